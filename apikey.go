@@ -0,0 +1,125 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var InvalidAPIKeyError = errors.New("Invalid or expired API key.")
+var UnknownScopeError = errors.New("Unknown API key scope.")
+
+// Actions a key can be scoped to, besides ActionWriteDocuments and
+// ActionWriteFiles.
+const (
+	ActionReadDocuments = "documents:read"
+	ActionReadFiles     = "files:read"
+)
+
+// Scopes API keys can be granted.
+var APIKeyScopes = []string{ActionReadDocuments, ActionWriteDocuments, ActionReadFiles, ActionWriteFiles}
+
+// Every key starts with this, so that leaked keys are easy to spot.
+const apiKeyMarker = "qdk_"
+
+// Length of the part of the key kept in clear, to tell keys apart.
+const apiKeyPrefixLength = len(apiKeyMarker) + 8
+
+// APIKey lets scripts and the browser extension act on behalf of a user,
+// within the granted scopes. Only the hash of the key is stored.
+type APIKey struct {
+	ID        bson.ObjectId `bson:"_id"                 json:"keyID"`
+	User      bson.ObjectId `bson:"user"                json:"-"`
+	Label     string        `bson:"label"               json:"label"`
+	Prefix    string        `bson:"prefix"              json:"prefix"`
+	Hash      []byte        `bson:"hash"                json:"-"`
+	Scopes    []string      `bson:"scopes"              json:"scopes"`
+	Created   time.Time     `bson:"created"             json:"created"`
+	ExpiresAt time.Time     `bson:"expires,omitempty"   json:"expires,omitempty"`
+	LastUsed  time.Time     `bson:"last_used,omitempty" json:"lastUsed,omitempty"`
+}
+
+// HasScope tells whether action is among the granted scopes.
+func HasScope(scopes []string, action string) bool {
+	for _, s := range scopes {
+		if s == action {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateAPIKey returns a new key of the user, granting the given scopes.
+// A zero ttl makes a key that never expires. The key is not stored
+// anywhere and can't be recovered.
+func (u *User) CreateAPIKey(label string, scopes []string, ttl time.Duration) (string, *APIKey, error) {
+	if len(scopes) == 0 {
+		return "", nil, UnknownScopeError
+	}
+	for _, s := range scopes {
+		if !HasScope(APIKeyScopes, s) {
+			return "", nil, UnknownScopeError
+		}
+	}
+	raw := apiKeyMarker + RandomUrlencodedString(30)
+	now := timeNow()
+	k := &APIKey{
+		ID:      bson.NewObjectId(),
+		User:    u.ID,
+		Label:   label,
+		Prefix:  raw[:apiKeyPrefixLength],
+		Hash:    hashToken(raw),
+		Scopes:  scopes,
+		Created: now,
+	}
+	if ttl > 0 {
+		k.ExpiresAt = now.Add(ttl)
+	}
+	if err := getStore().APIKeys().Insert(k); err != nil {
+		return "", nil, err
+	}
+	return raw, k, nil
+}
+
+// APIKeys lists the user's keys, expired ones included.
+func (u *User) APIKeys() ([]APIKey, error) {
+	return getStore().APIKeys().FindByUser(u.ID)
+}
+
+// RevokeAPIKey deletes one of the user's keys.
+func (u *User) RevokeAPIKey(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return NotFoundError
+	}
+	return getStore().APIKeys().Remove(u.ID, bson.ObjectIdHex(id))
+}
+
+// AuthenticateAPIKey returns the owner of the key and the scopes it grants.
+func AuthenticateAPIKey(raw string) (*User, []string, error) {
+	if !strings.HasPrefix(raw, apiKeyMarker) {
+		return nil, nil, InvalidAPIKeyError
+	}
+	keys := getStore().APIKeys()
+	k, err := keys.FindByHash(hashToken(raw))
+	if err == NotFoundError {
+		return nil, nil, InvalidAPIKeyError
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	now := timeNow()
+	if !k.ExpiresAt.IsZero() && !k.ExpiresAt.After(now) {
+		return nil, nil, InvalidAPIKeyError
+	}
+	u := &User{ID: k.User}
+	if err := u.Sync(); err != nil {
+		return nil, nil, InvalidAPIKeyError
+	}
+	if err := keys.Touch(k.ID, now); err != nil {
+		log.Println("Error recording API key use:", err)
+	}
+	return u, k.Scopes, nil
+}
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeys(t *testing.T) {
+	clock := setupAuthTest(t)
+	u := registerTestUser(t, "lena", "plum-Harbor-42")
+	if _, _, err := u.CreateAPIKey("bad", []string{"admin"}, 0); err != UnknownScopeError {
+		t.Error("Unknown scope granted:", err)
+	}
+	raw, key, err := u.CreateAPIKey("extension", []string{ActionWriteDocuments}, 0)
+	if err != nil {
+		t.Fatal("CreateAPIKey:", err)
+	}
+	if !strings.HasPrefix(raw, key.Prefix) || len(key.Prefix) >= len(raw) {
+		t.Error("Prefix doesn't identify the key:", key.Prefix)
+	}
+	short, _, _ := u.CreateAPIKey("script", []string{ActionReadDocuments}, time.Hour)
+
+	*clock = clock.Add(time.Minute)
+	owner, scopes, err := AuthenticateAPIKey(raw)
+	if err != nil || owner.ID != u.ID || !HasScope(scopes, ActionWriteDocuments) || HasScope(scopes, ActionReadFiles) {
+		t.Fatal("AuthenticateAPIKey:", err, scopes)
+	}
+	keys, err := u.APIKeys()
+	if err != nil || len(keys) != 2 {
+		t.Fatal("APIKeys:", err, len(keys))
+	}
+	for _, k := range keys {
+		if k.ID == key.ID && !k.LastUsed.Equal(*clock) {
+			t.Error("Last use not recorded:", k.LastUsed)
+		}
+	}
+	if _, _, err := AuthenticateAPIKey(raw + "x"); err != InvalidAPIKeyError {
+		t.Error("Wrong key accepted:", err)
+	}
+
+	*clock = clock.Add(time.Hour)
+	if _, _, err := AuthenticateAPIKey(short); err != InvalidAPIKeyError {
+		t.Error("Expired key accepted:", err)
+	}
+	if err := u.RevokeAPIKey(key.ID.Hex()); err != nil {
+		t.Fatal("RevokeAPIKey:", err)
+	}
+	if _, _, err := AuthenticateAPIKey(raw); err != InvalidAPIKeyError {
+		t.Error("Revoked key accepted:", err)
+	}
+}
@@ -2,78 +2,209 @@ package core
 
 import (
 	"log"
+	"net"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
-
 	"gopkg.in/mgo.v2/bson"
 )
 
-/*
+// LoginAttempt records one authentication attempt, successful or not.
 type LoginAttempt struct {
-	ID         bson.ObjectId `bson:"_id,omitempty"`
-	Username   string        `bson:"username"`
-	Date       time.Time     `bson:"last_login"`
-	Ip         net.IP        `bson:"ip"`
-	Successful bool          `bson:"success"`
-	Trial      int           `bson:"trial"`
-	TotalTrial int           `bson:"total_trial"`
+	ID         bson.ObjectId `bson:"_id,omitempty"  json:"-"`
+	UserID     bson.ObjectId `bson:"user,omitempty" json:"-"`
+	Username   string        `bson:"username"       json:"username"`
+	Date       time.Time     `bson:"date"           json:"date"`
+	Ip         string        `bson:"ip"             json:"ip"`
+	UserAgent  string        `bson:"ua"             json:"userAgent"`
+	Successful bool          `bson:"success"        json:"success"`
+	Outcome    string        `bson:"outcome"        json:"outcome"`
+	Trial      int           `bson:"trial"          json:"trial"`
+}
+
+// Outcomes of a LoginAttempt.
+const (
+	LoginSucceeded   = "success"
+	LoginBadPassword = "bad_password"
+	LoginLocked      = "locked"
+	LoginUnknownUser = "unknown_user"
+
+	LoginBadSecondFactor = "bad_second_factor"
+)
+
+// Do checks the given password for the attempt's username and, if it
+// matches, logs the user in. Either way the attempt is recorded.
+// Users with two-factor authentication enabled get a
+// *SecondFactorRequiredError instead, see DoSecondFactor.
+func (l *LoginAttempt) Do(password string) (*User, error) {
+	u := &User{
+		Username:         l.Username,
+		EnteredPassword:  password,
+		EnteredIp:        l.Ip,
+		EnteredUserAgent: l.UserAgent,
+	}
+	if err := u.CheckPassword(); err != nil {
+		return nil, err
+	}
+	if u.TOTPEnabled {
+		challenge, err := u.newLoginChallenge()
+		if err != nil {
+			return nil, err
+		}
+		return nil, &SecondFactorRequiredError{challenge}
+	}
+	u.Login()
+	return u, nil
 }
 
-func (l *LoginAttempt) Time() time.Time {
-	return l.ID.Time()
+// Records an attempt on the calling user's account, using the client's
+// address and user agent entered along with the credentials.
+func (u *User) recordAttempt(outcome string) *LoginAttempt {
+	a := &LoginAttempt{
+		UserID:     u.ID,
+		Username:   u.Username,
+		Date:       timeNow(),
+		Ip:         u.EnteredIp,
+		UserAgent:  u.EnteredUserAgent,
+		Successful: outcome == LoginSucceeded,
+		Outcome:    outcome,
+		Trial:      u.FailedLogins,
+	}
+	if err := getStore().LoginAttempts().Insert(a); err != nil {
+		log.Println("Error recording login attempt:", err)
+	}
+	return a
 }
 
-func (l *LoginAttempt) Do() *User {
-	return new(User)
+// RecentLoginAttempts returns up to n attempts on the user's account within
+// the retention window, newest first.
+func (u *User) RecentLoginAttempts(n int) ([]LoginAttempt, error) {
+	since := timeNow().Add(-getConfig().LoginAttemptRetention)
+	return getStore().LoginAttempts().FindByUser(u.ID, since, n)
+}
+
+// RecentLoginAttemptsByIp returns up to n attempts made from the given
+// address within the retention window, newest first.
+func RecentLoginAttemptsByIp(ip string, n int) ([]LoginAttempt, error) {
+	since := timeNow().Add(-getConfig().LoginAttemptRetention)
+	return getStore().LoginAttempts().FindByIp(ip, since, n)
+}
+
+// Returns the network an address belongs to, as a rough location:
+// the /24 for IPv4 and the /48 for IPv6.
+func ipNetwork(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// Tells whether a sign in comes from a device or network the user never
+// signed in from. The first sign in ever is not considered new.
+func (u *User) isNewSignIn(a *LoginAttempt) bool {
+	previous, err := u.RecentLoginAttempts(100)
+	if err != nil {
+		return false
+	}
+	known, seen := false, false
+	for _, p := range previous {
+		if !p.Successful || p.ID == a.ID {
+			continue
+		}
+		seen = true
+		if p.UserAgent == a.UserAgent && ipNetwork(p.Ip) == ipNetwork(a.Ip) {
+			known = true
+			break
+		}
+	}
+	return seen && !known
 }
-*/
 
 // Login will perform any actions that are required to make a user model
 // officially authenticated.
+// The attempt is recorded, and the client's new sign in hook runs if the
+// user signed in from an unknown device or network.
 func (u *User) Login() {
-	locSession := getSession()
-	defer locSession.Close()
-	c := locSession.DB(gqConfig.jobDatabase).C(UsersCollection)
-	update := bson.M{"$set": bson.M{"last_login": time.Now(), "fails": 0}}
-	err := c.UpdateId(u.ID, update)
+	err := getStore().Users().RecordLogin(u.ID, timeNow())
 	if err != nil {
 		log.Panic(err)
 	}
+	a := u.recordAttempt(LoginSucceeded)
+	if hook := std.onNewSignIn; hook != nil && u.isNewSignIn(a) {
+		hook(u, a)
+	}
 }
 
-// Function triggered on failed login. Counts failed attempts.
-func (u *User) LoginFailed() {
-	locSession := getSession()
-	defer locSession.Close()
-	c := locSession.DB(gqConfig.jobDatabase).C(UsersCollection)
-	update := bson.M{"$inc": bson.M{"fails": 1}}
-	c.UpdateId(u.ID, update)
+// Function triggered on failed login. Counts failed attempts and locks the
+// account as configured by the lockout policy, in which case it returns an
+// *AccountLockedError.
+func (u *User) LoginFailed() error {
+	return u.loginFailed(LoginBadPassword)
+}
+
+func (u *User) loginFailed(outcome string) error {
+	users := getStore().Users()
+	fails, err := users.IncFailedLogins(u.ID)
+	if err != nil {
+		return err
+	}
+	u.FailedLogins = fails
+	u.recordAttempt(outcome)
+	policy := getConfig().Lockout
+	if policy.Threshold <= 0 || fails < policy.Threshold {
+		return nil
+	}
+	until := timeNow().Add(policy.lockDuration(u.Lockouts))
+	if err := users.Lock(u.ID, until); err != nil {
+		return err
+	}
+	u.LockedUntil = until
+	u.Lockouts++
+	u.FailedLogins = 0
+	return &AccountLockedError{until}
 }
 
-/*
 // Logout will preform any actions that are required to completely
-// logout a user.
-func (u *User) Logout() {
-	_ = "Do nothing."
+// logout a user: every session is revoked, on every device.
+// Access tokens already issued stay valid until they expire.
+func (u *User) Logout() error {
+	return u.RevokeAllSessions()
 }
-*/
 
 // Check password against user.
-// Returns nil if successful.
+// Returns nil if successful, an *AccountLockedError if the account is
+// locked. A wrong password counts as a failed login.
+// Failures are recorded as login attempts; successes are recorded by Login.
 func (u *User) CheckPassword() error {
-	password := u.EnteredPassword
-	locSession := getSession()
-	defer locSession.Close()
-	c := locSession.DB(gqConfig.jobDatabase).C(UsersCollection)
-	err := c.Find(bson.M{"username": u.Username}).One(&u)
+	password, ip, userAgent := u.EnteredPassword, u.EnteredIp, u.EnteredUserAgent
+	stored, err := getStore().Users().FindByUsername(u.Username)
 	if err != nil {
+		if err == NotFoundError {
+			u.recordAttempt(LoginUnknownUser)
+		}
+		return err
+	}
+	*u = *stored
+	u.EnteredPassword, u.EnteredIp, u.EnteredUserAgent = password, ip, userAgent
+	if u.IsLocked() {
+		u.recordAttempt(LoginLocked)
+		return &AccountLockedError{u.LockedUntil}
+	}
+	err = comparePassword(u.Password, u.Salt, password)
+	if err == WrongPasswordError {
+		if lockErr := u.LoginFailed(); lockErr != nil {
+			return lockErr
+		}
 		return err
 	}
-	salted := append([]byte(password), u.Salt...)
-	err = bcrypt.CompareHashAndPassword(u.Password, salted)
 	if err != nil {
 		return err
 	}
+	if err := u.upgradePasswordHash(password); err != nil {
+		log.Println("Error upgrading password hash:", err)
+	}
 	return nil
 }
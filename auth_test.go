@@ -0,0 +1,249 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Installs a fresh memory store, a MemoryMailer and a controllable clock
+// for the test.
+func setupAuthTest(t *testing.T) *time.Time {
+	SetStore(NewMemoryStore())
+	mailer := std.mailer
+	std.SetMailer(new(MemoryMailer))
+	hashing := std.config.Passwords
+	std.config.Passwords.BcryptCost = bcrypt.MinCost
+	std.config.Passwords.Argon2Memory, std.config.Passwords.Argon2Time = 64, 1
+	clock := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return clock }
+	t.Cleanup(func() {
+		timeNow = time.Now
+		std.config.Passwords = hashing
+		std.SetMailer(mailer)
+	})
+	return &clock
+}
+
+// Delivers the outbox and returns the emails sent since setupAuthTest.
+func sentMail() []Message {
+	if _, err := DeliverOutbox(); err != nil {
+		panic(err)
+	}
+	return std.mailer.(*MemoryMailer).Messages()
+}
+
+func registerTestUser(t *testing.T, username, password string) *User {
+	u := new(User)
+	err := u.Register(User{Username: username, Email: username + "@example.com", EnteredPassword: password})
+	if err != nil {
+		t.Fatal("Register:", err)
+	}
+	return u
+}
+
+// Registers a user with the admin role.
+func registerTestAdmin(t *testing.T, username string) *User {
+	u := registerTestUser(t, username, "plum-Harbor-42")
+	u.Role = RoleAdmin
+	if err := getStore().Users().Update(u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestLockoutWithBackoff(t *testing.T) {
+	clock := setupAuthTest(t)
+	registerTestUser(t, "bob", "plum-Harbor-42")
+	policy := getConfig().Lockout
+
+	attempt := func(password string) error {
+		return (&User{Username: "bob", EnteredPassword: password}).CheckPassword()
+	}
+	for i := 1; i < policy.Threshold; i++ {
+		if _, locked := attempt("nope").(*AccountLockedError); locked {
+			t.Fatal("Locked after", i, "failures")
+		}
+	}
+	err := attempt("nope")
+	lockErr, ok := err.(*AccountLockedError)
+	if !ok {
+		t.Fatal("Expected an AccountLockedError, got", err)
+	}
+	if lockErr.RetryAfter() != policy.Duration {
+		t.Error("Unexpected first lock duration", lockErr.RetryAfter())
+	}
+	if _, ok := attempt("plum-Harbor-42").(*AccountLockedError); !ok {
+		t.Error("Right password accepted during lockout")
+	}
+
+	*clock = clock.Add(policy.Duration)
+	for i := 0; i < policy.Threshold; i++ {
+		err = attempt("nope")
+	}
+	lockErr, ok = err.(*AccountLockedError)
+	if !ok || lockErr.RetryAfter() != policy.lockDuration(1) || policy.lockDuration(1) <= policy.Duration {
+		t.Fatal("Expected a longer second lock, got", err)
+	}
+
+	u, _ := GetUserByName("bob")
+	if err := u.UnlockUser(u.ID.Hex()); err != ForbiddenError {
+		t.Error("User unlocked themselves:", err)
+	}
+	if err := registerTestAdmin(t, "root").UnlockUser(u.ID.Hex()); err != nil {
+		t.Fatal("UnlockUser:", err)
+	}
+	if err := attempt("plum-Harbor-42"); err != nil {
+		t.Error("Login after admin unlock:", err)
+	}
+}
+
+func TestChangePasswordLockout(t *testing.T) {
+	setupAuthTest(t)
+	u := registerTestUser(t, "bob", "plum-Harbor-42")
+	policy := getConfig().Lockout
+	var err error
+	for i := 0; i < policy.Threshold; i++ {
+		err = u.ChangePassword("nope", "brand-New-Fig1")
+	}
+	if _, ok := err.(*AccountLockedError); !ok {
+		t.Fatal("Expected wrong current passwords to lock the account, got", err)
+	}
+	if _, ok := u.ChangePassword("plum-Harbor-42", "brand-New-Fig1").(*AccountLockedError); !ok {
+		t.Error("Password changed during lockout")
+	}
+	attempts, _ := getStore().LoginAttempts().FindByUser(u.ID, time.Time{}, 100)
+	if len(attempts) != policy.Threshold+1 {
+		t.Error("Expected every try to be recorded, got", len(attempts))
+	}
+}
+
+func TestLoginAttemptsAndNewSignInHook(t *testing.T) {
+	clock := setupAuthTest(t)
+	u := registerTestUser(t, "carol", "plum-Harbor-42")
+	var alerts []LoginAttempt
+	std.OnNewSignIn(func(u *User, a *LoginAttempt) { alerts = append(alerts, *a) })
+	defer std.OnNewSignIn(nil)
+
+	login := func(password, ip, ua string) error {
+		*clock = clock.Add(time.Minute)
+		_, err := (&LoginAttempt{Username: "carol", Ip: ip, UserAgent: ua}).Do(password)
+		return err
+	}
+	login("plum-Harbor-42", "192.0.2.10", "Firefox")
+	login("nope", "198.51.100.7", "curl")
+	login("plum-Harbor-42", "192.0.2.99", "Firefox")
+	if len(alerts) != 0 {
+		t.Error("Alerted for a known device and network:", alerts)
+	}
+	login("plum-Harbor-42", "198.51.100.7", "Firefox")
+	if len(alerts) != 1 || alerts[0].Ip != "198.51.100.7" {
+		t.Error("Expected one alert for the new network, got", alerts)
+	}
+
+	attempts, err := u.RecentLoginAttempts(10)
+	if err != nil || len(attempts) != 4 {
+		t.Fatal("RecentLoginAttempts:", len(attempts), err)
+	}
+	if attempts[2].Successful || attempts[2].Outcome != LoginBadPassword || attempts[2].UserAgent != "curl" {
+		t.Error("Unexpected failed attempt record", attempts[2])
+	}
+	byIp, _ := RecentLoginAttemptsByIp("198.51.100.7", 10)
+	if len(byIp) != 2 {
+		t.Error("Expected two attempts from 198.51.100.7, got", len(byIp))
+	}
+
+	*clock = clock.Add(getConfig().LoginAttemptRetention + time.Minute)
+	if attempts, _ := u.RecentLoginAttempts(10); len(attempts) != 0 {
+		t.Error("Attempts outside the retention window returned:", len(attempts))
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	clock := setupAuthTest(t)
+	u := registerTestUser(t, "erin", "plum-Harbor-42")
+	session, _, _ := u.NewSession("laptop")
+
+	if err := RequestPasswordReset("nobody@example.com"); err != nil {
+		t.Error("RequestPasswordReset revealed an unknown address:", err)
+	}
+	stale, _ := u.createPasswordReset()
+	token, _ := u.createPasswordReset()
+
+	if err := ResetPassword(token, "short"); err == nil {
+		t.Fatal("Weak password accepted")
+	}
+	if err := ResetPassword(token, "brand-New-Fig1"); err != nil {
+		t.Fatal("ResetPassword:", err)
+	}
+	if err := ResetPassword(token, "brand-New-Fig2"); err != InvalidResetTokenError {
+		t.Error("Reset token reused:", err)
+	}
+	if err := ResetPassword(stale, "brand-New-Fig2"); err != InvalidResetTokenError {
+		t.Error("Other reset token still valid:", err)
+	}
+	if _, _, err := RefreshSession(session); err != InvalidRefreshTokenError {
+		t.Error("Session survived password reset:", err)
+	}
+	if err := (&User{Username: "erin", EnteredPassword: "brand-New-Fig1"}).CheckPassword(); err != nil {
+		t.Error("New password rejected:", err)
+	}
+
+	expired, _ := u.createPasswordReset()
+	*clock = clock.Add(getConfig().PasswordResetTTL)
+	if err := ResetPassword(expired, "brand-New-Fig3"); err != InvalidResetTokenError {
+		t.Error("Expired reset token accepted:", err)
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	clock := setupAuthTest(t)
+	std.config.RequireVerifiedEmail = []string{ActionWriteDocuments}
+	defer func() { std.config.RequireVerifiedEmail = nil }()
+	u := registerTestUser(t, "erin", "plum-Harbor-42")
+
+	if err := u.AddDocument(&Document{Title: "draft"}); err != EmailNotVerifiedError {
+		t.Error("Unverified user wrote a document:", err)
+	}
+	if err := u.ResendVerification(); err != ResendTooSoonError {
+		t.Error("Expected ResendTooSoonError, got", err)
+	}
+	first := u.VerificationCode
+	*clock = clock.Add(getConfig().VerificationResendInterval)
+	if err := u.ResendVerification(); err == ResendTooSoonError {
+		t.Fatal("Resend refused after the interval")
+	}
+	if _, err := VerifyEmail(first); err != InvalidVerificationCodeError {
+		t.Error("Superseded code accepted:", err)
+	}
+
+	*clock = clock.Add(getConfig().EmailVerificationTTL)
+	if _, err := VerifyEmail(u.VerificationCode); err != VerificationCodeExpiredError {
+		t.Error("Expected VerificationCodeExpiredError, got", err)
+	}
+	*clock = clock.Add(getConfig().VerificationResendInterval)
+	if err := u.ResendVerification(); err == ResendTooSoonError {
+		t.Fatal("Resend refused after expiry")
+	}
+	verified, err := VerifyEmail(u.VerificationCode)
+	if err != nil || !verified.EmailVerified || verified.ID != u.ID {
+		t.Fatal("VerifyEmail:", err)
+	}
+	if err := verified.AddDocument(&Document{Title: "draft"}); err != nil {
+		t.Error("Verified user couldn't write a document:", err)
+	}
+
+	// A user known only by ID, such as one built from token claims, doesn't
+	// overwrite the rest of the account.
+	partial := &User{ID: verified.ID}
+	if err := partial.ChangeEmail("erin@example.org"); err != nil {
+		t.Fatal("ChangeEmail:", err)
+	}
+	if err := verified.Sync(); err != nil || verified.EmailVerified || verified.VerificationCode == "" {
+		t.Error("Changed address not pending verification")
+	}
+	if verified.Username != "erin" || !verified.HasPassword || len(verified.Password) == 0 {
+		t.Errorf("ChangeEmail overwrote the account: %+v", verified)
+	}
+}
@@ -0,0 +1,143 @@
+package core
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// Client bundles the configuration and the storage backend used by the package.
+type Client struct {
+	config      Config
+	store       Store
+	onNewSignIn func(u *User, a *LoginAttempt)
+	breaches    BreachSource
+	mailer      Mailer
+
+	templatesOnce sync.Once
+	templates     *Templates
+	templatesErr  error
+
+	catalogsOnce sync.Once
+	catalogs     Catalogs
+	catalogsErr  error
+
+	rolesMu sync.RWMutex
+	roles   map[int]RoleDef
+}
+
+// std is the client used by the package-level functions and by the
+// User, Document and SignupCode methods.
+var std *Client
+
+// New returns a Client backed by the MongoDB instance described in cfg,
+// after validating it.
+// No connection is attempted until the first query, or until EnsureSchema.
+func New(ctx context.Context, cfg Config) (*Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return NewWithStore(cfg, DialMgoStore(cfg)), nil
+}
+
+// NewWithStore returns a Client using the given backend, such as a MemoryStore.
+func NewWithStore(cfg Config, s Store) *Client {
+	return &Client{config: cfg, store: s, mailer: newMailer(cfg), roles: defaultRoles()}
+}
+
+// Store returns the client's backend.
+func (c *Client) Store() Store {
+	return c.store
+}
+
+// Config returns the client's configuration.
+func (c *Client) Config() Config {
+	return c.config
+}
+
+// EnsureSchema creates the collections' indexes. It is safe to run it
+// more than once.
+func (c *Client) EnsureSchema(ctx context.Context) error {
+	return c.store.EnsureSchema(ctx)
+}
+
+// Close releases the connections held by the backend.
+func (c *Client) Close() error {
+	return c.store.Close()
+}
+
+// OnNewSignIn registers a function run, synchronously, whenever a user
+// logs in from a device or network they never signed in from before,
+// so that they can be alerted.
+func (c *Client) OnNewSignIn(f func(u *User, a *LoginAttempt)) {
+	c.onNewSignIn = f
+}
+
+// CheckBreaches makes the client refuse new passwords found in the
+// breaches known to source, such as PwnedPasswords{}. A nil source
+// disables the check, which is the default.
+func (c *Client) CheckBreaches(source BreachSource) {
+	c.breaches = source
+}
+
+// Mailer returns the mail transport, such as the MemoryMailer chosen with
+// Config.Mailer set to memory, to read the emails it kept.
+func (c *Client) Mailer() Mailer {
+	return c.mailer
+}
+
+// SetMailer replaces the mail transport chosen by Config.Mailer, such as
+// with a MemoryMailer in tests.
+func (c *Client) SetMailer(m Mailer) {
+	c.mailer = m
+}
+
+// SetTemplates replaces the email templates read from Config.TemplateDir.
+func (c *Client) SetTemplates(t *Templates) {
+	c.templatesOnce.Do(func() {})
+	c.templates, c.templatesErr = t, nil
+}
+
+// Loads the email templates on first use.
+func (c *Client) getTemplates() (*Templates, error) {
+	c.templatesOnce.Do(func() {
+		c.templates, c.templatesErr = loadConfiguredTemplates(c.config.TemplateDir)
+	})
+	return c.templates, c.templatesErr
+}
+
+// Loads the message catalogs on first use.
+func (c *Client) getCatalogs() (Catalogs, error) {
+	c.catalogsOnce.Do(func() {
+		c.catalogs, c.catalogsErr = loadConfiguredCatalogs(c.config.LocaleDir)
+	})
+	return c.catalogs, c.catalogsErr
+}
+
+// SetDefaultClient makes c the client used by the package-level functions
+// and by the User, Document and SignupCode methods.
+// It is meant to be called once, before serving any request.
+func SetDefaultClient(c *Client) {
+	std = c
+}
+
+func getConfig() Config {
+	return std.config
+}
+
+func getMailer() Mailer {
+	return std.mailer
+}
+
+func init() {
+	// Nothing is dialed nor validated here: the connection is established
+	// on first use, and services are expected to build their own client.
+	cfg := DefaultConfig()
+	if err := FromEnv()(&cfg); err != nil {
+		log.Println("Error reading the configuration from the environment, the default client may be misconfigured:", err)
+	}
+	std = NewWithStore(cfg, DialMgoStore(cfg))
+}
@@ -1,56 +1,227 @@
 package core
 
 import (
+	"crypto/rand"
 	"errors"
+	"log"
+	"strings"
 	"time"
 
 	"gopkg.in/mgo.v2/bson"
 )
 
+var SignupCodeNotRecognizedError = errors.New("Code not recognized.")
+
+// Permission needed to generate, list and revoke signup codes.
+const ActionManageSignupCodes = "signup_codes:manage"
+
+// Letters of generated codes: no vowels, so that codes don't spell words,
+// and none of 0, 1, O, I or L, which are easily mistaken for one another.
+const signupCodeAlphabet = "23456789BCDFGHJKMNPQRSTVWXYZ"
+
+// Generated codes are made of two groups of this many letters.
+const signupCodeGroupLength = 4
+
 ////////////////////////////////
 // SignupCodes are keys meant to grant access to signup either to a person with a code,
 // either to a specific email address without providing a code.
 ////////////////////////////////
 
 type SignupCode struct {
-	ID         bson.ObjectId `bson:"_id,omitempty"     json:"-"`
-	EmailBound bool          `bson:"is_email_bound"    json:"is_email_bound"`
-	Email      string        `bson:"email"             json:"email"`
-	Code       string        `bson:"code"              json:"code"`
-	Used       time.Time     `bson:"used_at,omitempty" json:"used_at"`
+	ID          bson.ObjectId `bson:"_id,omitempty"     json:"-"`
+	EmailBound  bool          `bson:"is_email_bound"    json:"is_email_bound"`
+	Email       string        `bson:"email"             json:"email"`
+	Code        string        `bson:"code"              json:"code"`
+	Used        time.Time     `bson:"used_at,omitempty" json:"used_at"`
+	Label       string        `bson:"label,omitempty"   json:"label,omitempty"`
+	Creator     bson.ObjectId `bson:"creator,omitempty" json:"-"`
+	Created     time.Time     `bson:"created,omitempty" json:"created,omitempty"`
+	ExpiresAt   time.Time     `bson:"expires,omitempty" json:"expires,omitempty"`
+	MaxUses     int           `bson:"max_uses"          json:"max_uses"`
+	Uses        int           `bson:"uses"              json:"uses"`
+	Redemptions []Redemption  `bson:"redemptions"       json:"redemptions"`
+	Revoked     time.Time     `bson:"revoked,omitempty" json:"revoked,omitempty"`
+	// PendingMail holds the invitation, until it is moved to the outbox.
+	PendingMail []OutboxMessage `bson:"pending_mail,omitempty" json:"-"`
+}
+
+// Redemption records a signup made with a code.
+type Redemption struct {
+	Username string    `bson:"username" json:"username"`
+	Email    string    `bson:"email"    json:"email"`
+	At       time.Time `bson:"at"       json:"at"`
+}
+
+// SignupCodeOptions are the settings of a batch of generated codes.
+type SignupCodeOptions struct {
+	// Label names the batch, such as "launch-party".
+	Label string
+	// MaxUses is how many signups each code allows, one if zero.
+	MaxUses int
+	// ExpiresAt is when the codes stop working. The zero time means never.
+	ExpiresAt time.Time
 }
 
 // Saves a new code to the database.
 func (s *SignupCode) Persist() error {
-	locSession := getSession()
-	defer locSession.Close()
-	c := locSession.DB(gqConfig.jobDatabase).C(SignupCodesCollection)
-	return c.Insert(s)
+	return getStore().SignupCodes().Insert(s)
 }
 
-// Check whether user is entitled to sign up, calling User.Register if OK
+// How many random codes are drawn for a new signup code before giving up,
+// should they all be taken.
+const signupCodeDraws = 5
+
+// Saves a new code under a random code, drawing another one while the
+// drawn code is taken. If mail isn't nil, the email it returns for the
+// drawn code is saved with it.
+func (s *SignupCode) persistRandom(mail func() (*OutboxMessage, error)) error {
+	var err error
+	for i := 0; i < signupCodeDraws; i++ {
+		s.Code = newSignupCode()
+		if mail != nil {
+			m, err := mail()
+			if err != nil {
+				return err
+			}
+			s.PendingMail = []OutboxMessage{*m}
+		}
+		if err = s.Persist(); err != DuplicateKeyError {
+			return err
+		}
+	}
+	return err
+}
+
+// Codes saved before use counts existed record their single use in Used.
+func (s *SignupCode) uses() int {
+	if s.Uses == 0 && !s.Used.IsZero() {
+		return 1
+	}
+	return s.Uses
+}
+
+func (s *SignupCode) maxUses() int {
+	if s.MaxUses < 1 {
+		return 1
+	}
+	return s.MaxUses
+}
+
+// Tells whether the code lets the given address sign up at the given time.
+func (s *SignupCode) usableBy(email string, at time.Time) bool {
+	return s.Revoked.IsZero() &&
+		(s.ExpiresAt.IsZero() || at.Before(s.ExpiresAt)) &&
+		s.uses() < s.maxUses() &&
+		(!s.EmailBound || s.Email == email)
+}
+
+// Returns a random code such as "K7QW-3MZD".
+func newSignupCode() string {
+	// Bytes past the last multiple of the alphabet's length are discarded,
+	// so that every character is as likely.
+	limit := 256 - 256%len(signupCodeAlphabet)
+	code := make([]byte, 0, 2*signupCodeGroupLength+1)
+	raw := make([]byte, 2*signupCodeGroupLength)
+	for len(code) < cap(code) {
+		if _, err := rand.Read(raw); err != nil {
+			panic(err)
+		}
+		for _, b := range raw {
+			if int(b) >= limit || len(code) == cap(code) {
+				continue
+			}
+			if len(code) == signupCodeGroupLength {
+				code = append(code, '-')
+			}
+			code = append(code, signupCodeAlphabet[int(b)%len(signupCodeAlphabet)])
+		}
+	}
+	return string(code)
+}
+
+// Puts a code typed by a user in the form generated codes are stored in.
+func normalizeSignupCode(code string) string {
+	code = strings.ToUpper(strings.Join(strings.Fields(code), ""))
+	if len(code) == 2*signupCodeGroupLength {
+		code = code[:signupCodeGroupLength] + "-" + code[signupCodeGroupLength:]
+	}
+	return code
+}
+
+// GenerateSignupCodes creates n random codes sharing the given options,
+// on behalf of actor.
+func (actor *User) GenerateSignupCodes(n int, opts SignupCodeOptions) ([]SignupCode, error) {
+	if err := Authorize(actor, ActionManageSignupCodes, nil); err != nil {
+		return nil, err
+	}
+	now := timeNow()
+	codes := make([]SignupCode, 0, n)
+	for len(codes) < n {
+		sc := SignupCode{
+			Label:       opts.Label,
+			Creator:     actor.ID,
+			Created:     now,
+			ExpiresAt:   opts.ExpiresAt,
+			MaxUses:     opts.MaxUses,
+			Redemptions: []Redemption{},
+		}
+		if sc.MaxUses < 1 {
+			sc.MaxUses = 1
+		}
+		if err := sc.persistRandom(nil); err != nil {
+			return codes, err
+		}
+		codes = append(codes, sc)
+	}
+	return codes, nil
+}
+
+// SignupCodes lists the codes of a batch, or all of them if label is empty,
+// with their redemptions.
+func (actor *User) SignupCodes(label string) ([]SignupCode, error) {
+	if err := Authorize(actor, ActionManageSignupCodes, nil); err != nil {
+		return nil, err
+	}
+	return getStore().SignupCodes().List(label)
+}
+
+// RevokeSignupCode stops a code from being used for further signups.
+func (actor *User) RevokeSignupCode(id string) error {
+	if err := Authorize(actor, ActionManageSignupCodes, nil); err != nil {
+		return err
+	}
+	if !bson.IsObjectIdHex(id) {
+		return NotFoundError
+	}
+	return getStore().SignupCodes().Revoke(bson.ObjectIdHex(id), timeNow())
+}
+
+// Check whether user is entitled to sign up, calling User.Register if OK.
+// The code is claimed before registering, so that concurrent signups can't
+// use it more than allowed, and released if the registration fails.
 func (u *User) SignupWithCode(code string) error {
-	errorCodeNotRecognized := errors.New("Code not recognized")
-	signupCodes := []SignupCode{}
-	locSession := getSession()
-	defer locSession.Close()
-	c := locSession.DB(gqConfig.jobDatabase).C(SignupCodesCollection)
-	err := c.Find(bson.M{"code": code}).All(&signupCodes)
+	codes := getStore().SignupCodes()
+	r := Redemption{Username: u.Username, Email: u.Email, At: timeNow()}
+	sc, err := codes.Claim(code, r)
+	if normalized := normalizeSignupCode(code); err == NotFoundError && normalized != code {
+		sc, err = codes.Claim(normalized, r)
+	}
+	if err == NotFoundError {
+		return SignupCodeNotRecognizedError
+	}
 	if err != nil {
 		return err
 	}
-	for _, sc := range signupCodes {
-		// If not used AND (not bound OR bound to the right address)
-		if (sc.Used == time.Time{}) && (sc.EmailBound && u.Email == sc.Email || !sc.EmailBound) {
-			u.CodeUsed = sc.ID
-			err = u.Register(*u)
-			if err != nil {
-				return err
-			}
-			sc.Used = time.Now()
-			c.UpdateId(sc.ID, sc)
-			return nil
+	u.CodeUsed = sc.ID
+	if sc.isInvitation() {
+		u.InvitedBy = sc.Creator
+	}
+	if err := u.Register(*u); err != nil {
+		if releaseErr := codes.Release(sc.ID, r); releaseErr != nil {
+			log.Println("Error releasing signup code:", releaseErr)
 		}
+		u.CodeUsed, u.InvitedBy = "", ""
+		return err
 	}
-	return errorCodeNotRecognized
+	return nil
 }
@@ -0,0 +1,177 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// Returns a MongoDB store on throwaway collections, skipping the test if
+// no server answers. QDOC_TEST_MONGO overrides the default localhost.
+func testMgoStore(t *testing.T) *MgoStore {
+	cfg := DefaultConfig()
+	if hosts := os.Getenv("QDOC_TEST_MONGO"); hosts != "" {
+		cfg.MongoDBHosts = hosts
+	}
+	cfg.JobDatabase = "qdoc_test"
+	WithCollectionPrefix(fmt.Sprintf("t%d_", time.Now().UnixNano()))(&cfg)
+	s := DialMgoStore(cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.EnsureSchema(ctx); err != nil {
+		t.Skip("MongoDB unavailable:", err)
+	}
+	t.Cleanup(func() {
+		for _, f := range configFields(&cfg) {
+			s.with(f.value.String(), func(c *mgo.Collection) error { return c.DropCollection() })
+		}
+		s.Close()
+	})
+	return s
+}
+
+func TestConcurrentSignupWithCode(t *testing.T) {
+	stores := map[string]func(*testing.T) Store{
+		"memory": func(*testing.T) Store { return NewMemoryStore() },
+		"mongo":  func(t *testing.T) Store { return testMgoStore(t) },
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			setupAuthTest(t)
+			SetStore(newStore(t))
+			if err := (&SignupCode{Code: "WELCOME"}).Persist(); err != nil {
+				t.Fatal("Persist:", err)
+			}
+
+			var wg sync.WaitGroup
+			results := make(chan error, 20)
+			for i := 0; i < cap(results); i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					u := &User{
+						Username:        fmt.Sprintf("racer%d", i),
+						Email:           fmt.Sprintf("racer%d@example.com", i),
+						EnteredPassword: "plum-Harbor-42",
+					}
+					results <- u.SignupWithCode("WELCOME")
+				}(i)
+			}
+			wg.Wait()
+			close(results)
+			registered := 0
+			for err := range results {
+				if err == nil {
+					registered++
+				} else if err != SignupCodeNotRecognizedError {
+					t.Error("Unexpected error:", err)
+				}
+			}
+			if registered != 1 {
+				t.Fatalf("Code used %d times", registered)
+			}
+
+			// A failed registration gives the code back.
+			if err := (&SignupCode{Code: "AGAIN"}).Persist(); err != nil {
+				t.Fatal("Persist:", err)
+			}
+			registerTestUser(t, "taken", "plum-Harbor-42")
+			taken := &User{Username: "taken", Email: "dup@example.com", EnteredPassword: "plum-Harbor-42"}
+			if err := taken.SignupWithCode("AGAIN"); err != UsernameAlreadyTakenError {
+				t.Fatal("Expected a failed registration, got", err)
+			}
+			fresh := &User{Username: "latecomer", Email: "late@example.com", EnteredPassword: "plum-Harbor-42"}
+			if err := fresh.SignupWithCode("AGAIN"); err != nil {
+				t.Error("Code not released after a failed registration:", err)
+			}
+
+			// Multi-use codes too, once used.
+			if err := (&SignupCode{Code: "TWICE", MaxUses: 2}).Persist(); err != nil {
+				t.Fatal("Persist:", err)
+			}
+			for _, name := range []string{"first", "taken", "second"} {
+				u := &User{Username: name, Email: name + "@example.org", EnteredPassword: "plum-Harbor-42"}
+				err := u.SignupWithCode("TWICE")
+				if name == "taken" && err != UsernameAlreadyTakenError || name != "taken" && err != nil {
+					t.Fatal("SignupWithCode as", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateSignupCodes(t *testing.T) {
+	clock := setupAuthTest(t)
+	admin := registerTestAdmin(t, "admin")
+	if _, err := registerTestUser(t, "bob", "plum-Harbor-42").GenerateSignupCodes(1, SignupCodeOptions{}); err != ForbiddenError {
+		t.Fatal("Expected ForbiddenError, got", err)
+	}
+	codes, err := admin.GenerateSignupCodes(3, SignupCodeOptions{Label: "launch", MaxUses: 2, ExpiresAt: clock.Add(time.Hour)})
+	if err != nil {
+		t.Fatal("GenerateSignupCodes:", err)
+	}
+	if len(codes) != 3 || codes[0].Code == codes[1].Code {
+		t.Fatal("Unexpected codes:", codes)
+	}
+	if len(codes[0].Code) != 9 || codes[0].Code[4] != '-' || codes[0].Creator != admin.ID {
+		t.Error("Unexpected code:", codes[0])
+	}
+	if err := (&SignupCode{Code: codes[0].Code}).Persist(); err != DuplicateKeyError {
+		t.Error("Expected DuplicateKeyError for a taken code, got", err)
+	}
+
+	signup := func(name, code string) error {
+		u := &User{Username: name, Email: name + "@example.com", EnteredPassword: "plum-Harbor-42"}
+		return u.SignupWithCode(code)
+	}
+	// Codes are typed in any case, with or without the dash.
+	typed := strings.ToLower(strings.Replace(codes[0].Code, "-", " ", 1))
+	if err := signup("carol", typed); err != nil {
+		t.Fatal("SignupWithCode:", err)
+	}
+	if err := signup("bob", codes[0].Code); err != UsernameAlreadyTakenError {
+		t.Fatal("Expected UsernameAlreadyTakenError, got", err)
+	}
+	if err := signup("dave", codes[0].Code); err != nil {
+		t.Fatal("Second use:", err)
+	}
+	if err := signup("erin", codes[0].Code); err != SignupCodeNotRecognizedError {
+		t.Error("Code used more than MaxUses:", err)
+	}
+
+	listed, err := admin.SignupCodes("launch")
+	if err != nil {
+		t.Fatal("SignupCodes:", err)
+	}
+	for _, sc := range listed {
+		if sc.ID != codes[0].ID {
+			continue
+		}
+		if sc.Uses != 2 || len(sc.Redemptions) != 2 || sc.Redemptions[0].Username != "carol" || sc.Redemptions[1].Username != "dave" {
+			t.Error("Unexpected redemptions:", sc.Uses, sc.Redemptions)
+		}
+	}
+	if len(listed) != 3 {
+		t.Error("Expected 3 codes, got", len(listed))
+	}
+	if others, _ := admin.SignupCodes("other"); len(others) != 0 {
+		t.Error("Listed codes of another batch:", others)
+	}
+
+	if err := admin.RevokeSignupCode(codes[1].ID.Hex()); err != nil {
+		t.Fatal("RevokeSignupCode:", err)
+	}
+	if err := signup("erin", codes[1].Code); err != SignupCodeNotRecognizedError {
+		t.Error("Revoked code used:", err)
+	}
+	*clock = clock.Add(time.Hour)
+	if err := signup("erin", codes[2].Code); err != SignupCodeNotRecognizedError {
+		t.Error("Expired code used:", err)
+	}
+}
@@ -0,0 +1,103 @@
+// Command qdoc-waitlist lets administrators see and release the waitlist.
+//
+// Usage:
+//
+//	qdoc-waitlist [-config file] -as admin list
+//	qdoc-waitlist [-config file] -as admin release N
+//
+// The configuration is read from the file, if any, then from the QDOC_*
+// environment variables. Actions are authorized as the named user.
+// Invitations are queued in the outbox, for the server's worker to send.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/goquadro/core"
+)
+
+func main() {
+	configFile := flag.String("config", "", "configuration `file` (JSON, YAML or TOML)")
+	as := flag.String("as", "", "`username` of the administrator to act as")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: qdoc-waitlist [-config file] -as admin list|release N")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *as == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var opts []core.Option
+	if *configFile != "" {
+		opts = append(opts, core.FromFile(*configFile))
+	}
+	cfg, err := core.LoadConfig(append(opts, core.FromEnv())...)
+	if err != nil {
+		fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DialTimeout)
+	defer cancel()
+	client, err := core.New(ctx, cfg)
+	if err != nil {
+		fatal(err)
+	}
+	defer client.Close()
+	core.SetDefaultClient(client)
+
+	admin, err := core.GetUserByName(*as)
+	if err != nil {
+		fatal(fmt.Errorf("%s: %v", *as, err))
+	}
+
+	switch flag.Arg(0) {
+	case "list":
+		entries, err := admin.Waitlist()
+		if err != nil {
+			fatal(err)
+		}
+		printEntries(entries)
+	case "release":
+		n, err := strconv.Atoi(flag.Arg(1))
+		if err != nil || n <= 0 {
+			fatal(fmt.Errorf("release needs a positive number of people"))
+		}
+		released, err := admin.ReleaseWaitlist(n)
+		printEntries(released)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Printf("Released %d of %d.\n", len(released), n)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func printEntries(entries []core.WaitlistEntry) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "POSITION\tEMAIL\tJOINED\tSTATUS")
+	for _, e := range entries {
+		position, status := "-", "unverified"
+		switch {
+		case !e.Invited.IsZero():
+			status = "invited " + e.Invited.Format(time.RFC3339)
+		case e.Position > 0:
+			position, status = strconv.Itoa(e.Position), "waiting"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", position, e.Email, e.Joined.Format(time.RFC3339), status)
+	}
+	w.Flush()
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "qdoc-waitlist:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,540 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+const redacted = "********"
+
+// Config is the struct in which are stored all the credentials
+// used throughout the package.
+//
+// Every field can be set from a configuration file, using the key in its
+// `config` tag, and from the environment variable in its `env` tag.
+// Fields tagged `secret` are never printed.
+type Config struct {
+	MailgunDomain            string          `config:"mailgun_domain"         env:"QDOC_MAILGUN_DOMAIN"`
+	MailgunKey               string          `config:"mailgun_key"            env:"QDOC_MAILGUN_PRIVATE_KEY" secret:"true"`
+	MailgunPubKey            string          `config:"mailgun_public_key"     env:"QDOC_MAILGUN_PUBLIC_KEY"`
+	NotificationAddress      string          `config:"notification_address"   env:"QDOC_NOTIFICATION_ADDRESS"`
+	Mailer                   string          `config:"mailer"                 env:"QDOC_MAILER"`
+	SMTP                     SMTPConfig      `config:"smtp"`
+	MailDir                  string          `config:"mail_dir"               env:"QDOC_MAIL_DIR"`
+	TemplateDir              string          `config:"template_dir"           env:"QDOC_TEMPLATE_DIR"`
+	LocaleDir                string          `config:"locale_dir"             env:"QDOC_LOCALE_DIR"`
+	DefaultLocale            string          `config:"default_locale"         env:"QDOC_DEFAULT_LOCALE"`
+	MongoDBHosts             string          `config:"mongo_hosts"            env:"QDOC_MONGO_HOST"`
+	AuthDatabase             string          `config:"mongo_auth_db"          env:"QDOC_MONGO_AUTH_DB"`
+	AuthUserName             string          `config:"mongo_user"             env:"QDOC_MONGO_USER"`
+	AuthPassword             string          `config:"mongo_password"         env:"QDOC_MONGO_PW"            secret:"true"`
+	JobDatabase              string          `config:"mongo_db"               env:"QDOC_MONGO_DB"`
+	UsersCollection          string          `config:"users_collection"       env:"QDOC_USERS_COLLECTION"`
+	DocumentsCollection      string          `config:"documents_collection"   env:"QDOC_DOCUMENTS_COLLECTION"`
+	SignupCodesCollection    string          `config:"signupcodes_collection" env:"QDOC_SIGNUPCODES_COLLECTION"`
+	FilesCollection          string          `config:"files_collection"       env:"QDOC_FILES_COLLECTION"`
+	SubscribersCollection    string          `config:"subscribers_collection" env:"QDOC_SUBSCRIBERS_COLLECTION"`
+	LoginAttemptsCollection  string          `config:"loginattempts_collection" env:"QDOC_LOGINATTEMPTS_COLLECTION"`
+	SessionsCollection       string          `config:"sessions_collection"      env:"QDOC_SESSIONS_COLLECTION"`
+	PasswordResetsCollection string          `config:"passwordresets_collection" env:"QDOC_PASSWORDRESETS_COLLECTION"`
+	APIKeysCollection        string          `config:"apikeys_collection"        env:"QDOC_APIKEYS_COLLECTION"`
+	WaitlistCollection       string          `config:"waitlist_collection"       env:"QDOC_WAITLIST_COLLECTION"`
+	OutboxCollection         string          `config:"outbox_collection"         env:"QDOC_OUTBOX_COLLECTION"`
+	MailEventCollection      string          `config:"mail_event_collection"     env:"QDOC_MAIL_EVENT_COLLECTION"`
+	SuppressionCollection    string          `config:"suppression_collection"    env:"QDOC_SUPPRESSION_COLLECTION"`
+	DialTimeout              time.Duration   `config:"dial_timeout"           env:"QDOC_MONGO_TIMEOUT"`
+	Lockout                  LockoutPolicy   `config:"lockout"`
+	Tokens                   TokenConfig     `config:"tokens"`
+	Passwords                PasswordHashing `config:"passwords"`
+	PasswordPolicy           PasswordPolicy  `config:"password_policy"`
+	Outbox                   OutboxConfig    `config:"outbox"`
+	// Google holds the OAuth client used for "Sign in with Google".
+	Google OIDCConfig `config:"google"`
+	// BaseURL is the address of the web application, used in emailed links.
+	BaseURL string `config:"base_url" env:"QDOC_BASE_URL"`
+	// TOTPIssuer names the service in authenticator apps.
+	TOTPIssuer string `config:"totp_issuer" env:"QDOC_TOTP_ISSUER"`
+	// PasswordResetTTL is how long a password reset link is valid.
+	PasswordResetTTL time.Duration `config:"password_reset_ttl" env:"QDOC_PASSWORD_RESET_TTL"`
+	// EmailVerificationTTL is how long an email verification code is valid.
+	EmailVerificationTTL time.Duration `config:"email_verification_ttl" env:"QDOC_EMAIL_VERIFICATION_TTL"`
+	// VerificationResendInterval is the minimum time between two
+	// verification emails to the same user.
+	VerificationResendInterval time.Duration `config:"verification_resend_interval" env:"QDOC_VERIFICATION_RESEND_INTERVAL"`
+	// RequireVerifiedEmail lists the actions, such as "documents:write",
+	// reserved to users who verified their email address.
+	RequireVerifiedEmail []string `config:"require_verified_email" env:"QDOC_REQUIRE_VERIFIED_EMAIL"`
+	// InviteAllowance is how many people each user can invite.
+	InviteAllowance int `config:"invite_allowance" env:"QDOC_INVITE_ALLOWANCE"`
+	// InvitationTTL is how long an invitation can be accepted.
+	InvitationTTL time.Duration `config:"invitation_ttl" env:"QDOC_INVITATION_TTL"`
+	// MailgunWebhookKey is the key Mailgun signs its webhook calls with.
+	MailgunWebhookKey string `config:"mailgun_webhook_key" env:"QDOC_MAILGUN_WEBHOOK_KEY" secret:"true"`
+	// MailEventSecret signs the calls to the generic mail event webhook.
+	MailEventSecret string `config:"mail_event_secret" env:"QDOC_MAIL_EVENT_SECRET" secret:"true"`
+	// LoginAttemptRetention is how long login attempts are kept.
+	LoginAttemptRetention time.Duration `config:"login_attempt_retention" env:"QDOC_LOGIN_ATTEMPT_RETENTION"`
+}
+
+// ConfigError lists everything that is wrong with a Config.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "Invalid configuration: " + strings.Join(e.Problems, "; ") + "."
+}
+
+// Option modifies a Config being loaded by LoadConfig.
+type Option func(*Config) error
+
+// DefaultConfig returns the configuration used when nothing else is specified.
+// It holds no credentials.
+func DefaultConfig() Config {
+	return Config{
+		MailgunDomain:              "goquadro.com",
+		NotificationAddress:        "qdoc <notify@goquadro.com>",
+		Mailer:                     MailerMailgun,
+		DefaultLocale:              "en",
+		MongoDBHosts:               "localhost",
+		JobDatabase:                "qdoc",
+		UsersCollection:            UsersCollection,
+		DocumentsCollection:        DocumentsCollection,
+		SignupCodesCollection:      SignupCodesCollection,
+		FilesCollection:            FilesCollection,
+		SubscribersCollection:      SubscribersCollection,
+		LoginAttemptsCollection:    LoginAttemptsCollection,
+		SessionsCollection:         SessionsCollection,
+		PasswordResetsCollection:   PasswordResetsCollection,
+		APIKeysCollection:          APIKeysCollection,
+		WaitlistCollection:         WaitlistCollection,
+		OutboxCollection:           OutboxCollection,
+		MailEventCollection:        MailEventCollection,
+		SuppressionCollection:      SuppressionCollection,
+		BaseURL:                    "https://www.goquadro.com",
+		TOTPIssuer:                 "GoQuadro",
+		PasswordResetTTL:           time.Hour,
+		EmailVerificationTTL:       72 * time.Hour,
+		VerificationResendInterval: 5 * time.Minute,
+		InviteAllowance:            5,
+		InvitationTTL:              14 * 24 * time.Hour,
+		DialTimeout:                60 * time.Second,
+		Lockout: LockoutPolicy{
+			Threshold:   5,
+			Duration:    time.Minute,
+			Backoff:     2,
+			MaxDuration: 24 * time.Hour,
+		},
+		LoginAttemptRetention: 90 * 24 * time.Hour,
+		Passwords: PasswordHashing{
+			Algorithm:     Bcrypt,
+			BcryptCost:    12,
+			Argon2Time:    3,
+			Argon2Memory:  64 * 1024,
+			Argon2Threads: 2,
+		},
+		Google: OIDCConfig{
+			Provider: ProviderGoogle,
+			Issuer:   "https://accounts.google.com",
+		},
+		Outbox: OutboxConfig{
+			MaxAttempts:  8,
+			BaseDelay:    30 * time.Second,
+			MaxDelay:     6 * time.Hour,
+			PollInterval: 5 * time.Second,
+			Lease:        5 * time.Minute,
+		},
+		PasswordPolicy: PasswordPolicy{
+			MinLength:      8,
+			MinScore:       2,
+			RejectPersonal: true,
+			RejectCommon:   true,
+		},
+		Tokens: TokenConfig{
+			Issuer:     "goquadro.com",
+			Audience:   "goquadro-api",
+			TTL:        15 * time.Minute,
+			Leeway:     30 * time.Second,
+			RefreshTTL: 30 * 24 * time.Hour,
+		},
+	}
+}
+
+// LoadConfig applies opts in order on top of DefaultConfig and validates
+// the result.
+func LoadConfig(opts ...Option) (Config, error) {
+	cfg := DefaultConfig()
+	for _, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return Config{}, err
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// FromEnv reads the QDOC_* environment variables. Unset variables leave
+// the corresponding fields untouched.
+func FromEnv() Option {
+	return func(c *Config) error {
+		for _, f := range configFields(c) {
+			if f.env == "" {
+				continue
+			}
+			if v := os.Getenv(f.env); v != "" {
+				if err := setConfigField(f, v); err != nil {
+					return fmt.Errorf("%s: %v", f.env, err)
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// FromFile reads a JSON, YAML or TOML file, chosen by its extension.
+// Nested tables map to nested fields. Unknown keys are rejected.
+func FromFile(path string) Option {
+	return func(c *Config) error {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		values := map[string]interface{}{}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".json":
+			d := json.NewDecoder(bytes.NewReader(raw))
+			d.UseNumber()
+			err = d.Decode(&values)
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(raw, &values)
+		case ".toml":
+			_, err = toml.Decode(string(raw), &values)
+		default:
+			return fmt.Errorf("%s: unsupported configuration format", path)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		flat := map[string]string{}
+		flattenConfig("", values, flat)
+		fields := map[string]configField{}
+		for _, f := range configFields(c) {
+			fields[f.key] = f
+		}
+		for key, v := range flat {
+			f, ok := fields[key]
+			if !ok {
+				return fmt.Errorf("%s: unknown key %q, expected one of %s", path, key, strings.Join(configKeys(), ", "))
+			}
+			if err := setConfigField(f, v); err != nil {
+				return fmt.Errorf("%s: %s: %v", path, key, err)
+			}
+		}
+		return nil
+	}
+}
+
+// WithMongo sets the MongoDB hosts (comma separated) and database.
+func WithMongo(hosts, database string) Option {
+	return func(c *Config) error {
+		c.MongoDBHosts = hosts
+		c.JobDatabase = database
+		return nil
+	}
+}
+
+// WithMongoCredentials sets the MongoDB user and the database it authenticates against.
+func WithMongoCredentials(authDatabase, username, password string) Option {
+	return func(c *Config) error {
+		c.AuthDatabase = authDatabase
+		c.AuthUserName = username
+		c.AuthPassword = password
+		return nil
+	}
+}
+
+// WithMailgun sets the Mailgun domain and keys.
+func WithMailgun(domain, key, publicKey string) Option {
+	return func(c *Config) error {
+		c.MailgunDomain = domain
+		c.MailgunKey = key
+		c.MailgunPubKey = publicKey
+		return nil
+	}
+}
+
+// WithCollectionPrefix prepends prefix to every collection name.
+func WithCollectionPrefix(prefix string) Option {
+	return func(c *Config) error {
+		for _, f := range configFields(c) {
+			if strings.HasSuffix(f.key, "_collection") {
+				f.value.SetString(prefix + f.value.String())
+			}
+		}
+		return nil
+	}
+}
+
+// Validate reports every missing or inconsistent setting at once.
+func (c Config) Validate() error {
+	var problems []string
+	if c.MongoDBHosts == "" {
+		problems = append(problems, "mongo_hosts is missing")
+	}
+	if c.JobDatabase == "" {
+		problems = append(problems, "mongo_db is missing")
+	}
+	if c.AuthUserName != "" && c.AuthPassword == "" {
+		problems = append(problems, "mongo_password is missing for mongo_user "+c.AuthUserName)
+	}
+	switch c.Mailer {
+	case MailerMailgun:
+		if c.MailgunKey == "" {
+			problems = append(problems, "mailgun_key is missing")
+		}
+	case MailerSMTP:
+		if c.SMTP.Host == "" {
+			problems = append(problems, "smtp.host is missing")
+		}
+	case MailerFile:
+		if c.MailDir == "" {
+			problems = append(problems, "mail_dir is missing")
+		}
+	case MailerMemory:
+	default:
+		problems = append(problems, "mailer must be one of mailgun, smtp, file or memory")
+	}
+	if c.TemplateDir != "" {
+		if _, err := LoadTemplates(os.DirFS(c.TemplateDir)); err != nil {
+			problems = append(problems, "template_dir: "+err.Error())
+		}
+	}
+	if c.LocaleDir != "" {
+		if err := (Catalogs{}).Load(os.DirFS(c.LocaleDir)); err != nil {
+			problems = append(problems, "locale_dir: "+err.Error())
+		}
+	}
+	if _, err := canonicalLocale(c.DefaultLocale); err != nil {
+		problems = append(problems, "default_locale is not a language tag")
+	}
+	if c.DialTimeout <= 0 {
+		problems = append(problems, "dial_timeout must be positive")
+	}
+	if c.Lockout.Threshold > 0 && c.Lockout.Duration <= 0 {
+		problems = append(problems, "lockout.duration must be positive")
+	}
+	if c.Tokens.TTL <= 0 {
+		problems = append(problems, "tokens.ttl must be positive")
+	}
+	if c.Tokens.RefreshTTL <= 0 {
+		problems = append(problems, "tokens.refresh_ttl must be positive")
+	}
+	problems = append(problems, c.Passwords.problems()...)
+	if c.PasswordPolicy.MinScore < 0 || c.PasswordPolicy.MinScore > 4 {
+		problems = append(problems, "password_policy.min_score must be between 0 and 4")
+	}
+	if c.Google.ClientID != "" && (c.Google.Issuer == "" || c.Google.RedirectURL == "") {
+		problems = append(problems, "google.issuer and google.redirect_url are required with google.client_id")
+	}
+	if c.BaseURL == "" {
+		problems = append(problems, "base_url is missing")
+	}
+	if c.PasswordResetTTL <= 0 {
+		problems = append(problems, "password_reset_ttl must be positive")
+	}
+	if c.EmailVerificationTTL <= 0 {
+		problems = append(problems, "email_verification_ttl must be positive")
+	}
+	if c.InvitationTTL <= 0 {
+		problems = append(problems, "invitation_ttl must be positive")
+	}
+	if c.Outbox.MaxAttempts < 1 {
+		problems = append(problems, "outbox.max_attempts must be at least 1")
+	}
+	if c.Outbox.BaseDelay <= 0 || c.Outbox.MaxDelay < c.Outbox.BaseDelay {
+		problems = append(problems, "outbox.base_delay must be positive and at most outbox.max_delay")
+	}
+	if c.Outbox.PollInterval <= 0 || c.Outbox.Lease <= 0 {
+		problems = append(problems, "outbox.poll_interval and outbox.lease must be positive")
+	}
+	if c.LoginAttemptRetention <= 0 {
+		problems = append(problems, "login_attempt_retention must be positive")
+	}
+	seen := map[string]string{}
+	for _, f := range configFields(&c) {
+		if !strings.HasSuffix(f.key, "_collection") {
+			continue
+		}
+		name := f.value.String()
+		if name == "" {
+			problems = append(problems, f.key+" is missing")
+		} else if other, ok := seen[name]; ok {
+			problems = append(problems, f.key+" and "+other+" are both "+strconv.Quote(name))
+		}
+		seen[name] = f.key
+	}
+	if len(problems) > 0 {
+		return &ConfigError{problems}
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration with every secret masked.
+func (c Config) Redacted() Config {
+	for _, f := range configFields(&c) {
+		if f.secret && !f.value.IsZero() {
+			f.value.SetString(redacted)
+		}
+	}
+	return c
+}
+
+// String prints the effective configuration, one key per line, with
+// secrets masked. It is safe to log.
+func (c Config) String() string {
+	r := c.Redacted()
+	var lines []string
+	for _, f := range configFields(&r) {
+		lines = append(lines, fmt.Sprintf("%s = %v", f.key, f.value.Interface()))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Returns the effective auth database: the job database unless set.
+func (c Config) authDatabase() string {
+	if c.AuthDatabase != "" {
+		return c.AuthDatabase
+	}
+	return c.JobDatabase
+}
+
+type configField struct {
+	key    string
+	env    string
+	secret bool
+	value  reflect.Value
+}
+
+// Lists the settable fields of c, descending into nested structs, whose
+// keys are joined with a dot.
+func configFields(c *Config) []configField {
+	return appendConfigFields(nil, "", reflect.ValueOf(c).Elem())
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func appendConfigFields(fields []configField, prefix string, v reflect.Value) []configField {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		key := sf.Tag.Get("config")
+		if key == "" || key == "-" {
+			continue
+		}
+		if sf.Type.Kind() == reflect.Struct {
+			fields = appendConfigFields(fields, prefix+key+".", v.Field(i))
+			continue
+		}
+		fields = append(fields, configField{
+			key:    prefix + key,
+			env:    sf.Tag.Get("env"),
+			secret: sf.Tag.Get("secret") == "true",
+			value:  v.Field(i),
+		})
+	}
+	return fields
+}
+
+func setConfigField(f configField, s string) error {
+	v := f.value
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// Flattens the decoded file into dotted keys and string values.
+func flattenConfig(prefix string, values interface{}, out map[string]string) {
+	switch vs := values.(type) {
+	case map[string]interface{}:
+		for k, v := range vs {
+			flattenConfig(prefix+k+".", v, out)
+		}
+	case map[interface{}]interface{}:
+		for k, v := range vs {
+			flattenConfig(prefix+fmt.Sprint(k)+".", v, out)
+		}
+	case []interface{}:
+		items := make([]string, len(vs))
+		for i, v := range vs {
+			items[i] = fmt.Sprint(v)
+		}
+		out[strings.TrimSuffix(prefix, ".")] = strings.Join(items, ",")
+	default:
+		out[strings.TrimSuffix(prefix, ".")] = fmt.Sprint(vs)
+	}
+}
+
+// Keys of the configuration, for documentation and error messages.
+func configKeys() []string {
+	var keys []string
+	for _, f := range configFields(new(Config)) {
+		keys = append(keys, f.key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,73 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFromFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gqconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"qdoc.json": `{"mongo_hosts": "db1,db2", "mailgun_key": "key-json", "users_collection": "people", "dial_timeout": "5s"}`,
+		"qdoc.yaml": "mongo_hosts: db1,db2\nmailgun_key: key-yaml\nusers_collection: people\ndial_timeout: 5s\n",
+		"qdoc.toml": "mongo_hosts = \"db1,db2\"\nmailgun_key = \"key-toml\"\nusers_collection = \"people\"\ndial_timeout = \"5s\"\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfig(FromFile(path))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if cfg.MongoDBHosts != "db1,db2" || cfg.UsersCollection != "people" || cfg.DialTimeout != 5*time.Second {
+			t.Errorf("%s: unexpected config %+v", name, cfg)
+		}
+		if cfg.DocumentsCollection != DocumentsCollection {
+			t.Errorf("%s: default documents collection lost", name)
+		}
+	}
+
+	path := filepath.Join(dir, "typo.yaml")
+	ioutil.WriteFile(path, []byte("mongo_host: db1\n"), 0600)
+	if _, err := LoadConfig(FromFile(path)); err == nil || !strings.Contains(err.Error(), "mongo_host") {
+		t.Error("Expected an unknown key error, got", err)
+	}
+}
+
+func TestConfigValidateAndRedact(t *testing.T) {
+	_, err := LoadConfig(WithMongoCredentials("admin", "qdoc1", ""), WithCollectionPrefix(""))
+	cerr, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatal("Expected a ConfigError, got", err)
+	}
+	if len(cerr.Problems) != 2 {
+		t.Error("Expected missing mongo_password and mailgun_key, got", cerr.Problems)
+	}
+
+	cfg, err := LoadConfig(WithMailgun("example.com", "key-secret", "pubkey"), WithMongoCredentials("admin", "qdoc1", "hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := cfg.String()
+	if strings.Contains(dump, "key-secret") || strings.Contains(dump, "hunter2") {
+		t.Error("Secrets leaked in dump:\n" + dump)
+	}
+	if !strings.Contains(dump, "mailgun_public_key = pubkey") {
+		t.Error("Public settings missing from dump:\n" + dump)
+	}
+	if cfg.AuthPassword != "hunter2" {
+		t.Error("Redaction modified the original config")
+	}
+}
@@ -34,10 +34,7 @@ func (d *Document) CreatedAt() time.Time {
 
 // Get a user's documents from the proper collection
 func (u User) Documents() (*[]Document, error) {
-	docs := []Document{}
-	locSession := getSession()
-	defer locSession.Close()
-	err := locSession.DB(gqConfig.jobDatabase).C(DocumentsCollection).Find(bson.M{"user": u.ID}).All(&docs)
+	docs, err := getStore().Documents().FindByOwner(u.ID)
 	return &docs, err
 }
 
@@ -63,18 +60,13 @@ func (u User) DocumentsByTopic() (*map[string][]Document, error) {
 }
 */
 
-// Returns zero doc & err==nil if not found
+// Returns zero doc & NotFoundError if not found
 func (user *User) GetDocumentById(id string) (*Document, error) {
 	doc := Document{}
 	if !bson.IsObjectIdHex(id) {
 		return &doc, InvalidBsonIdError
 	}
-	bsonId := bson.ObjectIdHex(id)
-	locSession := getSession()
-	defer locSession.Close()
-	docFinder := bson.M{"user": user.ID, "_id": bsonId}
-	err := locSession.DB(gqConfig.jobDatabase).C(DocumentsCollection).Find(docFinder).One(&doc)
-	return &doc, err
+	return getStore().Documents().FindByID(user.ID, bson.ObjectIdHex(id))
 }
 
 // sanitizeUrl performs basic url checking. To be worked on.
@@ -88,6 +80,9 @@ func sanitizeUrl(docurl string) (string, error) {
 
 // User.AddDocument persists a document belonging to the acting user.
 func (u *User) AddDocument(doc *Document) error {
+	if err := u.requireVerifiedEmail(ActionWriteDocuments); err != nil {
+		return err
+	}
 	doc.ID = bson.NewObjectId()
 	doc.Owner = u.ID
 	doc.Url, _ = sanitizeUrl(doc.Url)
@@ -98,10 +93,7 @@ func (u *User) AddDocument(doc *Document) error {
 	//doc.Thumb
 	doc.LastModified = doc.CreatedAt()
 
-	locSession := getSession()
-	defer locSession.Close()
-	c := locSession.DB(gqConfig.jobDatabase).C(DocumentsCollection)
-	err := c.Insert(doc)
+	err := getStore().Documents().Insert(doc)
 
 	if err == nil {
 		for _, parentId := range doc.Parents {
@@ -118,17 +110,7 @@ func (u *User) AddDocument(doc *Document) error {
 // AddChild adds a document's ID to the list of children of its parent.
 // Doesn't check for document owner consistency against any specific user.
 func (d Document) AddChild(child *Document) error {
-	locSession := getSession()
-	defer locSession.Close()
-	c := locSession.DB(gqConfig.jobDatabase).C(DocumentsCollection)
-	docFinder := bson.M{"_id": d.ID, "user": d.Owner}
-	err := c.Find(docFinder).One(d)
-	if err != nil {
-		return err
-	}
-	d.Children = append(d.Children, child.ID)
-	change := bson.M{"$set": bson.M{"children": d.Children, "last_modified": time.Now()}}
-	return c.Update(docFinder, change)
+	return getStore().Documents().AddChild(d.Owner, d.ID, child.ID)
 }
 
 /*
@@ -143,15 +125,17 @@ func (u *User) GetDocsByTags(tags []string) (*[]Document, error) {
 }
 */
 
-// Change a document's ownerID to a selected userID.
-// Doesn't perform any auth check.
-func (d *Document) ChangeOwner(u *User) error {
-	locSession := getSession()
-	defer locSession.Close()
-	c := locSession.DB(gqConfig.jobDatabase).C(DocumentsCollection)
-	docFinder := bson.M{"_id": d.ID, "user": d.Owner}
-	change := bson.M{"$set": bson.M{"user": u.ID, "last_modified": time.Now()}}
-	return c.Update(docFinder, change)
+// Change a document's ownerID to a selected userID, if the acting user
+// is allowed to.
+func (d *Document) ChangeOwner(actor, u *User) error {
+	if err := Authorize(actor, ActionChangeOwner, d); err != nil {
+		return err
+	}
+	err := getStore().Documents().ChangeOwner(d.ID, d.Owner, u.ID)
+	if err == nil {
+		d.Owner = u.ID
+	}
+	return err
 }
 
 // ToDo: Change behaviour to just mark a doc for deletion, in order to permit undo.
@@ -161,18 +145,16 @@ func (u *User) DeleteDocument(d *Document) error {
 	if err != nil {
 		candidateDoc = d
 	}
-	locSession := getSession()
-	defer locSession.Close()
-	return locSession.DB(gqConfig.jobDatabase).C(DocumentsCollection).Remove(bson.M{"_id": candidateDoc.ID, "user": u.ID})
+	return getStore().Documents().Remove(u.ID, candidateDoc.ID)
 }
 
 // User.PutDocument is a PUT (full overwrite) scheme document modifier
 func (u *User) PutDocument(d *Document) error {
-	locSession := getSession()
-	defer locSession.Close()
-	c := locSession.DB(gqConfig.jobDatabase).C(DocumentsCollection)
-	selector := bson.M{"_id": d.ID, "user": u.ID}
-	return c.Update(selector, d)
+	if err := u.requireVerifiedEmail(ActionWriteDocuments); err != nil {
+		return err
+	}
+	d.Owner = u.ID
+	return getStore().Documents().Update(d)
 }
 
 // Document.NamePreview aims to provide a human-friendly name for the document,
@@ -189,3 +171,12 @@ func (d *Document) NamePreview(length int) string {
 	}
 	return newName
 }
+
+// NotifyShare emails recipient that the user shared the document with them.
+func (u *User) NotifyShare(d *Document, recipient string) error {
+	return sendTemplate(TemplateShare, recipient, u.Locale, map[string]interface{}{
+		"Sharer": u.Username,
+		"Title":  d.Title,
+		"Link":   d.Url,
+	})
+}
@@ -0,0 +1,39 @@
+package core
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// File describes a user file stored on S3.
+type File struct {
+	ID          bson.ObjectId `bson:"_id"      json:"fileID"`
+	Owner       bson.ObjectId `bson:"user"     json:"owner"`
+	Name        string        `bson:"name"     json:"name"`
+	ContentType string        `bson:"ctype"    json:"contentType"`
+	Size        int64         `bson:"size"     json:"size"`
+	Key         string        `bson:"s3key"    json:"-"`
+	Uploaded    time.Time     `bson:"uploaded" json:"uploaded"`
+}
+
+// Get a user's files from the proper collection
+func (u User) Files() ([]File, error) {
+	return getStore().Files().FindByOwner(u.ID)
+}
+
+// User.AddFile persists the metadata of a file belonging to the acting user.
+func (u *User) AddFile(f *File) error {
+	if err := u.requireVerifiedEmail(ActionWriteFiles); err != nil {
+		return err
+	}
+	f.ID = bson.NewObjectId()
+	f.Owner = u.ID
+	f.Uploaded = f.ID.Time()
+	return getStore().Files().Insert(f)
+}
+
+// User.DeleteFile removes the metadata of a file belonging to the acting user.
+func (u *User) DeleteFile(f *File) error {
+	return getStore().Files().Remove(u.ID, f.ID)
+}
@@ -0,0 +1,359 @@
+package core
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var InvalidLocaleError = errors.New("Invalid language.")
+
+// The catalogs shipped with the package, to which Config.LocaleDir can
+// add languages or override messages.
+//
+//go:embed locales
+var embeddedLocales embed.FS
+
+// Plural categories, as in the Unicode CLDR.
+const (
+	PluralZero  = "zero"
+	PluralOne   = "one"
+	PluralTwo   = "two"
+	PluralFew   = "few"
+	PluralMany  = "many"
+	PluralOther = "other"
+)
+
+// A message, in one form or one per plural category.
+type catalogEntry struct {
+	text   string
+	plural map[string]string
+}
+
+func (e *catalogEntry) UnmarshalJSON(raw []byte) error {
+	if err := json.Unmarshal(raw, &e.text); err == nil {
+		return nil
+	}
+	return json.Unmarshal(raw, &e.plural)
+}
+
+// Catalogs holds the messages of every language, by locale then key.
+// Messages are fmt formats. Plural messages have one form per plural
+// category of the language, and at least PluralOther.
+type Catalogs map[string]map[string]catalogEntry
+
+// Load reads the LOCALE.json files of fsys, such as
+// os.DirFS(dir), on top of the catalogs already in c.
+func (c Catalogs) Load(fsys fs.FS) error {
+	files, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		raw, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+		entries := map[string]catalogEntry{}
+		if err := json.Unmarshal(raw, &entries); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		locale, err := canonicalLocale(strings.TrimSuffix(path.Base(file), ".json"))
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		if c[locale] == nil {
+			c[locale] = map[string]catalogEntry{}
+		}
+		for key, e := range entries {
+			if e.plural != nil && e.plural[PluralOther] == "" {
+				return fmt.Errorf("%s: %s has no %q form", file, key, PluralOther)
+			}
+			c[locale][key] = e
+		}
+	}
+	return nil
+}
+
+// DefaultCatalogs returns the catalogs shipped with the package.
+func DefaultCatalogs() Catalogs {
+	sub, err := fs.Sub(embeddedLocales, "locales")
+	check(err)
+	c := Catalogs{}
+	check(c.Load(sub))
+	return c
+}
+
+// Loads the default catalogs, then those of Config.LocaleDir.
+func loadConfiguredCatalogs(dir string) (Catalogs, error) {
+	c := DefaultCatalogs()
+	if dir == "" {
+		return c, nil
+	}
+	return c, c.Load(os.DirFS(dir))
+}
+
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}([-_][A-Za-z0-9]{2,8})*$`)
+
+// Returns the usual spelling of a language tag, such as "pt-BR" for "pt_br".
+func canonicalLocale(tag string) (string, error) {
+	if !localePattern.MatchString(tag) {
+		return "", InvalidLocaleError
+	}
+	parts := strings.FieldsFunc(tag, func(r rune) bool { return r == '-' || r == '_' })
+	parts[0] = strings.ToLower(parts[0])
+	for i := 1; i < len(parts); i++ {
+		if len(parts[i]) == 2 {
+			parts[i] = strings.ToUpper(parts[i])
+		}
+	}
+	return strings.Join(parts, "-"), nil
+}
+
+// SetLocale sets the language the user gets emails and messages in.
+// The user must be saved.
+func (u *User) SetLocale(tag string) error {
+	locale, err := canonicalLocale(tag)
+	if err != nil {
+		return err
+	}
+	u.Locale = locale
+	return nil
+}
+
+// Localizer translates messages into a language, falling back to more
+// generic ones, from "pt-BR" to "pt", then to Config.DefaultLocale.
+type Localizer struct {
+	catalogs Catalogs
+	chain    []string
+}
+
+// Localize returns a Localizer for the language, such as User.Locale.
+// An empty or invalid tag gets the default language.
+func Localize(tag string) *Localizer {
+	catalogs, err := std.getCatalogs()
+	if err != nil {
+		// A broken Config.LocaleDir is reported by Validate; the shipped
+		// catalogs still work.
+		catalogs = DefaultCatalogs()
+	}
+	return newLocalizer(catalogs, tag, getConfig().DefaultLocale)
+}
+
+func newLocalizer(catalogs Catalogs, tag, fallback string) *Localizer {
+	l := &Localizer{catalogs: catalogs}
+	add := func(locale string) {
+		for _, known := range l.chain {
+			if known == locale {
+				return
+			}
+		}
+		if _, ok := catalogs[locale]; ok {
+			l.chain = append(l.chain, locale)
+		}
+	}
+	for _, t := range []string{tag, fallback, "en"} {
+		locale, err := canonicalLocale(t)
+		if err != nil {
+			continue
+		}
+		for {
+			add(locale)
+			i := strings.LastIndex(locale, "-")
+			if i < 0 {
+				break
+			}
+			locale = locale[:i]
+		}
+	}
+	return l
+}
+
+// Locale returns the language messages are looked up in first.
+func (l *Localizer) Locale() string {
+	if len(l.chain) == 0 {
+		return ""
+	}
+	return l.chain[0]
+}
+
+func (l *Localizer) lookup(key string) (catalogEntry, string, bool) {
+	for _, locale := range l.chain {
+		if e, ok := l.catalogs[locale][key]; ok {
+			return e, locale, true
+		}
+	}
+	return catalogEntry{}, "", false
+}
+
+// T returns the message with the given key, formatted with args.
+// Unknown keys are returned as they are, to be noticed.
+func (l *Localizer) T(key string, args ...interface{}) string {
+	e, _, ok := l.lookup(key)
+	if !ok {
+		return key
+	}
+	format := e.text
+	if e.plural != nil {
+		format = e.plural[PluralOther]
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// N returns the form of the message fitting the count n, formatted with
+// n followed by args.
+func (l *Localizer) N(key string, n int, args ...interface{}) string {
+	e, locale, ok := l.lookup(key)
+	if !ok {
+		return key
+	}
+	format := e.text
+	if e.plural != nil {
+		format = e.plural[pluralCategory(locale, n)]
+		if format == "" {
+			format = e.plural[PluralOther]
+		}
+	}
+	return fmt.Sprintf(format, append([]interface{}{n}, args...)...)
+}
+
+// Date formats t as usual in the language.
+func (l *Localizer) Date(t time.Time) string {
+	return t.Format(l.T("format.date"))
+}
+
+// Returns the plural category of n in the language of locale, following
+// the CLDR rules for integers.
+func pluralCategory(locale string, n int) string {
+	if n < 0 {
+		n = -n
+	}
+	lang := strings.SplitN(locale, "-", 2)[0]
+	switch lang {
+	case "ja", "ko", "zh", "th", "vi", "id":
+		return PluralOther
+	case "fr", "pt":
+		if n == 0 || n == 1 {
+			return PluralOne
+		}
+	case "ru", "uk":
+		switch {
+		case n%10 == 1 && n%100 != 11:
+			return PluralOne
+		case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+			return PluralFew
+		default:
+			return PluralMany
+		}
+	case "pl":
+		switch {
+		case n == 1:
+			return PluralOne
+		case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+			return PluralFew
+		default:
+			return PluralMany
+		}
+	default:
+		if n == 1 {
+			return PluralOne
+		}
+	}
+	return PluralOther
+}
+
+// Stable codes of the package's errors, for API clients to rely on.
+var errorCodes = map[error]string{
+	AlreadyRegisteredError:       "already_registered",
+	DuplicateKeyError:            "duplicate_key",
+	EmailAlreadyVerifiedError:    "email_already_verified",
+	EmailBouncedError:            "email_bounced",
+	EmailNotVerifiedError:        "email_not_verified",
+	ForbiddenError:               "forbidden",
+	IdentityInUseError:           "identity_in_use",
+	InvalidAPIKeyError:           "invalid_api_key",
+	InvalidBsonIdError:           "invalid_id",
+	InvalidCredentials:           "invalid_credentials",
+	InvalidEmailAddressError:     "invalid_email_address",
+	InvalidIDTokenError:          "invalid_id_token",
+	InvalidLocaleError:           "invalid_locale",
+	InvalidLoginChallengeError:   "invalid_login_challenge",
+	InvalidOTPError:              "invalid_otp",
+	InvalidRefreshTokenError:     "invalid_refresh_token",
+	InvalidResetTokenError:       "invalid_reset_token",
+	InvalidTokenError:            "invalid_token",
+	InvalidUidError:              "invalid_uid",
+	InvalidUsernameError:         "invalid_username",
+	InvalidVerificationCodeError: "invalid_verification_code",
+	InvalidWebhookSignatureError: "invalid_webhook_signature",
+	LastLoginMethodError:         "last_login_method",
+	NoInvitesLeftError:           "no_invites_left",
+	NotFoundError:                "not_found",
+	OIDCStateMismatchError:       "oidc_state_mismatch",
+	RefreshTokenReusedError:      "refresh_token_reused",
+	ResendTooSoonError:           "resend_too_soon",
+	SignupCodeNotRecognizedError: "signup_code_not_recognized",
+	StartTLSUnsupportedError:     "starttls_unsupported",
+	SuppressedAddressError:       "suppressed_address",
+	TOTPAlreadyEnabledError:      "totp_already_enabled",
+	TOTPNotEnrolledError:         "totp_not_enrolled",
+	TokenExpiredError:            "token_expired",
+	UnknownPasswordHashError:     "unknown_password_hash",
+	UnknownRoleError:             "unknown_role",
+	UnknownScopeError:            "unknown_scope",
+	UnknownTokenKeyError:         "unknown_token_key",
+	UnverifiedEmailConflictError: "unverified_email_conflict",
+	UserAlreadyLoggedIn:          "user_already_logged_in",
+	UsernameAlreadyTakenError:    "username_taken",
+	VerificationCodeExpiredError: "verification_code_expired",
+	WrongPasswordError:           "wrong_password",
+}
+
+// Code of the errors that aren't the package's.
+const ErrorCodeInternal = "internal_error"
+
+// ErrorCode returns the stable code of an error of the package, or
+// ErrorCodeInternal.
+func ErrorCode(err error) string {
+	switch err.(type) {
+	case *WeakPasswordError:
+		return "weak_password"
+	case *AccountLockedError:
+		return "account_locked"
+	case *SecondFactorRequiredError:
+		return "second_factor_required"
+	}
+	if code, ok := errorCodes[err]; ok {
+		return code
+	}
+	return ErrorCodeInternal
+}
+
+// Error translates an error of the package, through the "error.CODE"
+// messages. Errors that aren't the package's get a generic message,
+// as their text isn't meant for users.
+func (l *Localizer) Error(err error) string {
+	switch e := err.(type) {
+	case *WeakPasswordError:
+		messages := []string{l.T("error.weak_password")}
+		for _, f := range e.Feedback {
+			if f.Code == PasswordTooShort {
+				messages = append(messages, l.N("password."+f.Code, getConfig().PasswordPolicy.MinLength))
+			} else {
+				messages = append(messages, l.T("password."+f.Code))
+			}
+		}
+		return strings.Join(messages, " ")
+	case *AccountLockedError:
+		minutes := int((e.RetryAfter() + time.Minute - 1) / time.Minute)
+		return l.N("error.account_locked", minutes)
+	}
+	return l.T("error." + ErrorCode(err))
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalizer(t *testing.T) {
+	catalogs := Catalogs{
+		"en":    {"hello": {text: "Hello, %s."}, "docs": {plural: map[string]string{"one": "%d doc", "other": "%d docs"}}},
+		"pt":    {"hello": {text: "Olá, %s."}, "docs": {plural: map[string]string{"one": "%d documento", "other": "%d documentos"}}},
+		"pt-BR": {"hello": {text: "Oi, %s."}},
+		"ru":    {"docs": {plural: map[string]string{"one": "%d документ", "few": "%d документа", "many": "%d документов", "other": "%d документа"}}},
+	}
+	for _, c := range []struct {
+		locale, key string
+		n           int
+		want        string
+	}{
+		{"pt_br", "hello", -1, "Oi, Ana."},
+		{"pt-PT", "hello", -1, "Olá, Ana."},
+		{"pt-BR", "docs", 0, "0 documento"},
+		{"pt-BR", "docs", 2, "2 documentos"},
+		{"de", "docs", 0, "0 docs"},
+		{"", "docs", 1, "1 doc"},
+		{"ru", "docs", 21, "21 документ"},
+		{"ru", "docs", 3, "3 документа"},
+		{"ru", "docs", 11, "11 документов"},
+		{"!!", "hello", -1, "Hello, Ana."},
+		{"en", "missing", -1, "missing"},
+	} {
+		l := newLocalizer(catalogs, c.locale, "en")
+		got := l.T(c.key, "Ana")
+		if c.n >= 0 {
+			got = l.N(c.key, c.n)
+		}
+		if got != c.want {
+			t.Errorf("%s %s %d: expected %q, got %q", c.locale, c.key, c.n, c.want, got)
+		}
+	}
+	if l := newLocalizer(catalogs, "pt-BR", "en"); strings.Join(l.chain, ",") != "pt-BR,pt,en" {
+		t.Error("Unexpected fallback chain:", l.chain)
+	}
+}
+
+func TestDefaultCatalogs(t *testing.T) {
+	en := DefaultCatalogs()["en"]
+	for err, code := range errorCodes {
+		e, ok := en["error."+code]
+		if !ok {
+			t.Errorf("No English message for %s", code)
+		} else if e.text != err.Error() {
+			t.Errorf("error.%s: %q differs from %q", code, e.text, err.Error())
+		}
+	}
+	// Every other catalog only has keys the English one has.
+	files, _ := fs.Glob(embeddedLocales, "locales/*.json")
+	for _, file := range files {
+		raw, _ := fs.ReadFile(embeddedLocales, file)
+		keys := map[string]json.RawMessage{}
+		if err := json.Unmarshal(raw, &keys); err != nil {
+			t.Fatal(file, err)
+		}
+		for key := range keys {
+			if _, ok := en[key]; !ok {
+				t.Errorf("%s: unknown key %s", file, key)
+			}
+		}
+	}
+}
+
+func TestLocalizedErrors(t *testing.T) {
+	clock := setupAuthTest(t)
+	fr := Localize("fr-CA")
+	if fr.Locale() != "fr" {
+		t.Fatal("Expected the fr catalog, got", fr.Locale())
+	}
+	if code := ErrorCode(UsernameAlreadyTakenError); code != "username_taken" {
+		t.Error("Unexpected code:", code)
+	}
+	if msg := fr.Error(UsernameAlreadyTakenError); msg != "Nom d'utilisateur déjà pris." {
+		t.Error("Unexpected message:", msg)
+	}
+	if msg := fr.Error(UnknownTokenKeyError); msg != UnknownTokenKeyError.Error() {
+		t.Error("No fallback to English:", msg)
+	}
+	foreign := errors.New("dial tcp: connection refused")
+	if code, msg := ErrorCode(foreign), fr.Error(foreign); code != ErrorCodeInternal || strings.Contains(msg, "dial") {
+		t.Error("Leaked a foreign error:", code, msg)
+	}
+	locked := &AccountLockedError{Until: clock.Add(90 * time.Second)}
+	if msg := fr.Error(locked); msg != "Compte verrouillé, réessayez dans 2 minutes." {
+		t.Error("Unexpected message:", msg)
+	}
+	weak := getConfig().PasswordPolicy.Check("abc", nil)
+	if msg := Localize("en").Error(weak); !strings.HasPrefix(msg, "Password too weak. Use at least 8 characters.") {
+		t.Error("Unexpected message:", msg)
+	}
+}
+
+func TestLocalizedEmail(t *testing.T) {
+	setupAuthTest(t)
+	u := registerTestUser(t, "jeanne", "plum-Harbor-42")
+	if err := u.SetLocale("xx-"); err != InvalidLocaleError {
+		t.Error("Expected InvalidLocaleError, got", err)
+	}
+	if err := u.SetLocale("fr_fr"); err != nil || u.Locale != "fr-FR" {
+		t.Fatal("SetLocale:", u.Locale, err)
+	}
+	if err := u.SendConfirmationEmail(); err != nil {
+		t.Fatal("SendConfirmationEmail:", err)
+	}
+	sent := sentMail()
+	m := sent[len(sent)-1]
+	if m.Subject != "Vous venez de vous inscrire sur GoQuadro" || !strings.Contains(m.Text, "Bonjour jeanne !") ||
+		!strings.Contains(m.HTML, `<html lang="fr">`) || !strings.Contains(m.Text, "L'équipe GoQuadro") {
+		t.Errorf("Unexpected email: %+v", m)
+	}
+}
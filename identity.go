@@ -0,0 +1,137 @@
+package core
+
+import (
+	"errors"
+	"time"
+)
+
+var IdentityInUseError = errors.New("This account is already linked to another user.")
+var LastLoginMethodError = errors.New("Set a password before unlinking your last sign in method.")
+
+// Identity providers. Any other name can be used, such as "oidc:okta".
+const (
+	ProviderGoogle = "google"
+	ProviderGitHub = "github"
+	ProviderOIDC   = "oidc"
+	ProviderSAML   = "saml"
+)
+
+// Identity is an account of the user at an external identity provider,
+// which they can sign in with.
+type Identity struct {
+	Provider string    `bson:"provider"        json:"provider"`
+	Subject  string    `bson:"subject"         json:"subject"`
+	Email    string    `bson:"email,omitempty" json:"email,omitempty"`
+	Linked   time.Time `bson:"linked"          json:"linked"`
+	// Key joins the provider and subject, for the store to keep each
+	// account linked to a single user.
+	Key string `bson:"key" json:"-"`
+}
+
+func identityKey(provider, subject string) string {
+	return provider + ":" + subject
+}
+
+// FindUserByIdentity returns the user the provider's account is linked to.
+// Users linked to Google before identities existed are migrated on the way.
+func FindUserByIdentity(provider, subject string) (*User, error) {
+	users := getStore().Users()
+	u, err := users.FindByIdentity(provider, subject)
+	if err != NotFoundError || provider != ProviderGoogle {
+		return u, err
+	}
+	u, err = users.FindByGoogleOAuthSub(subject)
+	if err != nil {
+		return u, err
+	}
+	u.migrateGoogleOAuthSub()
+	return u, users.UpdateFields(u, "identities", "google_oauth_sub")
+}
+
+// Moves the deprecated GoogleOAuthSub to the identities.
+func (u *User) migrateGoogleOAuthSub() {
+	if u.GoogleOAuthSub == "" {
+		return
+	}
+	if !u.hasIdentity(ProviderGoogle, u.GoogleOAuthSub) {
+		u.Identities = append(u.Identities, Identity{
+			Provider: ProviderGoogle,
+			Subject:  u.GoogleOAuthSub,
+			Linked:   u.ID.Time(),
+			Key:      identityKey(ProviderGoogle, u.GoogleOAuthSub),
+		})
+	}
+	u.GoogleOAuthSub = ""
+}
+
+func (u *User) hasIdentity(provider, subject string) bool {
+	for _, id := range u.Identities {
+		if id.Provider == provider && id.Subject == subject {
+			return true
+		}
+	}
+	return false
+}
+
+// LinkedIdentities lists the external accounts the user can sign in with.
+func (u *User) LinkedIdentities() []Identity {
+	u.migrateGoogleOAuthSub()
+	return append([]Identity(nil), u.Identities...)
+}
+
+// LinkIdentity lets the user sign in with an account of an external
+// provider. email is the address the provider knows them by, if any.
+func (u *User) LinkIdentity(provider, subject, email string) error {
+	if u.ID.Valid() {
+		if err := u.Sync(); err != nil {
+			return err
+		}
+	}
+	u.migrateGoogleOAuthSub()
+	if u.hasIdentity(provider, subject) {
+		return nil
+	}
+	other, err := FindUserByIdentity(provider, subject)
+	if err == nil && other.ID != u.ID {
+		return IdentityInUseError
+	}
+	if err != nil && err != NotFoundError {
+		return err
+	}
+	u.Identities = append(u.Identities, Identity{
+		Provider: provider,
+		Subject:  subject,
+		Email:    email,
+		Linked:   timeNow(),
+		Key:      identityKey(provider, subject),
+	})
+	if !u.ID.Valid() {
+		return nil
+	}
+	err = getStore().Users().UpdateFields(u, "identities", "google_oauth_sub")
+	if err == DuplicateKeyError {
+		return IdentityInUseError
+	}
+	return err
+}
+
+// UnlinkIdentity stops the user from signing in with an external account.
+// Users without a password can't unlink their last identity, as they
+// would be locked out.
+func (u *User) UnlinkIdentity(provider, subject string) error {
+	if err := u.Sync(); err != nil {
+		return err
+	}
+	u.migrateGoogleOAuthSub()
+	for i, id := range u.Identities {
+		if id.Provider != provider || id.Subject != subject {
+			continue
+		}
+		if !u.HasPassword && len(u.Identities) == 1 {
+			return LastLoginMethodError
+		}
+		u.Identities = append(u.Identities[:i], u.Identities[i+1:]...)
+		return getStore().Users().UpdateFields(u, "identities", "google_oauth_sub")
+	}
+	return NotFoundError
+}
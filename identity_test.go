@@ -0,0 +1,61 @@
+package core
+
+import "testing"
+
+func TestLinkedIdentities(t *testing.T) {
+	setupAuthTest(t)
+	judy := registerTestUser(t, "judy", "plum-Harbor-42")
+	if err := judy.LinkIdentity(ProviderGitHub, "1234", ""); err != nil {
+		t.Fatal("LinkIdentity:", err)
+	}
+	if err := judy.LinkIdentity(ProviderSAML, "judy@corp", "judy@corp.example"); err != nil {
+		t.Fatal("LinkIdentity:", err)
+	}
+	found, err := FindUserByIdentity(ProviderGitHub, "1234")
+	if err != nil || found.ID != judy.ID || len(found.LinkedIdentities()) != 2 {
+		t.Fatal("FindUserByIdentity:", err)
+	}
+	if _, err := FindUserByIdentity(ProviderGoogle, "1234"); err != NotFoundError {
+		t.Error("Identity found under another provider:", err)
+	}
+	other := registerTestUser(t, "karl", "plum-Harbor-42")
+	if err := other.LinkIdentity(ProviderGitHub, "1234", ""); err != IdentityInUseError {
+		t.Error("Identity linked twice:", err)
+	}
+	// Mixing the provider of one of judy's identities with the subject of
+	// another makes a different identity.
+	if err := other.LinkIdentity(ProviderSAML, "1234", ""); err != nil {
+		t.Error("LinkIdentity:", err)
+	}
+	if stored, _ := getStore().Users().FindByID(other.ID); len(stored.Identities) != 1 || stored.Identities[0].Key != "saml:1234" {
+		t.Errorf("Unexpected identities %+v", stored.Identities)
+	}
+
+	// Accounts linked to Google before identities existed.
+	other.GoogleOAuthSub = "g-77"
+	getStore().Users().Update(other)
+	migrated, err := FindUserByIdentity(ProviderGoogle, "g-77")
+	if err != nil || migrated.ID != other.ID || migrated.GoogleOAuthSub != "" || !migrated.hasIdentity(ProviderGoogle, "g-77") {
+		t.Fatal("Google subject not migrated:", err)
+	}
+
+	// Users without password keep one way to sign in, whatever a stale
+	// copy of the user says.
+	judy.HasPassword = false
+	getStore().Users().Update(judy)
+	if err := judy.UnlinkIdentity(ProviderGitHub, "1234"); err != nil {
+		t.Error("UnlinkIdentity:", err)
+	}
+	stale := &User{ID: judy.ID, HasPassword: true}
+	if err := stale.UnlinkIdentity(ProviderSAML, "judy@corp"); err != LastLoginMethodError {
+		t.Error("Unlinked the last login method:", err)
+	}
+	if err := judy.UnlinkIdentity(ProviderGitHub, "1234"); err != NotFoundError {
+		t.Error("Expected NotFoundError, got", err)
+	}
+	judy.HasPassword = true
+	getStore().Users().Update(judy)
+	if err := judy.UnlinkIdentity(ProviderSAML, "judy@corp"); err != nil {
+		t.Error("UnlinkIdentity with a password:", err)
+	}
+}
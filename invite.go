@@ -0,0 +1,189 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"time"
+)
+
+var NoInvitesLeftError = errors.New("You have no invitations left.")
+var AlreadyRegisteredError = errors.New("Someone with that address is already registered.")
+
+// Label of the signup codes created by User.Invite.
+const invitationLabel = "invitation"
+
+// Statuses of an invitation.
+const (
+	InvitationPending  = "pending"
+	InvitationAccepted = "accepted"
+	InvitationExpired  = "expired"
+	InvitationRevoked  = "revoked"
+)
+
+// Invitation is what an inviter gets to know about one of their invitations.
+type Invitation struct {
+	Email     string    `json:"email"`
+	Sent      time.Time `json:"sent"`
+	ExpiresAt time.Time `json:"expires"`
+	Status    string    `json:"status"`
+	Username  string    `json:"username,omitempty"`
+}
+
+func (sc *SignupCode) isInvitation() bool {
+	return sc.EmailBound && sc.Label == invitationLabel
+}
+
+// Invite sends the address a code to sign up with, counted against the
+// user's allowance of Config.InviteAllowance invitations. Inviting an
+// address again while the first invitation is pending sends it again.
+func (u *User) Invite(email string) error {
+	if !u.EmailVerified {
+		return EmailNotVerifiedError
+	}
+	invitee := new(User)
+	if err := invitee.SetEmail(email); err != nil {
+		return InvalidEmailAddressError
+	}
+	email = invitee.Email
+	if _, err := getStore().Users().FindByEmail(email); err != NotFoundError {
+		if err == nil {
+			return AlreadyRegisteredError
+		}
+		return err
+	}
+	codes, err := getStore().SignupCodes().FindByCreator(u.ID)
+	if err != nil {
+		return err
+	}
+	now := timeNow()
+	sent := 0
+	for i := range codes {
+		sc := &codes[i]
+		if !sc.isInvitation() || !sc.Revoked.IsZero() {
+			continue
+		}
+		if sc.Email == email && sc.usableBy(email, now) {
+			return sendInvitation(u, sc)
+		}
+		sent++
+	}
+	if sent >= getConfig().InviteAllowance {
+		return NoInvitesLeftError
+	}
+	// The counter on the user keeps concurrent invitations within the
+	// allowance.
+	users := getStore().Users()
+	if err := users.ReserveInvite(u.ID, getConfig().InviteAllowance); err == NotFoundError {
+		return NoInvitesLeftError
+	} else if err != nil {
+		return err
+	}
+	sc := &SignupCode{
+		EmailBound:  true,
+		Email:       email,
+		Label:       invitationLabel,
+		Creator:     u.ID,
+		Created:     now,
+		ExpiresAt:   now.Add(getConfig().InvitationTTL),
+		MaxUses:     1,
+		Redemptions: []Redemption{},
+	}
+	err = sc.persistRandom(func() (*OutboxMessage, error) {
+		return invitationMail(u, sc)
+	})
+	if err != nil {
+		if releaseErr := users.ReleaseInvite(u.ID); releaseErr != nil {
+			log.Println("Error giving back an invitation:", releaseErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Emails the invitation again.
+func sendInvitation(inviter *User, sc *SignupCode) error {
+	m, err := invitationMail(inviter, sc)
+	if err != nil {
+		return err
+	}
+	return getStore().Outbox().Insert(m)
+}
+
+// Returns the invitation to sign up with the code, in the inviter's
+// language. inviter is nil for people released from the waitlist.
+func invitationMail(inviter *User, sc *SignupCode) (*OutboxMessage, error) {
+	name, locale := "", ""
+	if inviter != nil {
+		name, locale = inviter.Username, inviter.Locale
+	}
+	return renderMail(TemplateInvitation, sc.Email, locale, map[string]interface{}{
+		"Inviter": name,
+		"Link":    appLink("/#/signup", url.Values{"code": {sc.Code}, "email": {sc.Email}}),
+		"Expires": sc.ExpiresAt,
+	})
+}
+
+// InvitesLeft tells how many more people the user can invite.
+func (u *User) InvitesLeft() (int, error) {
+	invitations, err := u.Invitations()
+	if err != nil {
+		return 0, err
+	}
+	left := getConfig().InviteAllowance
+	for _, inv := range invitations {
+		if inv.Status != InvitationRevoked {
+			left--
+		}
+	}
+	if left < 0 {
+		left = 0
+	}
+	return left, nil
+}
+
+// Invitations lists the invitations the user sent, newest first.
+func (u *User) Invitations() ([]Invitation, error) {
+	codes, err := getStore().SignupCodes().FindByCreator(u.ID)
+	if err != nil {
+		return nil, err
+	}
+	now := timeNow()
+	invitations := []Invitation{}
+	for _, sc := range codes {
+		if !sc.isInvitation() {
+			continue
+		}
+		inv := Invitation{Email: sc.Email, Sent: sc.Created, ExpiresAt: sc.ExpiresAt, Status: InvitationPending}
+		switch {
+		case len(sc.Redemptions) > 0:
+			inv.Status = InvitationAccepted
+			inv.Username = sc.Redemptions[0].Username
+		case !sc.Revoked.IsZero():
+			inv.Status = InvitationRevoked
+		case !sc.ExpiresAt.IsZero() && !now.Before(sc.ExpiresAt):
+			inv.Status = InvitationExpired
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, nil
+}
+
+// CancelInvitation revokes the user's pending invitation of the address,
+// giving the invitation back.
+func (u *User) CancelInvitation(email string) error {
+	codes, err := getStore().SignupCodes().FindByCreator(u.ID)
+	if err != nil {
+		return err
+	}
+	now := timeNow()
+	for _, sc := range codes {
+		if sc.isInvitation() && sc.Email == email && sc.usableBy(email, now) {
+			if err := getStore().SignupCodes().Revoke(sc.ID, now); err != nil {
+				return err
+			}
+			return getStore().Users().ReleaseInvite(u.ID)
+		}
+	}
+	return NotFoundError
+}
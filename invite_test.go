@@ -0,0 +1,109 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInvite(t *testing.T) {
+	clock := setupAuthTest(t)
+	std.config.InviteAllowance = 2
+	alice := registerTestUser(t, "alice", "plum-Harbor-42")
+	if err := alice.Invite("friend@example.com"); err != EmailNotVerifiedError {
+		t.Fatal("Expected EmailNotVerifiedError, got", err)
+	}
+	alice.EmailVerified = true
+	if err := alice.Invite("alice@example.com"); err != AlreadyRegisteredError {
+		t.Error("Expected AlreadyRegisteredError, got", err)
+	}
+	for _, email := range []string{"friend@example.com", "friend@example.com", "other@example.com"} {
+		if err := alice.Invite(email); err != nil {
+			t.Fatal("Invite:", err)
+		}
+	}
+	if err := alice.Invite("third@example.com"); err != NoInvitesLeftError {
+		t.Fatal("Expected NoInvitesLeftError, got", err)
+	}
+	if err := alice.CancelInvitation("other@example.com"); err != nil {
+		t.Fatal("CancelInvitation:", err)
+	}
+	if left, _ := alice.InvitesLeft(); left != 1 {
+		t.Error("Expected 1 invitation left, got", left)
+	}
+
+	codes, _ := getStore().SignupCodes().FindByCreator(alice.ID)
+	var code string
+	for _, sc := range codes {
+		if sc.Email == "friend@example.com" {
+			code = sc.Code
+		}
+	}
+	stranger := &User{Username: "stranger", Email: "stranger@example.com", EnteredPassword: "plum-Harbor-42"}
+	if err := stranger.SignupWithCode(code); err != SignupCodeNotRecognizedError {
+		t.Error("Invitation used by another address:", err)
+	}
+	friend := &User{Username: "friend", Email: "friend@example.com", EnteredPassword: "plum-Harbor-42"}
+	if err := friend.SignupWithCode(code); err != nil {
+		t.Fatal("SignupWithCode:", err)
+	}
+	if stored, _ := GetUserByName("friend"); stored.InvitedBy != alice.ID {
+		t.Error("Inviter not recorded:", stored.InvitedBy)
+	}
+
+	if err := alice.Invite("late@example.com"); err != nil {
+		t.Fatal("Invite:", err)
+	}
+	*clock = clock.Add(getConfig().InvitationTTL + time.Second)
+	invitations, err := alice.Invitations()
+	if err != nil {
+		t.Fatal("Invitations:", err)
+	}
+	statuses := map[string]string{}
+	for _, inv := range invitations {
+		statuses[inv.Email] = inv.Status
+	}
+	want := map[string]string{
+		"friend@example.com": InvitationAccepted,
+		"other@example.com":  InvitationRevoked,
+		"late@example.com":   InvitationExpired,
+	}
+	for email, status := range want {
+		if statuses[email] != status {
+			t.Errorf("Invitation of %s is %q, expected %q", email, statuses[email], status)
+		}
+	}
+}
+
+func TestConcurrentInvites(t *testing.T) {
+	setupAuthTest(t)
+	allowance := std.config.InviteAllowance
+	std.config.InviteAllowance = 3
+	defer func() { std.config.InviteAllowance = allowance }()
+	alice := registerTestUser(t, "alice", "plum-Harbor-42")
+	alice.EmailVerified = true
+
+	var wg sync.WaitGroup
+	results := make(chan error, 20)
+	for i := 0; i < cap(results); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results <- alice.Invite(fmt.Sprintf("friend%d@example.com", i))
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+	sent := 0
+	for err := range results {
+		if err == nil {
+			sent++
+		} else if err != NoInvitesLeftError {
+			t.Error("Unexpected error:", err)
+		}
+	}
+	if invitations, _ := alice.Invitations(); sent != 3 || len(invitations) != 3 {
+		t.Fatalf("Allowance exceeded: %d sent, %d stored", sent, len(invitations))
+	}
+}
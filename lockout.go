@@ -0,0 +1,84 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// timeNow is the package clock, replaced in tests.
+var timeNow = time.Now
+
+// LockoutPolicy decides when repeated failed logins lock an account.
+// After Threshold consecutive failures the account is locked for Duration,
+// multiplied by Backoff for every previous lockout, up to MaxDuration.
+// A successful login resets everything. A zero Threshold disables lockouts.
+type LockoutPolicy struct {
+	Threshold   int           `config:"threshold"    env:"QDOC_LOCKOUT_THRESHOLD"`
+	Duration    time.Duration `config:"duration"     env:"QDOC_LOCKOUT_DURATION"`
+	Backoff     float64       `config:"backoff"      env:"QDOC_LOCKOUT_BACKOFF"`
+	MaxDuration time.Duration `config:"max_duration" env:"QDOC_LOCKOUT_MAX_DURATION"`
+}
+
+// AccountLockedError is returned by the authentication path while an
+// account is locked.
+type AccountLockedError struct {
+	Until time.Time
+}
+
+func (e *AccountLockedError) Error() string {
+	return fmt.Sprintf("Account locked, retry after %s.", e.Until.UTC().Format(ISO8601))
+}
+
+// RetryAfter returns how long the caller has to wait, as of now.
+func (e *AccountLockedError) RetryAfter() time.Duration {
+	if d := e.Until.Sub(timeNow()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Returns how long the next lock lasts, given the number of previous ones.
+func (p LockoutPolicy) lockDuration(lockouts int) time.Duration {
+	backoff := p.Backoff
+	if backoff < 1 {
+		backoff = 1
+	}
+	d := float64(p.Duration) * math.Pow(backoff, float64(lockouts))
+	if p.MaxDuration > 0 && d > float64(p.MaxDuration) {
+		return p.MaxDuration
+	}
+	return time.Duration(d)
+}
+
+// IsLocked tells whether the user is currently locked out.
+func (u *User) IsLocked() bool {
+	return u.LockedUntil.After(timeNow())
+}
+
+// Lifts a lockout and resets the failed logins counters.
+// Doesn't perform any auth check.
+func (u *User) unlock() error {
+	err := getStore().Users().Unlock(u.ID)
+	if err == nil {
+		u.LockedUntil = time.Time{}
+		u.Lockouts = 0
+		u.FailedLogins = 0
+	}
+	return err
+}
+
+// UnlockUser lifts the lockout of the user with the given ID, if the
+// acting user is allowed to.
+func (actor *User) UnlockUser(uid string) error {
+	if !bson.IsObjectIdHex(uid) {
+		return InvalidUidError
+	}
+	u := &User{ID: bson.ObjectIdHex(uid)}
+	if err := Authorize(actor, ActionUnlockUser, u); err != nil {
+		return err
+	}
+	return u.unlock()
+}
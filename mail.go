@@ -1,51 +1,68 @@
 package core
 
 import (
-	"bytes"
-	"html/template"
-	"log"
+	"net/mail"
+	"strings"
 
 	mailgun "github.com/mailgun/mailgun-go"
-	"gopkg.in/mgo.v2/bson"
 )
 
-const (
-	SubscribersCollection       = "newsletter"
-	SIGNUP_NOTIFICATION_MESSAGE = "Hi, {{.Username}}! You've just signed up to GoQuadro.\nPlease click here to confirm your email address: {{.ConfirmationCode}}"
-)
+const SubscribersCollection = "newsletter"
 
-// ValidateEmailAddress is a wrapper for Mailgun email validator
+// ValidateEmailAddress is a wrapper for Mailgun email validator.
+// With other mailers, the address is only checked for syntax.
 func ValidateEmailAddress(email string) (mailgun.EmailVerification, error) {
-	gun := mailgun.NewMailgun(gqConfig.mailgunDomain, gqConfig.mailgunKey, gqConfig.mailgunPubKey)
-	return gun.ValidateEmail(email)
+	if v, ok := getMailer().(interface {
+		ValidateEmail(string) (mailgun.EmailVerification, error)
+	}); ok {
+		return v.ValidateEmail(email)
+	}
+	result := mailgun.EmailVerification{Address: email}
+	address, err := mail.ParseAddress(email)
+	if err != nil {
+		return result, nil
+	}
+	at := strings.LastIndex(address.Address, "@")
+	result.IsValid = true
+	result.Parts = mailgun.EmailVerificationParts{
+		LocalPart:   address.Address[:at],
+		Domain:      address.Address[at+1:],
+		DisplayName: address.Name,
+	}
+	return result, nil
 }
 
 // Add a single email address to the mailing list.
 // ToDo: Implement mailgun mailing list system
 func RegisterToNewsletter(email string) error {
-	locSession := getSession()
-	defer locSession.Close()
-	c := locSession.DB(gqConfig.jobDatabase).C(SubscribersCollection)
-	err := c.Insert(bson.M{"email": email})
-	return err
+	return getStore().Subscribers().Add(email)
 }
 
-// Wrapper for the Mailgun sender API
+// Queues a plain text email from the notification address, for the
+// outbox worker to send through the client's Mailer.
 func SendMail(subject, body, recipient string) error {
-	gun := mailgun.NewMailgun(gqConfig.mailgunDomain, gqConfig.mailgunKey, gqConfig.mailgunPubKey)
-
-	m := mailgun.NewMessage(gqConfig.notificationAddress, subject, body, recipient)
-	response, id, err := gun.Send(m)
-	log.Printf("Response ID: %s\n", id)
-	log.Printf("Message from server: %s\n", response)
-	return err
+	return enqueue("", &Message{
+		From:    getConfig().NotificationAddress,
+		To:      recipient,
+		Subject: subject,
+		Text:    body,
+	})
 }
 
-// Send a confirmation email to the newly registered user.
+// Send a welcome email to the newly registered user, with a link to
+// verify their address if needed.
 func (u User) SendConfirmationEmail() error {
-	var signup_notification_message []byte
-	buf := bytes.NewBuffer(signup_notification_message)
-	t := template.Must(template.New("letter").Parse(SIGNUP_NOTIFICATION_MESSAGE))
-	t.Execute(buf, u)
-	return SendMail("You just registered on GoQuadro", string(signup_notification_message), u.Email)
+	m, err := u.confirmationMail()
+	if err != nil {
+		return err
+	}
+	return getStore().Outbox().Insert(m)
+}
+
+func (u User) confirmationMail() (*OutboxMessage, error) {
+	data := map[string]interface{}{"Username": u.Username, "Link": ""}
+	if !u.EmailVerified && u.VerificationCode != "" {
+		data["Link"] = u.verificationLink()
+	}
+	return renderMail(TemplateWelcome, u.Email, u.Locale, data)
 }
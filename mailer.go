@@ -0,0 +1,266 @@
+package core
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	mailgun "github.com/mailgun/mailgun-go"
+)
+
+var StartTLSUnsupportedError = errors.New("The SMTP server doesn't support STARTTLS.")
+
+// Mail transports Config.Mailer can name.
+const (
+	MailerMailgun = "mailgun"
+	MailerSMTP    = "smtp"
+	MailerFile    = "file"
+	// MailerMemory keeps the emails in a MemoryMailer, see Client.Mailer.
+	MailerMemory = "memory"
+)
+
+// Message is an email to send. HTML is optional: when set, the message
+// is sent as multipart/alternative with Text as the plain part.
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer sends emails, returning the ID the transport gave the message.
+type Mailer interface {
+	Send(m *Message) (string, error)
+}
+
+// SMTPConfig describes a plain SMTP relay.
+type SMTPConfig struct {
+	Host     string `config:"host"      env:"QDOC_SMTP_HOST"`
+	Port     int    `config:"port"      env:"QDOC_SMTP_PORT"`
+	Username string `config:"username"  env:"QDOC_SMTP_USERNAME"`
+	Password string `config:"password"  env:"QDOC_SMTP_PASSWORD" secret:"true"`
+	// StartTLS makes sending fail unless the connection can be upgraded
+	// to TLS before authenticating.
+	StartTLS bool `config:"start_tls" env:"QDOC_SMTP_STARTTLS"`
+}
+
+// Builds the transport named in the configuration.
+func newMailer(cfg Config) Mailer {
+	switch cfg.Mailer {
+	case MailerSMTP:
+		return &SMTPMailer{cfg.SMTP}
+	case MailerFile:
+		return &FileMailer{Dir: cfg.MailDir}
+	case MailerMemory:
+		return new(MemoryMailer)
+	default:
+		return NewMailgunMailer(cfg.MailgunDomain, cfg.MailgunKey, cfg.MailgunPubKey)
+	}
+}
+
+// MailgunMailer sends emails through the Mailgun API.
+type MailgunMailer struct {
+	gun mailgun.Mailgun
+}
+
+func NewMailgunMailer(domain, key, publicKey string) *MailgunMailer {
+	return &MailgunMailer{mailgun.NewMailgun(domain, key, publicKey)}
+}
+
+func (g *MailgunMailer) Send(m *Message) (string, error) {
+	msg := mailgun.NewMessage(m.From, m.Subject, m.Text, m.To)
+	if m.HTML != "" {
+		msg.SetHtml(m.HTML)
+	}
+	_, id, err := g.gun.Send(msg)
+	return id, err
+}
+
+// ValidateEmail asks Mailgun whether the address looks deliverable.
+func (g *MailgunMailer) ValidateEmail(email string) (mailgun.EmailVerification, error) {
+	return g.gun.ValidateEmail(email)
+}
+
+// SMTPMailer sends emails through an SMTP relay.
+type SMTPMailer struct {
+	SMTPConfig
+}
+
+func (s *SMTPMailer) Send(m *Message) (string, error) {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return "", err
+	}
+	to, err := mail.ParseAddress(m.To)
+	if err != nil {
+		return "", err
+	}
+	id := newMessageID(s.Host)
+	raw, err := m.bytes(id, timeNow())
+	if err != nil {
+		return "", err
+	}
+	port := s.Port
+	if port == 0 {
+		port = 587
+	}
+	c, err := smtp.Dial(net.JoinHostPort(s.Host, strconv.Itoa(port)))
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	if s.StartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return "", StartTLSUnsupportedError
+		}
+		if err := c.StartTLS(&tls.Config{ServerName: s.Host}); err != nil {
+			return "", err
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return "", err
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return "", err
+	}
+	if err := c.Rcpt(to.Address); err != nil {
+		return "", err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return id, c.Quit()
+}
+
+// FileMailer writes emails to a maildir instead of sending them, for
+// development. Any mail client can open the directory.
+type FileMailer struct {
+	Dir string
+}
+
+func (f *FileMailer) Send(m *Message) (string, error) {
+	id := newMessageID("localhost")
+	raw, err := m.bytes(id, timeNow())
+	if err != nil {
+		return "", err
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(f.Dir, sub), 0700); err != nil {
+			return "", err
+		}
+	}
+	// Maildir readers only look at new, where files must appear complete.
+	name := fmt.Sprintf("%d.%s.qdoc", timeNow().UnixNano(), RandomUrlencodedString(6))
+	tmp := filepath.Join(f.Dir, "tmp", name)
+	if err := ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		return "", err
+	}
+	return id, os.Rename(tmp, filepath.Join(f.Dir, "new", name))
+}
+
+// MemoryMailer keeps the emails it is given, for tests.
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (r *MemoryMailer) Send(m *Message) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, *m)
+	return newMessageID("memory"), nil
+}
+
+// Messages returns the emails sent so far, oldest first.
+func (r *MemoryMailer) Messages() []Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Message(nil), r.messages...)
+}
+
+func newMessageID(host string) string {
+	return fmt.Sprintf("<%d.%s@%s>", timeNow().UnixNano(), RandomUrlencodedString(9), host)
+}
+
+// Formats the message as RFC 5322 text.
+func (m *Message) bytes(id string, date time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	header := textproto.MIMEHeader{}
+	header.Set("From", m.From)
+	header.Set("To", m.To)
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header.Set("Date", date.Format(time.RFC1123Z))
+	header.Set("Message-ID", id)
+	header.Set("MIME-Version", "1.0")
+	if m.HTML == "" {
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		writeHeader(&buf, header)
+		if err := writeQuotedPrintable(&buf, m.Text); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	parts := multipart.NewWriter(&buf)
+	header.Set("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	var top bytes.Buffer
+	writeHeader(&top, header)
+	for _, p := range []struct{ contentType, body string }{{"text/plain", m.Text}, {"text/html", m.HTML}} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(w, p.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return append(top.Bytes(), buf.Bytes()...), nil
+}
+
+func writeHeader(buf *bytes.Buffer, header textproto.MIMEHeader) {
+	for _, key := range []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"} {
+		if v := header.Get(key); v != "" {
+			fmt.Fprintf(buf, "%s: %s\r\n", key, v)
+		}
+	}
+	buf.WriteString("\r\n")
+}
+
+func writeQuotedPrintable(w io.Writer, s string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(s)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
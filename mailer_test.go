@@ -0,0 +1,160 @@
+package core
+
+import (
+	"bufio"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSendMail(t *testing.T) {
+	setupAuthTest(t)
+	if err := SendMail("Hello", "Body", "bob@example.com"); err != nil {
+		t.Fatal("SendMail:", err)
+	}
+	sent := sentMail()
+	if len(sent) != 1 || sent[0].To != "bob@example.com" || sent[0].From != getConfig().NotificationAddress || sent[0].Text != "Body" {
+		t.Error("Unexpected messages:", sent)
+	}
+	v, err := ValidateEmailAddress("Bob <bob@example.com>")
+	if err != nil || !v.IsValid || v.Parts.Domain != "example.com" || v.Parts.DisplayName != "Bob" {
+		t.Error("Unexpected validation:", v, err)
+	}
+	if v, _ := ValidateEmailAddress("bob"); v.IsValid {
+		t.Error("Accepted an invalid address")
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m := &FileMailer{Dir: dir}
+	msg := &Message{From: "qdoc <notify@example.com>", To: "bob@example.com", Subject: "Café", Text: "Plain", HTML: "<p>Rich</p>"}
+	id, err := m.Send(msg)
+	if err != nil {
+		t.Fatal("Send:", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "new", "*"))
+	if len(files) != 1 {
+		t.Fatal("Expected one message in new, got", files)
+	}
+	raw, _ := ioutil.ReadFile(files[0])
+	parsed, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatal("ReadMessage:", err)
+	}
+	if parsed.Header.Get("Message-Id") != id {
+		t.Error("Unexpected Message-ID:", parsed.Header.Get("Message-Id"))
+	}
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject")); subject != "Café" {
+		t.Error("Unexpected subject:", subject)
+	}
+	_, params, _ := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	parts := multipart.NewReader(parsed.Body, params["boundary"])
+	for _, want := range []string{"Plain", "<p>Rich</p>"} {
+		p, err := parts.NextPart()
+		if err != nil {
+			t.Fatal("NextPart:", err)
+		}
+		body, _ := ioutil.ReadAll(p)
+		if string(body) != want {
+			t.Errorf("Expected part %q, got %q", want, body)
+		}
+	}
+}
+
+func TestSMTPMailer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan []string, 2)
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		var log []string
+		reply("220 test")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			line = strings.TrimRight(line, "\r\n")
+			log = append(log, line)
+			switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+			case "EHLO", "HELO":
+				reply("250 test")
+			case "DATA":
+				reply("354 go on")
+				for {
+					data, err := r.ReadString('\n')
+					if err != nil || data == ".\r\n" {
+						break
+					}
+					log = append(log, strings.TrimRight(data, "\r\n"))
+				}
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				received <- log
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+		received <- log
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	m := &SMTPMailer{SMTPConfig{Host: host}}
+	m.Port, _ = net.LookupPort("tcp", port)
+	if _, err := m.Send(&Message{From: "qdoc <notify@example.com>", To: "bob@example.com", Subject: "Hi", Text: "Hello"}); err != nil {
+		t.Fatal("Send:", err)
+	}
+	session := strings.Join(<-received, "\n")
+	for _, want := range []string{"MAIL FROM:<notify@example.com>", "RCPT TO:<bob@example.com>", "Subject: Hi", "Hello"} {
+		if !strings.Contains(session, want) {
+			t.Errorf("Expected %q in the session:\n%s", want, session)
+		}
+	}
+
+	m.StartTLS = true
+	if _, err := m.Send(&Message{From: "notify@example.com", To: "bob@example.com"}); err == nil {
+		t.Error("Sent without STARTTLS")
+	}
+}
+
+func TestMemoryMailerFromConfig(t *testing.T) {
+	memory := func(cfg *Config) error {
+		cfg.Mailer = MailerMemory
+		return nil
+	}
+	if _, err := LoadConfig(memory); err != nil {
+		t.Fatal("LoadConfig:", err)
+	}
+	c := NewWithStore(Config{Mailer: "memory"}, NewMemoryStore())
+	mailer, ok := c.Mailer().(*MemoryMailer)
+	if !ok {
+		t.Fatalf("Expected a MemoryMailer, got %T", c.Mailer())
+	}
+	if _, err := mailer.Send(&Message{To: "bob@example.com", Subject: "Hello"}); err != nil {
+		t.Fatal("Send:", err)
+	}
+	if sent := mailer.Messages(); len(sent) != 1 || sent[0].Subject != "Hello" {
+		t.Error("Unexpected messages:", sent)
+	}
+}
@@ -0,0 +1,338 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var EmailBouncedError = errors.New("Email to your address bounced, please check it or use another one.")
+var SuppressedAddressError = errors.New("No more email is sent to this address, after a bounce or a complaint.")
+var InvalidWebhookSignatureError = errors.New("Invalid webhook signature.")
+
+// Kinds of mail events reported by the provider.
+const (
+	MailDelivered  = "delivered"
+	MailBounced    = "bounced"
+	MailComplained = "complained"
+)
+
+// Webhook calls signed longer ago than this are refused, so that captured
+// ones can't be replayed.
+const webhookMaxAge = 15 * time.Minute
+
+// Largest webhook body read.
+const webhookMaxBody = 1 << 20
+
+// MailEvent is something that happened to an email after it was handed to
+// the provider.
+type MailEvent struct {
+	ID         bson.ObjectId `bson:"_id"               json:"id"`
+	Message    bson.ObjectId `bson:"message,omitempty" json:"message,omitempty"`
+	ProviderID string        `bson:"provider_id"       json:"providerId"`
+	Recipient  string        `bson:"recipient"         json:"recipient"`
+	Type       string        `bson:"type"              json:"type"`
+	// Permanent tells hard bounces from the ones worth retrying.
+	Permanent bool      `bson:"permanent"        json:"permanent"`
+	Reason    string    `bson:"reason,omitempty" json:"reason,omitempty"`
+	At        time.Time `bson:"at"               json:"at"`
+	Received  time.Time `bson:"received"         json:"received"`
+}
+
+// Suppression stops email to an address that bounced or complained.
+type Suppression struct {
+	Email   string    `bson:"_id"              json:"email"`
+	Type    string    `bson:"type"             json:"type"`
+	Reason  string    `bson:"reason,omitempty" json:"reason,omitempty"`
+	Created time.Time `bson:"created"          json:"created"`
+}
+
+// Suppression list entries are looked up by address, case-insensitively.
+func suppressionKey(email string) string {
+	return strings.ToLower(recipientAddress(email))
+}
+
+// Message IDs are stored without the angle brackets some providers add.
+func normalizeMessageID(id string) string {
+	return strings.Trim(strings.TrimSpace(id), "<>")
+}
+
+// Returns SuppressedAddressError if email to the address is suppressed.
+func checkSuppressed(email string) error {
+	_, err := getStore().Suppressions().Find(suppressionKey(email))
+	if err == NotFoundError {
+		return nil
+	}
+	if err == nil {
+		return SuppressedAddressError
+	}
+	return err
+}
+
+// RecordMailEvent stores an event reported by the provider, on the
+// outbox message with the same provider ID if any.
+// Hard bounces and complaints put the recipient on the suppression list.
+// Users whose address hard bounced have it marked unverified, and
+// EmailBounced set.
+func RecordMailEvent(e *MailEvent) error {
+	e.ID = bson.NewObjectId()
+	e.ProviderID = normalizeMessageID(e.ProviderID)
+	e.Received = timeNow()
+	if e.At.IsZero() {
+		e.At = e.Received
+	}
+	if e.ProviderID != "" {
+		m, err := getStore().Outbox().FindByProviderID(e.ProviderID)
+		switch {
+		case err == nil:
+			e.Message = m.ID
+			if e.Recipient == "" {
+				e.Recipient = m.To
+			}
+		case err != NotFoundError:
+			return err
+		}
+	}
+	if err := getStore().MailEvents().Insert(e); err != nil {
+		return err
+	}
+	if e.Type == MailComplained || e.Type == MailBounced && e.Permanent {
+		if err := suppress(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func suppress(e *MailEvent) error {
+	if e.Recipient == "" {
+		return nil
+	}
+	err := getStore().Suppressions().Add(&Suppression{
+		Email:   suppressionKey(e.Recipient),
+		Type:    e.Type,
+		Reason:  e.Reason,
+		Created: e.Received,
+	})
+	if err != nil || e.Type != MailBounced {
+		return err
+	}
+	// Addresses are stored as users typed them, and providers may report
+	// them in another case, which the lookup ignores like the suppression
+	// list does.
+	users, err := getStore().Users().FindAllByEmailFold(recipientAddress(e.Recipient))
+	if err != nil {
+		return err
+	}
+	for i := range users {
+		u := &users[i]
+		u.EmailVerified = false
+		u.EmailBounced = e.At
+		if err := getStore().Users().UpdateFields(u, "email_verified", "email_bounced"); err != nil && err != NotFoundError {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the address of a recipient reported by the provider, parsed like
+// User.SetEmail does.
+func recipientAddress(recipient string) string {
+	if address, err := mail.ParseAddress(recipient); err == nil {
+		return address.Address
+	}
+	return strings.TrimSpace(recipient)
+}
+
+// MailEvents lists the events recorded for an outbox message.
+func (actor *User) MailEvents(messageID string) ([]MailEvent, error) {
+	if err := Authorize(actor, ActionManageOutbox, nil); err != nil {
+		return nil, err
+	}
+	if !bson.IsObjectIdHex(messageID) {
+		return nil, NotFoundError
+	}
+	return getStore().MailEvents().FindByMessage(bson.ObjectIdHex(messageID))
+}
+
+// Suppressions lists the addresses no email is sent to.
+func (actor *User) Suppressions() ([]Suppression, error) {
+	if err := Authorize(actor, ActionManageOutbox, nil); err != nil {
+		return nil, err
+	}
+	return getStore().Suppressions().List()
+}
+
+// Unsuppress lets email be sent to the address again.
+func (actor *User) Unsuppress(email string) error {
+	if err := Authorize(actor, ActionManageOutbox, nil); err != nil {
+		return err
+	}
+	return getStore().Suppressions().Remove(suppressionKey(email))
+}
+
+// Payload of the Mailgun webhooks.
+type mailgunWebhook struct {
+	Signature struct {
+		Timestamp string `json:"timestamp"`
+		Token     string `json:"token"`
+		Signature string `json:"signature"`
+	} `json:"signature"`
+	EventData struct {
+		Event     string  `json:"event"`
+		Severity  string  `json:"severity"`
+		Reason    string  `json:"reason"`
+		Recipient string  `json:"recipient"`
+		Timestamp float64 `json:"timestamp"`
+		Message   struct {
+			Headers struct {
+				MessageID string `json:"message-id"`
+			} `json:"headers"`
+		} `json:"message"`
+		DeliveryStatus struct {
+			Message     string `json:"message"`
+			Description string `json:"description"`
+		} `json:"delivery-status"`
+	} `json:"event-data"`
+}
+
+// Checks the signature Mailgun computes from the timestamp and token, with
+// the webhook signing key.
+func (w *mailgunWebhook) verify(key string) error {
+	s := w.Signature
+	sec, err := strconv.ParseInt(s.Timestamp, 10, 64)
+	if err != nil || key == "" {
+		return InvalidWebhookSignatureError
+	}
+	if age := timeNow().Sub(time.Unix(sec, 0)); age > webhookMaxAge || age < -webhookMaxAge {
+		return InvalidWebhookSignatureError
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(s.Timestamp + s.Token))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(s.Signature))) {
+		return InvalidWebhookSignatureError
+	}
+	return nil
+}
+
+// Returns the event to record, or nil for the kinds that aren't.
+func (w *mailgunWebhook) event() *MailEvent {
+	d := w.EventData
+	e := &MailEvent{
+		ProviderID: d.Message.Headers.MessageID,
+		Recipient:  d.Recipient,
+		Reason:     d.DeliveryStatus.Description,
+	}
+	if e.Reason == "" {
+		e.Reason = d.DeliveryStatus.Message
+	}
+	if e.Reason == "" {
+		e.Reason = d.Reason
+	}
+	if d.Timestamp > 0 {
+		e.At = time.Unix(0, int64(d.Timestamp*float64(time.Second)))
+	}
+	switch d.Event {
+	case "delivered":
+		e.Type = MailDelivered
+	case "failed":
+		e.Type, e.Permanent = MailBounced, d.Severity == "permanent"
+	case "complained":
+		e.Type = MailComplained
+	default:
+		return nil
+	}
+	return e
+}
+
+// MailgunWebhookHandler records the events Mailgun posts to its webhooks.
+// Calls must be signed with Config.MailgunWebhookKey.
+func MailgunWebhookHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload mailgunWebhook
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, webhookMaxBody)).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := payload.verify(getConfig().MailgunWebhookKey); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if e := payload.event(); e != nil {
+			recordWebhookEvent(w, e)
+		}
+	})
+}
+
+// Body of the generic mail event webhook.
+type mailEventWebhook struct {
+	Event     string    `json:"event"`
+	MessageID string    `json:"message_id"`
+	Recipient string    `json:"recipient"`
+	Permanent bool      `json:"permanent"`
+	Reason    string    `json:"reason"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// MailEventWebhookHandler records events posted as JSON objects with the
+// fields event (delivered, bounced or complained), message_id, recipient,
+// permanent, reason and timestamp (RFC 3339), for providers other than
+// Mailgun. The X-Signature header must hold the hex HMAC-SHA256 of the
+// body, keyed with Config.MailEventSecret.
+func MailEventWebhookHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, webhookMaxBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		key := getConfig().MailEventSecret
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write(body)
+		expected := hex.EncodeToString(mac.Sum(nil))
+		if key == "" || !hmac.Equal([]byte(expected), []byte(strings.ToLower(r.Header.Get("X-Signature")))) {
+			http.Error(w, InvalidWebhookSignatureError.Error(), http.StatusForbidden)
+			return
+		}
+		var payload mailEventWebhook
+		if err := json.Unmarshal(body, &payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch payload.Event {
+		case MailDelivered, MailBounced, MailComplained:
+		default:
+			http.Error(w, "Unknown event.", http.StatusBadRequest)
+			return
+		}
+		recordWebhookEvent(w, &MailEvent{
+			ProviderID: payload.MessageID,
+			Recipient:  payload.Recipient,
+			Type:       payload.Event,
+			Permanent:  payload.Permanent,
+			Reason:     payload.Reason,
+			At:         payload.Timestamp,
+		})
+	})
+}
+
+// Records the event, failing the call so that the provider retries it if
+// that didn't work.
+func recordWebhookEvent(w http.ResponseWriter, e *MailEvent) {
+	if err := RecordMailEvent(e); err != nil {
+		log.Println("Error recording mail event:", err)
+		http.Error(w, "Internal error.", http.StatusInternalServerError)
+	}
+}
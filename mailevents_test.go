@@ -0,0 +1,185 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sets the webhook keys for the test.
+func setupWebhookKeys(t *testing.T) {
+	mailgunKey, secret := std.config.MailgunWebhookKey, std.config.MailEventSecret
+	std.config.MailgunWebhookKey, std.config.MailEventSecret = "mailgun-key", "event-secret"
+	t.Cleanup(func() {
+		std.config.MailgunWebhookKey, std.config.MailEventSecret = mailgunKey, secret
+	})
+}
+
+func hmacHex(key, data string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Posts a Mailgun event signed at the given time, returning the status.
+func postMailgunEvent(key string, signed time.Time, event, severity, messageID, recipient string) int {
+	timestamp, token := fmt.Sprint(signed.Unix()), "0123456789abcdef"
+	body := fmt.Sprintf(`{
+		"signature": {"timestamp": %q, "token": %q, "signature": %q},
+		"event-data": {
+			"event": %q, "severity": %q, "recipient": %q, "timestamp": %d.25,
+			"message": {"headers": {"message-id": %q}},
+			"delivery-status": {"code": 550, "description": "No such mailbox"}
+		}
+	}`, timestamp, token, hmacHex(key, timestamp+token), event, severity, recipient, signed.Unix(), messageID)
+	rec := httptest.NewRecorder()
+	MailgunWebhookHandler().ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	return rec.Code
+}
+
+func postMailEvent(signature, body string) int {
+	r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	r.Header.Set("X-Signature", signature)
+	rec := httptest.NewRecorder()
+	MailEventWebhookHandler().ServeHTTP(rec, r)
+	return rec.Code
+}
+
+func TestMailgunBounce(t *testing.T) {
+	clock := setupAuthTest(t)
+	setupWebhookKeys(t)
+	admin := registerTestAdmin(t, "admin")
+	bob := registerTestUser(t, "bob", "plum-Harbor-42")
+	bob.EmailVerified = true
+	getStore().Users().Update(bob)
+	sentMail()
+	messages, _ := admin.OutboxMessages(OutboxSent, 1)
+	welcome := messages[0]
+	if welcome.To != bob.Email || welcome.ProviderID == "" || strings.ContainsAny(welcome.ProviderID, "<>") {
+		t.Fatalf("Unexpected message %+v", welcome)
+	}
+
+	if code := postMailgunEvent("wrong-key", *clock, "failed", "permanent", welcome.ProviderID, bob.Email); code != http.StatusForbidden {
+		t.Fatal("Expected a forged call to be refused, got", code)
+	}
+	if code := postMailgunEvent("mailgun-key", clock.Add(-time.Hour), "failed", "permanent", welcome.ProviderID, bob.Email); code != http.StatusForbidden {
+		t.Fatal("Expected a replayed call to be refused, got", code)
+	}
+	if code := postMailgunEvent("mailgun-key", *clock, "opened", "", welcome.ProviderID, bob.Email); code != http.StatusOK {
+		t.Fatal("Expected other events to be ignored, got", code)
+	}
+	if code := postMailgunEvent("mailgun-key", *clock, "failed", "temporary", welcome.ProviderID, bob.Email); code != http.StatusOK {
+		t.Fatal("Webhook failed:", code)
+	}
+	if err := SendMail("Hello", "Hi.", bob.Email); err != nil {
+		t.Fatal("Soft bounce suppressed the address:", err)
+	}
+	if code := postMailgunEvent("mailgun-key", *clock, "failed", "permanent", "<"+welcome.ProviderID+">", bob.Email); code != http.StatusOK {
+		t.Fatal("Webhook failed:", code)
+	}
+
+	if _, err := bob.MailEvents(welcome.ID.Hex()); err != ForbiddenError {
+		t.Fatal("Expected ForbiddenError, got", err)
+	}
+	events, err := admin.MailEvents(welcome.ID.Hex())
+	if err != nil || len(events) != 2 {
+		t.Fatalf("Expected two events, got %+v %v", events, err)
+	}
+	if e := events[1]; e.Type != MailBounced || !e.Permanent || e.Reason != "No such mailbox" || e.Recipient != bob.Email {
+		t.Fatalf("Unexpected event %+v", e)
+	}
+	bob.Sync()
+	if bob.EmailVerified || bob.EmailBounced.IsZero() {
+		t.Fatal("Expected the bounce to be flagged on the user")
+	}
+	std.config.RequireVerifiedEmail = []string{ActionWriteDocuments}
+	defer func() { std.config.RequireVerifiedEmail = nil }()
+	if err := bob.requireVerifiedEmail(ActionWriteDocuments); err != EmailBouncedError {
+		t.Fatal("Expected EmailBouncedError, got", err)
+	}
+
+	// The message queued before the bounce isn't sent.
+	if n, _ := DeliverOutbox(); n != 0 {
+		t.Fatal("Sent to a suppressed address")
+	}
+	if err := SendMail("Hello", "Hi.", strings.ToUpper(bob.Email)); err != SuppressedAddressError {
+		t.Fatal("Expected SuppressedAddressError, got", err)
+	}
+	if err := RequestPasswordReset(bob.Email); err != nil {
+		t.Fatal("RequestPasswordReset:", err)
+	}
+	list, _ := admin.Suppressions()
+	if len(list) != 1 || list[0].Email != bob.Email || list[0].Type != MailBounced {
+		t.Fatalf("Unexpected suppression list %+v", list)
+	}
+
+	if err := admin.Unsuppress(bob.Email); err != nil {
+		t.Fatal("Unsuppress:", err)
+	}
+	if err := SendMail("Hello", "Hi.", bob.Email); err != nil {
+		t.Fatal("SendMail:", err)
+	}
+	if err := bob.SetEmail("bob@example.org"); err != nil || !bob.EmailBounced.IsZero() {
+		t.Fatal("Expected a new address to clear the bounce", err)
+	}
+}
+
+func TestMailEventWebhook(t *testing.T) {
+	setupAuthTest(t)
+	setupWebhookKeys(t)
+	admin := registerTestAdmin(t, "admin")
+	sentMail()
+	messages, _ := admin.OutboxMessages(OutboxSent, 1)
+	welcome := messages[0]
+
+	delivered := fmt.Sprintf(`{"event": "delivered", "message_id": %q, "timestamp": "2015-03-01T12:00:05Z"}`, welcome.ProviderID)
+	if code := postMailEvent(hmacHex("wrong", delivered), delivered); code != http.StatusForbidden {
+		t.Fatal("Expected a forged call to be refused, got", code)
+	}
+	if code := postMailEvent(hmacHex("event-secret", delivered), delivered); code != http.StatusOK {
+		t.Fatal("Webhook failed:", code)
+	}
+	unknown := `{"event": "exploded"}`
+	if code := postMailEvent(hmacHex("event-secret", unknown), unknown); code != http.StatusBadRequest {
+		t.Fatal("Expected an unknown event to be refused, got", code)
+	}
+	complaint := `{"event": "complained", "recipient": "carol@example.com"}`
+	if code := postMailEvent(hmacHex("event-secret", complaint), complaint); code != http.StatusOK {
+		t.Fatal("Webhook failed:", code)
+	}
+
+	events, _ := admin.MailEvents(welcome.ID.Hex())
+	if len(events) != 1 || events[0].Type != MailDelivered || events[0].Recipient != admin.Email ||
+		!events[0].At.Equal(time.Date(2015, 3, 1, 12, 0, 5, 0, time.UTC)) {
+		t.Fatalf("Unexpected events %+v", events)
+	}
+	if err := SendMail("Hello", "Hi.", "carol@example.com"); err != SuppressedAddressError {
+		t.Fatal("Expected SuppressedAddressError after a complaint, got", err)
+	}
+}
+
+func TestMixedCaseBounce(t *testing.T) {
+	setupAuthTest(t)
+	setupWebhookKeys(t)
+	alice := registerTestUser(t, "alice", "plum-Harbor-42")
+	alice.EmailVerified = true
+	getStore().Users().UpdateFields(alice, "email_verified")
+
+	bounce := `{"event": "bounced", "recipient": "Alice <Alice@Example.COM>", "permanent": true}`
+	if code := postMailEvent(hmacHex("event-secret", bounce), bounce); code != http.StatusOK {
+		t.Fatal("Webhook failed:", code)
+	}
+	alice.Sync()
+	if alice.EmailVerified || alice.EmailBounced.IsZero() {
+		t.Fatal("Expected the bounce to be flagged on the user")
+	}
+	if err := SendMail("Hello", "Hi.", alice.Email); err != SuppressedAddressError {
+		t.Fatal("Expected SuppressedAddressError, got", err)
+	}
+}
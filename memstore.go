@@ -0,0 +1,1219 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MemoryStore is an in-memory implementation of Store, meant for tests
+// and for running without a MongoDB server.
+// Values are copied through a BSON round trip on the way in and out, so
+// fields tagged bson:"-" are dropped exactly as they would be by MongoDB.
+type MemoryStore struct {
+	mu          sync.Mutex
+	users       map[bson.ObjectId]*User
+	documents   map[bson.ObjectId]*Document
+	signupCodes map[bson.ObjectId]*SignupCode
+	subscribers []string
+	files       map[bson.ObjectId]*File
+	attempts    []LoginAttempt
+	sessions    map[bson.ObjectId]*Session
+	resets      map[bson.ObjectId]*PasswordReset
+	apiKeys     map[bson.ObjectId]*APIKey
+	waitlist    map[bson.ObjectId]*WaitlistEntry
+	outbox      map[bson.ObjectId]*OutboxMessage
+	mailEvents  map[bson.ObjectId]*MailEvent
+	suppressed  map[string]*Suppression
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:       make(map[bson.ObjectId]*User),
+		documents:   make(map[bson.ObjectId]*Document),
+		signupCodes: make(map[bson.ObjectId]*SignupCode),
+		files:       make(map[bson.ObjectId]*File),
+		sessions:    make(map[bson.ObjectId]*Session),
+		resets:      make(map[bson.ObjectId]*PasswordReset),
+		apiKeys:     make(map[bson.ObjectId]*APIKey),
+		waitlist:    make(map[bson.ObjectId]*WaitlistEntry),
+		outbox:      make(map[bson.ObjectId]*OutboxMessage),
+		mailEvents:  make(map[bson.ObjectId]*MailEvent),
+		suppressed:  make(map[string]*Suppression),
+	}
+}
+
+// Copies src into dst the way a MongoDB write and read would.
+func clone(src, dst interface{}) {
+	raw, err := bson.Marshal(src)
+	check(err)
+	check(bson.Unmarshal(raw, dst))
+}
+
+func (s *MemoryStore) Users() UserStore                   { return memUsers{s} }
+func (s *MemoryStore) Documents() DocumentStore           { return memDocuments{s} }
+func (s *MemoryStore) SignupCodes() SignupCodeStore       { return memSignupCodes{s} }
+func (s *MemoryStore) Subscribers() SubscriberStore       { return memSubscribers{s} }
+func (s *MemoryStore) Files() FileStore                   { return memFiles{s} }
+func (s *MemoryStore) LoginAttempts() LoginAttemptStore   { return memLoginAttempts{s} }
+func (s *MemoryStore) Sessions() SessionStore             { return memSessions{s} }
+func (s *MemoryStore) PasswordResets() PasswordResetStore { return memPasswordResets{s} }
+func (s *MemoryStore) APIKeys() APIKeyStore               { return memAPIKeys{s} }
+func (s *MemoryStore) Waitlist() WaitlistStore            { return memWaitlist{s} }
+func (s *MemoryStore) Outbox() OutboxStore                { return memOutbox{s} }
+func (s *MemoryStore) MailEvents() MailEventStore         { return memMailEvents{s} }
+func (s *MemoryStore) Suppressions() SuppressionStore     { return memSuppressions{s} }
+func (s *MemoryStore) PendingMail() PendingMailStore      { return memPendingMail{s} }
+
+// EnsureSchema does nothing: MemoryStore enforces its constraints in code.
+func (s *MemoryStore) EnsureSchema(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+type memUsers struct{ s *MemoryStore }
+
+func (m memUsers) FindByID(id bson.ObjectId) (*User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	u := new(User)
+	stored, ok := m.s.users[id]
+	if !ok {
+		return u, NotFoundError
+	}
+	clone(stored, u)
+	return u, nil
+}
+
+func (m memUsers) FindByUsername(username string) (*User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	u := new(User)
+	for _, stored := range m.s.users {
+		if stored.Username == username {
+			clone(stored, u)
+			return u, nil
+		}
+	}
+	return u, NotFoundError
+}
+
+func (m memUsers) FindByEmail(email string) (*User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	u := new(User)
+	for _, stored := range m.s.users {
+		if stored.Email == email {
+			clone(stored, u)
+			return u, nil
+		}
+	}
+	return u, NotFoundError
+}
+
+func (m memUsers) FindAllByEmailFold(email string) ([]User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	users := []User{}
+	for _, stored := range m.s.users {
+		if strings.EqualFold(stored.Email, email) {
+			var u User
+			clone(stored, &u)
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+func (m memUsers) FindByVerificationCode(code string) (*User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	u := new(User)
+	for _, stored := range m.s.users {
+		if stored.VerificationCode == code {
+			clone(stored, u)
+			return u, nil
+		}
+	}
+	return u, NotFoundError
+}
+
+func (m memUsers) FindByGoogleOAuthSub(sub string) (*User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	u := new(User)
+	for _, stored := range m.s.users {
+		if sub != "" && stored.GoogleOAuthSub == sub {
+			clone(stored, u)
+			return u, nil
+		}
+	}
+	return u, NotFoundError
+}
+
+func (m memUsers) FindByIdentity(provider, subject string) (*User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	u := new(User)
+	for _, stored := range m.s.users {
+		if stored.hasIdentity(provider, subject) {
+			clone(stored, u)
+			return u, nil
+		}
+	}
+	return u, NotFoundError
+}
+
+// Tells whether another user than u has the same username or identity.
+func (s *MemoryStore) conflicts(u *User) bool {
+	for id, stored := range s.users {
+		if id == u.ID {
+			continue
+		}
+		if stored.Username == u.Username {
+			return true
+		}
+		for _, i := range u.Identities {
+			if stored.hasIdentity(i.Provider, i.Subject) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m memUsers) Insert(u *User) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if u.ID == "" {
+		u.ID = bson.NewObjectId()
+	}
+	if _, ok := m.s.users[u.ID]; ok || m.s.conflicts(u) {
+		return DuplicateKeyError
+	}
+	stored := new(User)
+	clone(u, stored)
+	m.s.users[u.ID] = stored
+	return nil
+}
+
+func (m memUsers) Update(u *User) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if _, ok := m.s.users[u.ID]; !ok {
+		return NotFoundError
+	}
+	if m.s.conflicts(u) {
+		return DuplicateKeyError
+	}
+	stored := new(User)
+	clone(u, stored)
+	m.s.users[u.ID] = stored
+	return nil
+}
+
+func (m memUsers) UpdateFields(u *User, fields ...string) error {
+	return m.updateFields(u, nil, fields)
+}
+
+func (m memUsers) UpdateFieldsWithMail(u *User, msg *OutboxMessage, fields ...string) error {
+	return m.updateFields(u, msg, fields)
+}
+
+func (m memUsers) updateFields(u *User, msg *OutboxMessage, fields []string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored, ok := m.s.users[u.ID]
+	if !ok {
+		return NotFoundError
+	}
+	updated := new(User)
+	mergeFields(stored, u, fields, msg, updated)
+	if m.s.conflicts(updated) {
+		return DuplicateKeyError
+	}
+	m.s.users[u.ID] = updated
+	return nil
+}
+
+// Copies stored into updated with the given fields of v, adding msg to
+// the pending mail if not nil, the way a MongoDB update would.
+func mergeFields(stored, v interface{}, fields []string, msg *OutboxMessage, updated interface{}) {
+	doc := bson.M{}
+	clone(stored, doc)
+	set, unset := fieldUpdate(v, fields)
+	for f, value := range set {
+		doc[f] = value
+	}
+	for f := range unset {
+		delete(doc, f)
+	}
+	if msg != nil {
+		pending, _ := doc["pending_mail"].([]interface{})
+		doc["pending_mail"] = append(pending, msg)
+	}
+	clone(doc, updated)
+}
+
+func (m memUsers) Remove(id bson.ObjectId) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if _, ok := m.s.users[id]; !ok {
+		return NotFoundError
+	}
+	delete(m.s.users, id)
+	return nil
+}
+
+func (m memUsers) RecordLogin(id bson.ObjectId, at time.Time) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored, ok := m.s.users[id]
+	if !ok {
+		return NotFoundError
+	}
+	stored.LastLogin = at
+	stored.FailedLogins = 0
+	stored.Lockouts = 0
+	stored.LockedUntil = time.Time{}
+	return nil
+}
+
+func (m memUsers) IncFailedLogins(id bson.ObjectId) (int, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored, ok := m.s.users[id]
+	if !ok {
+		return 0, NotFoundError
+	}
+	stored.FailedLogins++
+	return stored.FailedLogins, nil
+}
+
+func (m memUsers) Lock(id bson.ObjectId, until time.Time) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored, ok := m.s.users[id]
+	if !ok {
+		return NotFoundError
+	}
+	stored.LockedUntil = until
+	stored.Lockouts++
+	stored.FailedLogins = 0
+	return nil
+}
+
+func (m memUsers) Unlock(id bson.ObjectId) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored, ok := m.s.users[id]
+	if !ok {
+		return NotFoundError
+	}
+	stored.LockedUntil = time.Time{}
+	stored.Lockouts = 0
+	stored.FailedLogins = 0
+	return nil
+}
+
+func (m memUsers) ReserveInvite(id bson.ObjectId, allowance int) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored, ok := m.s.users[id]
+	if !ok || stored.InvitesUsed >= allowance {
+		return NotFoundError
+	}
+	stored.InvitesUsed++
+	return nil
+}
+
+func (m memUsers) ReleaseInvite(id bson.ObjectId) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored, ok := m.s.users[id]
+	if !ok {
+		return NotFoundError
+	}
+	if stored.InvitesUsed > 0 {
+		stored.InvitesUsed--
+	}
+	return nil
+}
+
+type memDocuments struct{ s *MemoryStore }
+
+func (m memDocuments) FindByOwner(owner bson.ObjectId) ([]Document, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	docs := []Document{}
+	for _, stored := range m.s.documents {
+		if stored.Owner == owner {
+			var d Document
+			clone(stored, &d)
+			docs = append(docs, d)
+		}
+	}
+	return docs, nil
+}
+
+func (m memDocuments) FindByID(owner, id bson.ObjectId) (*Document, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	d := new(Document)
+	stored, ok := m.s.documents[id]
+	if !ok || stored.Owner != owner {
+		return d, NotFoundError
+	}
+	clone(stored, d)
+	return d, nil
+}
+
+func (m memDocuments) Insert(d *Document) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if _, ok := m.s.documents[d.ID]; ok {
+		return DuplicateKeyError
+	}
+	stored := new(Document)
+	clone(d, stored)
+	m.s.documents[d.ID] = stored
+	return nil
+}
+
+func (m memDocuments) Update(d *Document) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored, ok := m.s.documents[d.ID]
+	if !ok || stored.Owner != d.Owner {
+		return NotFoundError
+	}
+	stored = new(Document)
+	clone(d, stored)
+	m.s.documents[d.ID] = stored
+	return nil
+}
+
+func (m memDocuments) Remove(owner, id bson.ObjectId) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored, ok := m.s.documents[id]
+	if !ok || stored.Owner != owner {
+		return NotFoundError
+	}
+	delete(m.s.documents, id)
+	return nil
+}
+
+func (m memDocuments) AddChild(owner, parent, child bson.ObjectId) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored, ok := m.s.documents[parent]
+	if !ok || stored.Owner != owner {
+		return NotFoundError
+	}
+	stored.Children = append(stored.Children, child)
+	stored.LastModified = time.Now()
+	return nil
+}
+
+func (m memDocuments) ChangeOwner(id, from, to bson.ObjectId) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored, ok := m.s.documents[id]
+	if !ok || stored.Owner != from {
+		return NotFoundError
+	}
+	stored.Owner = to
+	stored.LastModified = time.Now()
+	return nil
+}
+
+func (m memDocuments) TransferAll(from, to bson.ObjectId) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for _, stored := range m.s.documents {
+		if stored.Owner == from {
+			stored.Owner = to
+		}
+	}
+	return nil
+}
+
+type memSignupCodes struct{ s *MemoryStore }
+
+func (m memSignupCodes) Insert(sc *SignupCode) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if sc.ID == "" {
+		sc.ID = bson.NewObjectId()
+	}
+	if _, ok := m.s.signupCodes[sc.ID]; ok {
+		return DuplicateKeyError
+	}
+	for _, stored := range m.s.signupCodes {
+		if stored.Code == sc.Code {
+			return DuplicateKeyError
+		}
+	}
+	stored := new(SignupCode)
+	clone(sc, stored)
+	m.s.signupCodes[sc.ID] = stored
+	return nil
+}
+
+func (m memSignupCodes) FindByCode(code string) ([]SignupCode, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	codes := []SignupCode{}
+	for _, stored := range m.s.signupCodes {
+		if stored.Code == code {
+			var sc SignupCode
+			clone(stored, &sc)
+			codes = append(codes, sc)
+		}
+	}
+	return codes, nil
+}
+
+func (m memSignupCodes) List(label string) ([]SignupCode, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	codes := []SignupCode{}
+	for _, stored := range m.s.signupCodes {
+		if label == "" || stored.Label == label {
+			var sc SignupCode
+			clone(stored, &sc)
+			codes = append(codes, sc)
+		}
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i].ID > codes[j].ID })
+	return codes, nil
+}
+
+func (m memSignupCodes) FindByCreator(creator bson.ObjectId) ([]SignupCode, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	codes := []SignupCode{}
+	for _, stored := range m.s.signupCodes {
+		if stored.Creator == creator {
+			var sc SignupCode
+			clone(stored, &sc)
+			codes = append(codes, sc)
+		}
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i].ID > codes[j].ID })
+	return codes, nil
+}
+
+func (m memSignupCodes) Claim(code string, r Redemption) (*SignupCode, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	sc := new(SignupCode)
+	for _, stored := range m.s.signupCodes {
+		if stored.Code == code && stored.usableBy(r.Email, r.At) {
+			stored.Uses = stored.uses() + 1
+			stored.Used = r.At
+			stored.Redemptions = append(stored.Redemptions, r)
+			clone(stored, sc)
+			return sc, nil
+		}
+	}
+	return sc, NotFoundError
+}
+
+func (m memSignupCodes) Release(id bson.ObjectId, r Redemption) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored, ok := m.s.signupCodes[id]
+	if !ok {
+		return NotFoundError
+	}
+	stored.Uses--
+	// Stored times are rounded to the millisecond, as in BSON.
+	at := r.At.Truncate(time.Millisecond)
+	for i, red := range stored.Redemptions {
+		if red.Username == r.Username && red.At.Equal(at) {
+			stored.Redemptions = append(stored.Redemptions[:i], stored.Redemptions[i+1:]...)
+			break
+		}
+	}
+	stored.Used = time.Time{}
+	return nil
+}
+
+func (m memSignupCodes) Revoke(id bson.ObjectId, at time.Time) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored, ok := m.s.signupCodes[id]
+	if !ok {
+		return NotFoundError
+	}
+	stored.Revoked = at
+	return nil
+}
+
+type memSubscribers struct{ s *MemoryStore }
+
+func (m memSubscribers) Add(email string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	m.s.subscribers = append(m.s.subscribers, email)
+	return nil
+}
+
+type memFiles struct{ s *MemoryStore }
+
+func (m memFiles) FindByOwner(owner bson.ObjectId) ([]File, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	files := []File{}
+	for _, stored := range m.s.files {
+		if stored.Owner == owner {
+			var f File
+			clone(stored, &f)
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+func (m memFiles) FindByID(owner, id bson.ObjectId) (*File, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	f := new(File)
+	stored, ok := m.s.files[id]
+	if !ok || stored.Owner != owner {
+		return f, NotFoundError
+	}
+	clone(stored, f)
+	return f, nil
+}
+
+func (m memFiles) Insert(f *File) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if _, ok := m.s.files[f.ID]; ok {
+		return DuplicateKeyError
+	}
+	stored := new(File)
+	clone(f, stored)
+	m.s.files[f.ID] = stored
+	return nil
+}
+
+func (m memFiles) Remove(owner, id bson.ObjectId) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored, ok := m.s.files[id]
+	if !ok || stored.Owner != owner {
+		return NotFoundError
+	}
+	delete(m.s.files, id)
+	return nil
+}
+
+// memLoginAttempts keeps every attempt: retention is only applied by queries.
+type memLoginAttempts struct{ s *MemoryStore }
+
+func (m memLoginAttempts) Insert(a *LoginAttempt) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if a.ID == "" {
+		a.ID = bson.NewObjectId()
+	}
+	var stored LoginAttempt
+	clone(a, &stored)
+	m.s.attempts = append(m.s.attempts, stored)
+	return nil
+}
+
+func (m memLoginAttempts) find(match func(a *LoginAttempt) bool, since time.Time, limit int) []LoginAttempt {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	attempts := []LoginAttempt{}
+	for i := len(m.s.attempts) - 1; i >= 0 && len(attempts) < limit; i-- {
+		a := m.s.attempts[i]
+		if match(&a) && !a.Date.Before(since) {
+			attempts = append(attempts, a)
+		}
+	}
+	return attempts
+}
+
+func (m memLoginAttempts) FindByUser(user bson.ObjectId, since time.Time, limit int) ([]LoginAttempt, error) {
+	return m.find(func(a *LoginAttempt) bool { return a.UserID == user }, since, limit), nil
+}
+
+func (m memLoginAttempts) FindByIp(ip string, since time.Time, limit int) ([]LoginAttempt, error) {
+	return m.find(func(a *LoginAttempt) bool { return a.Ip == ip }, since, limit), nil
+}
+
+type memSessions struct{ s *MemoryStore }
+
+func (m memSessions) Insert(sess *Session) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if _, ok := m.s.sessions[sess.ID]; ok {
+		return DuplicateKeyError
+	}
+	stored := new(Session)
+	clone(sess, stored)
+	m.s.sessions[sess.ID] = stored
+	return nil
+}
+
+func (m memSessions) findOne(match func(s *Session) bool) (*Session, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	sess := new(Session)
+	for _, stored := range m.s.sessions {
+		if match(stored) {
+			clone(stored, sess)
+			return sess, nil
+		}
+	}
+	return sess, NotFoundError
+}
+
+func (m memSessions) FindByHash(hash []byte) (*Session, error) {
+	return m.findOne(func(s *Session) bool { return bytes.Equal(s.TokenHash, hash) })
+}
+
+func (m memSessions) FindByPreviousHash(hash []byte) (*Session, error) {
+	return m.findOne(func(s *Session) bool {
+		for _, previous := range s.PreviousHashes {
+			if bytes.Equal(previous, hash) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (m memSessions) Rotate(id bson.ObjectId, oldHash, newHash []byte, at, expires time.Time) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored, ok := m.s.sessions[id]
+	if !ok || !bytes.Equal(stored.TokenHash, oldHash) {
+		return NotFoundError
+	}
+	stored.PreviousHashes = append(stored.PreviousHashes, oldHash)
+	stored.TokenHash = newHash
+	stored.LastUsed = at
+	stored.ExpiresAt = expires
+	return nil
+}
+
+func (m memSessions) FindByUser(user bson.ObjectId, at time.Time) ([]Session, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	sessions := []Session{}
+	for _, stored := range m.s.sessions {
+		if stored.User == user && stored.ExpiresAt.After(at) {
+			var sess Session
+			clone(stored, &sess)
+			sessions = append(sessions, sess)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastUsed.After(sessions[j].LastUsed) })
+	return sessions, nil
+}
+
+func (m memSessions) Remove(user, id bson.ObjectId) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored, ok := m.s.sessions[id]
+	if !ok || stored.User != user {
+		return NotFoundError
+	}
+	delete(m.s.sessions, id)
+	return nil
+}
+
+func (m memSessions) RemoveAll(user bson.ObjectId) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for id, stored := range m.s.sessions {
+		if stored.User == user {
+			delete(m.s.sessions, id)
+		}
+	}
+	return nil
+}
+
+type memPasswordResets struct{ s *MemoryStore }
+
+func (m memPasswordResets) Insert(r *PasswordReset) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if _, ok := m.s.resets[r.ID]; ok {
+		return DuplicateKeyError
+	}
+	stored := new(PasswordReset)
+	clone(r, stored)
+	m.s.resets[r.ID] = stored
+	return nil
+}
+
+func (m memPasswordResets) FindByHash(hash []byte) (*PasswordReset, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	r := new(PasswordReset)
+	for _, stored := range m.s.resets {
+		if bytes.Equal(stored.TokenHash, hash) {
+			clone(stored, r)
+			return r, nil
+		}
+	}
+	return r, NotFoundError
+}
+
+func (m memPasswordResets) Consume(hash []byte, at time.Time) (*PasswordReset, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	r := new(PasswordReset)
+	for _, stored := range m.s.resets {
+		if bytes.Equal(stored.TokenHash, hash) && stored.Used.IsZero() && stored.ExpiresAt.After(at) {
+			stored.Used = at
+			clone(stored, r)
+			return r, nil
+		}
+	}
+	return r, NotFoundError
+}
+
+func (m memPasswordResets) RemoveAll(user bson.ObjectId) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for id, stored := range m.s.resets {
+		if stored.User == user {
+			delete(m.s.resets, id)
+		}
+	}
+	return nil
+}
+
+type memAPIKeys struct{ s *MemoryStore }
+
+func (m memAPIKeys) Insert(k *APIKey) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for id, stored := range m.s.apiKeys {
+		if id == k.ID || bytes.Equal(stored.Hash, k.Hash) {
+			return DuplicateKeyError
+		}
+	}
+	stored := new(APIKey)
+	clone(k, stored)
+	m.s.apiKeys[k.ID] = stored
+	return nil
+}
+
+func (m memAPIKeys) FindByHash(hash []byte) (*APIKey, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	k := new(APIKey)
+	for _, stored := range m.s.apiKeys {
+		if bytes.Equal(stored.Hash, hash) {
+			clone(stored, k)
+			return k, nil
+		}
+	}
+	return k, NotFoundError
+}
+
+func (m memAPIKeys) FindByUser(user bson.ObjectId) ([]APIKey, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	keys := []APIKey{}
+	for _, stored := range m.s.apiKeys {
+		if stored.User == user {
+			var k APIKey
+			clone(stored, &k)
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created.After(keys[j].Created) })
+	return keys, nil
+}
+
+func (m memAPIKeys) Touch(id bson.ObjectId, at time.Time) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored, ok := m.s.apiKeys[id]
+	if !ok {
+		return NotFoundError
+	}
+	stored.LastUsed = at
+	return nil
+}
+
+func (m memAPIKeys) Remove(user, id bson.ObjectId) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored, ok := m.s.apiKeys[id]
+	if !ok || stored.User != user {
+		return NotFoundError
+	}
+	delete(m.s.apiKeys, id)
+	return nil
+}
+
+type memWaitlist struct{ s *MemoryStore }
+
+func (m memWaitlist) Insert(e *WaitlistEntry) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for _, stored := range m.s.waitlist {
+		if stored.ID == e.ID || stored.Email == e.Email {
+			return DuplicateKeyError
+		}
+	}
+	stored := new(WaitlistEntry)
+	clone(e, stored)
+	m.s.waitlist[e.ID] = stored
+	return nil
+}
+
+func (m memWaitlist) find(match func(e *WaitlistEntry) bool) (*WaitlistEntry, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	e := new(WaitlistEntry)
+	for _, stored := range m.s.waitlist {
+		if match(stored) {
+			clone(stored, e)
+			return e, nil
+		}
+	}
+	return e, NotFoundError
+}
+
+func (m memWaitlist) FindByEmail(email string) (*WaitlistEntry, error) {
+	return m.find(func(e *WaitlistEntry) bool { return e.Email == email })
+}
+
+func (m memWaitlist) FindByHash(hash []byte) (*WaitlistEntry, error) {
+	return m.find(func(e *WaitlistEntry) bool { return e.TokenHash != nil && bytes.Equal(e.TokenHash, hash) })
+}
+
+func (m memWaitlist) Update(e *WaitlistEntry) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if _, ok := m.s.waitlist[e.ID]; !ok {
+		return NotFoundError
+	}
+	stored := new(WaitlistEntry)
+	clone(e, stored)
+	m.s.waitlist[e.ID] = stored
+	return nil
+}
+
+func (m memWaitlist) UpdateFields(e *WaitlistEntry, fields ...string) error {
+	return m.updateFields(e, nil, fields)
+}
+
+func (m memWaitlist) UpdateFieldsWithMail(e *WaitlistEntry, msg *OutboxMessage, fields ...string) error {
+	return m.updateFields(e, msg, fields)
+}
+
+func (m memWaitlist) updateFields(e *WaitlistEntry, msg *OutboxMessage, fields []string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored, ok := m.s.waitlist[e.ID]
+	if !ok {
+		return NotFoundError
+	}
+	updated := new(WaitlistEntry)
+	mergeFields(stored, e, fields, msg, updated)
+	m.s.waitlist[e.ID] = updated
+	return nil
+}
+
+func (m memWaitlist) List() ([]WaitlistEntry, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	entries := []WaitlistEntry{}
+	for _, stored := range m.s.waitlist {
+		var e WaitlistEntry
+		clone(stored, &e)
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Joined.Equal(entries[j].Joined) {
+			return entries[i].Joined.Before(entries[j].Joined)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+func (m memWaitlist) MarkInvited(id, code bson.ObjectId, at time.Time, invitation *OutboxMessage) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored, ok := m.s.waitlist[id]
+	if !ok || !stored.Invited.IsZero() {
+		return NotFoundError
+	}
+	stored.Invited = at
+	stored.Code = code
+	if invitation != nil {
+		var pending OutboxMessage
+		clone(invitation, &pending)
+		stored.PendingMail = append(stored.PendingMail, pending)
+	}
+	return nil
+}
+
+type memOutbox struct{ s *MemoryStore }
+
+func (m memOutbox) Insert(msg *OutboxMessage) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if _, ok := m.s.outbox[msg.ID]; ok {
+		return DuplicateKeyError
+	}
+	stored := new(OutboxMessage)
+	clone(msg, stored)
+	m.s.outbox[msg.ID] = stored
+	return nil
+}
+
+func (m memOutbox) ClaimDue(at, lease time.Time) (*OutboxMessage, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	var due *OutboxMessage
+	for _, stored := range m.s.outbox {
+		if (stored.Status == OutboxPending || stored.Status == OutboxSending) && !stored.NextAttempt.After(at) &&
+			(due == nil || stored.NextAttempt.Before(due.NextAttempt) ||
+				stored.NextAttempt.Equal(due.NextAttempt) && stored.ID < due.ID) {
+			due = stored
+		}
+	}
+	msg := new(OutboxMessage)
+	if due == nil {
+		return msg, NotFoundError
+	}
+	due.Status = OutboxSending
+	due.NextAttempt = lease
+	clone(due, msg)
+	return msg, nil
+}
+
+func (m memOutbox) Update(msg *OutboxMessage) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if _, ok := m.s.outbox[msg.ID]; !ok {
+		return NotFoundError
+	}
+	stored := new(OutboxMessage)
+	clone(msg, stored)
+	m.s.outbox[msg.ID] = stored
+	return nil
+}
+
+func (m memOutbox) FindByProviderID(id string) (*OutboxMessage, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	msg := new(OutboxMessage)
+	for _, stored := range m.s.outbox {
+		if stored.ProviderID == id {
+			clone(stored, msg)
+			return msg, nil
+		}
+	}
+	return msg, NotFoundError
+}
+
+func (m memOutbox) List(status string, limit int) ([]OutboxMessage, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	messages := []OutboxMessage{}
+	for _, stored := range m.s.outbox {
+		if status == "" || stored.Status == status {
+			var msg OutboxMessage
+			clone(stored, &msg)
+			messages = append(messages, msg)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID > messages[j].ID })
+	if limit > 0 && len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+func (m memOutbox) Requeue(id bson.ObjectId, at time.Time) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored, ok := m.s.outbox[id]
+	if !ok || stored.Status != OutboxDead && stored.Status != OutboxSent && stored.Status != OutboxSuppressed {
+		return NotFoundError
+	}
+	stored.Status = OutboxPending
+	stored.Attempts = 0
+	stored.NextAttempt = at
+	stored.LastError = ""
+	return nil
+}
+
+type memMailEvents struct{ s *MemoryStore }
+
+func (m memMailEvents) Insert(e *MailEvent) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if _, ok := m.s.mailEvents[e.ID]; ok {
+		return DuplicateKeyError
+	}
+	stored := new(MailEvent)
+	clone(e, stored)
+	m.s.mailEvents[e.ID] = stored
+	return nil
+}
+
+func (m memMailEvents) FindByMessage(id bson.ObjectId) ([]MailEvent, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	events := []MailEvent{}
+	for _, stored := range m.s.mailEvents {
+		if stored.Message == id {
+			var e MailEvent
+			clone(stored, &e)
+			events = append(events, e)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].At.Equal(events[j].At) {
+			return events[i].ID < events[j].ID
+		}
+		return events[i].At.Before(events[j].At)
+	})
+	return events, nil
+}
+
+type memSuppressions struct{ s *MemoryStore }
+
+func (m memSuppressions) Add(s *Suppression) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	stored := new(Suppression)
+	clone(s, stored)
+	m.s.suppressed[s.Email] = stored
+	return nil
+}
+
+func (m memSuppressions) Find(email string) (*Suppression, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	s := new(Suppression)
+	stored, ok := m.s.suppressed[email]
+	if !ok {
+		return s, NotFoundError
+	}
+	clone(stored, s)
+	return s, nil
+}
+
+func (m memSuppressions) Remove(email string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if _, ok := m.s.suppressed[email]; !ok {
+		return NotFoundError
+	}
+	delete(m.s.suppressed, email)
+	return nil
+}
+
+func (m memSuppressions) List() ([]Suppression, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	list := []Suppression{}
+	for _, stored := range m.s.suppressed {
+		var s Suppression
+		clone(stored, &s)
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Email < list[j].Email })
+	return list, nil
+}
+
+type memPendingMail struct{ s *MemoryStore }
+
+// Returns the pending mail of the document of the given kind, for
+// Remove to replace.
+func (s *MemoryStore) pendingMail(kind string, owner bson.ObjectId) (*[]OutboxMessage, bool) {
+	switch kind {
+	case pendingOnUser:
+		if u, ok := s.users[owner]; ok {
+			return &u.PendingMail, true
+		}
+	case pendingOnPasswordReset:
+		if r, ok := s.resets[owner]; ok {
+			return &r.PendingMail, true
+		}
+	case pendingOnSignupCode:
+		if sc, ok := s.signupCodes[owner]; ok {
+			return &sc.PendingMail, true
+		}
+	case pendingOnWaitlist:
+		if e, ok := s.waitlist[owner]; ok {
+			return &e.PendingMail, true
+		}
+	}
+	return nil, false
+}
+
+func (m memPendingMail) Find(limit int) ([]PendingMail, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	list := []PendingMail{}
+	add := func(kind string, owner bson.ObjectId, pending []OutboxMessage) {
+		for _, msg := range pending {
+			p := PendingMail{Kind: kind, Owner: owner}
+			clone(&msg, &p.Message)
+			list = append(list, p)
+		}
+	}
+	for id, u := range m.s.users {
+		add(pendingOnUser, id, u.PendingMail)
+	}
+	for id, r := range m.s.resets {
+		add(pendingOnPasswordReset, id, r.PendingMail)
+	}
+	for id, sc := range m.s.signupCodes {
+		add(pendingOnSignupCode, id, sc.PendingMail)
+	}
+	for id, e := range m.s.waitlist {
+		add(pendingOnWaitlist, id, e.PendingMail)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Message.ID < list[j].Message.ID })
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+func (m memPendingMail) Remove(p *PendingMail) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	pending, ok := m.s.pendingMail(p.Kind, p.Owner)
+	if !ok {
+		return NotFoundError
+	}
+	kept := []OutboxMessage{}
+	for _, msg := range *pending {
+		if msg.ID != p.Message.ID {
+			kept = append(kept, msg)
+		}
+	}
+	*pending = kept
+	return nil
+}
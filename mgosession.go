@@ -1,67 +1,1086 @@
 package core
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 const (
-	UsersCollection       = "users"
-	DocumentsCollection   = "docs"
-	SignupCodesCollection = "signupcodes"
-	FilesCollection       = "files"
+	UsersCollection          = "users"
+	DocumentsCollection      = "docs"
+	SignupCodesCollection    = "signupcodes"
+	FilesCollection          = "files"
+	LoginAttemptsCollection  = "loginattempts"
+	SessionsCollection       = "sessions"
+	PasswordResetsCollection = "passwordresets"
+	APIKeysCollection        = "apikeys"
+	WaitlistCollection       = "waitlist"
+	OutboxCollection         = "outbox"
+	MailEventCollection      = "mail_events"
+	SuppressionCollection    = "suppressions"
 )
 
-var mgoSession *mgo.Session
+// MgoStore is the MongoDB implementation of Store.
+type MgoStore struct {
+	mu      sync.Mutex
+	info    *mgo.DialInfo
+	session *mgo.Session
+	cfg     Config
+}
 
-// Gets a new session clone.
-func getSession() *mgo.Session {
-	return mgoSession.Copy()
+// NewMgoStore returns a Store backed by the database and collections
+// named in cfg. Every operation runs on a copy of session.
+func NewMgoStore(session *mgo.Session, cfg Config) *MgoStore {
+	return &MgoStore{session: session, cfg: cfg}
 }
 
-func init() {
-	var err error
+// DialMgoStore returns a Store backed by the database and collections
+// named in cfg, which dials MongoDB on first use. A failed dial is reported
+// by the operation that triggered it and retried by the next one.
+func DialMgoStore(cfg Config) *MgoStore {
+	info := &mgo.DialInfo{
+		Addrs:    strings.Split(cfg.MongoDBHosts, ","),
+		Timeout:  cfg.DialTimeout,
+		Database: cfg.authDatabase(),
+		Username: cfg.AuthUserName,
+		Password: cfg.AuthPassword,
+	}
+	return &MgoStore{info: info, cfg: cfg}
+}
 
-	mongoDBDialInfo := &mgo.DialInfo{
-		Addrs:    []string{gqConfig.mongoDBHosts},
-		Timeout:  60 * time.Second,
-		Database: gqConfig.authDatabase,
-		Username: gqConfig.authUserName,
-		Password: gqConfig.authPassword,
+// Returns a copy of the main session, dialing it if needed.
+func (s *MgoStore) copySession() (*mgo.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.session == nil {
+		session, err := mgo.DialWithInfo(s.info)
+		if err != nil {
+			return nil, err
+		}
+		session.SetMode(mgo.Monotonic, true)
+		s.session = session
 	}
+	return s.session.Copy(), nil
+}
 
-	mgoSession, err = mgo.DialWithInfo(mongoDBDialInfo)
+// Runs f against a fresh session copy of the named collection.
+func (s *MgoStore) with(collection string, f func(c *mgo.Collection) error) error {
+	locSession, err := s.copySession()
 	if err != nil {
-		log.Fatal("Error connecting to MongoDB:", err)
+		return err
 	}
+	defer locSession.Close()
+	return mgoError(f(locSession.DB(s.cfg.JobDatabase).C(collection)))
+}
+
+// mgoCollection binds a collection name to its store.
+type mgoCollection struct {
+	s    *MgoStore
+	name string
+}
 
-	mgoSession.SetMode(mgo.Monotonic, true)
+func (m mgoCollection) with(f func(c *mgo.Collection) error) error {
+	return m.s.with(m.name, f)
+}
 
-	usernameIndex := mgo.Index{
-		Key:    []string{"username"},
-		Unique: true,
+// Translates mgo errors into the package's store errors.
+func mgoError(err error) error {
+	if err == mgo.ErrNotFound {
+		return NotFoundError
 	}
-	tagsIndex := mgo.Index{
-		Key:    []string{"owner", "tags"},
-		Unique: false,
-		Sparse: false,
+	if mgo.IsDup(err) {
+		return DuplicateKeyError
 	}
-	signupCodesIndex := mgo.Index{
-		Key:    []string{"code"},
-		Unique: false,
+	return err
+}
+
+func (s *MgoStore) Users() UserStore {
+	return mgoUsers{mgoCollection{s, s.cfg.UsersCollection}}
+}
+
+func (s *MgoStore) Documents() DocumentStore {
+	return mgoDocuments{mgoCollection{s, s.cfg.DocumentsCollection}}
+}
+
+func (s *MgoStore) SignupCodes() SignupCodeStore {
+	return mgoSignupCodes{mgoCollection{s, s.cfg.SignupCodesCollection}}
+}
+
+func (s *MgoStore) Subscribers() SubscriberStore {
+	return mgoSubscribers{mgoCollection{s, s.cfg.SubscribersCollection}}
+}
+
+func (s *MgoStore) Files() FileStore {
+	return mgoFiles{mgoCollection{s, s.cfg.FilesCollection}}
+}
+
+func (s *MgoStore) LoginAttempts() LoginAttemptStore {
+	return mgoLoginAttempts{mgoCollection{s, s.cfg.LoginAttemptsCollection}}
+}
+
+func (s *MgoStore) Sessions() SessionStore {
+	return mgoSessions{mgoCollection{s, s.cfg.SessionsCollection}}
+}
+
+func (s *MgoStore) PasswordResets() PasswordResetStore {
+	return mgoPasswordResets{mgoCollection{s, s.cfg.PasswordResetsCollection}}
+}
+
+func (s *MgoStore) APIKeys() APIKeyStore {
+	return mgoAPIKeys{mgoCollection{s, s.cfg.APIKeysCollection}}
+}
+
+func (s *MgoStore) Waitlist() WaitlistStore {
+	return mgoWaitlist{mgoCollection{s, s.cfg.WaitlistCollection}}
+}
+
+func (s *MgoStore) Outbox() OutboxStore {
+	return mgoOutbox{mgoCollection{s, s.cfg.OutboxCollection}}
+}
+
+func (s *MgoStore) MailEvents() MailEventStore {
+	return mgoMailEvents{mgoCollection{s, s.cfg.MailEventCollection}}
+}
+
+func (s *MgoStore) Suppressions() SuppressionStore {
+	return mgoSuppressions{mgoCollection{s, s.cfg.SuppressionCollection}}
+}
+
+func (s *MgoStore) PendingMail() PendingMailStore {
+	return mgoPendingMail{s}
+}
+
+// EnsureSchema creates the indexes used by the package.
+// If ctx has a deadline, it bounds the dial.
+func (s *MgoStore) EnsureSchema(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	err = mgoSession.DB(gqConfig.jobDatabase).C(UsersCollection).EnsureIndex(usernameIndex)
-	if err != nil {
-		log.Fatal("Error creating users index:", err)
+	if deadline, ok := ctx.Deadline(); ok && s.info != nil {
+		s.mu.Lock()
+		if s.session == nil {
+			info := *s.info
+			info.Timeout = time.Until(deadline)
+			s.info = &info
+		}
+		s.mu.Unlock()
 	}
-	err = mgoSession.DB(gqConfig.jobDatabase).C(DocumentsCollection).EnsureIndex(tagsIndex)
+	indexes := []struct {
+		collection string
+		index      mgo.Index
+	}{
+		{s.cfg.UsersCollection, mgo.Index{Key: []string{"username"}, Unique: true}},
+		{s.cfg.DocumentsCollection, mgo.Index{Key: []string{"user", "tag"}}},
+		{s.cfg.SignupCodesCollection, mgo.Index{Key: []string{"code"}, Unique: true}},
+		{s.cfg.SignupCodesCollection, mgo.Index{Key: []string{"label"}, Sparse: true}},
+		{s.cfg.SignupCodesCollection, mgo.Index{Key: []string{"creator"}, Sparse: true}},
+		{s.cfg.LoginAttemptsCollection, mgo.Index{Key: []string{"user", "-date"}}},
+		{s.cfg.LoginAttemptsCollection, mgo.Index{Key: []string{"ip", "-date"}}},
+		{s.cfg.LoginAttemptsCollection, mgo.Index{Key: []string{"date"}, ExpireAfter: s.cfg.LoginAttemptRetention}},
+		{s.cfg.SessionsCollection, mgo.Index{Key: []string{"hash"}, Unique: true}},
+		{s.cfg.SessionsCollection, mgo.Index{Key: []string{"previous"}}},
+		{s.cfg.SessionsCollection, mgo.Index{Key: []string{"user"}}},
+		{s.cfg.SessionsCollection, mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second}},
+		{s.cfg.UsersCollection, mgo.Index{Key: []string{"email"}}},
+		{s.cfg.UsersCollection, mgo.Index{Key: []string{"confirm_code"}}},
+		{s.cfg.UsersCollection, mgo.Index{Key: []string{"google_oauth_sub"}, Sparse: true}},
+		{s.cfg.UsersCollection, mgo.Index{Key: []string{"identities.key"}, Unique: true, Sparse: true}},
+		{s.cfg.PasswordResetsCollection, mgo.Index{Key: []string{"hash"}, Unique: true}},
+		{s.cfg.PasswordResetsCollection, mgo.Index{Key: []string{"user"}}},
+		{s.cfg.PasswordResetsCollection, mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second}},
+		{s.cfg.APIKeysCollection, mgo.Index{Key: []string{"hash"}, Unique: true}},
+		{s.cfg.APIKeysCollection, mgo.Index{Key: []string{"user"}}},
+		{s.cfg.WaitlistCollection, mgo.Index{Key: []string{"email"}, Unique: true}},
+		{s.cfg.WaitlistCollection, mgo.Index{Key: []string{"hash"}, Sparse: true}},
+		{s.cfg.WaitlistCollection, mgo.Index{Key: []string{"joined"}}},
+		{s.cfg.OutboxCollection, mgo.Index{Key: []string{"status", "next_attempt"}}},
+		{s.cfg.OutboxCollection, mgo.Index{Key: []string{"provider_id"}, Sparse: true}},
+		{s.cfg.MailEventCollection, mgo.Index{Key: []string{"message", "at"}}},
+		{s.cfg.UsersCollection, mgo.Index{Key: []string{"pending_mail._id"}, Sparse: true}},
+		{s.cfg.PasswordResetsCollection, mgo.Index{Key: []string{"pending_mail._id"}, Sparse: true}},
+		{s.cfg.SignupCodesCollection, mgo.Index{Key: []string{"pending_mail._id"}, Sparse: true}},
+		{s.cfg.WaitlistCollection, mgo.Index{Key: []string{"pending_mail._id"}, Sparse: true}},
+	}
+	if err := s.migrateIdentityKeys(); err != nil {
+		return fmt.Errorf("Error migrating identities: %v", err)
+	}
+	if err := s.migrateSignupCodeIndex(); err != nil {
+		return fmt.Errorf("Error migrating the signup codes index: %v", err)
+	}
+	for _, idx := range indexes {
+		err := s.with(idx.collection, func(c *mgo.Collection) error {
+			return c.EnsureIndex(idx.index)
+		})
+		if err != nil {
+			return fmt.Errorf("Error creating %s index: %v", idx.collection, err)
+		}
+	}
+	return nil
+}
+
+// Drops the index of the collection with the given name, if it exists and
+// drop approves it.
+func (s *MgoStore) dropIndex(collection, name string, drop func(mgo.Index) bool) error {
+	return s.with(collection, func(c *mgo.Collection) error {
+		indexes, err := c.Indexes()
+		if err != nil {
+			return err
+		}
+		for _, idx := range indexes {
+			if idx.Name == name && drop(idx) {
+				return c.DropIndexName(name)
+			}
+		}
+		return nil
+	})
+}
+
+// Replaces the compound index on the identities, which as a multikey index
+// spans every pair of providers and subjects of a user, with the unique
+// index on their keys, after setting the keys of identities that lack one.
+func (s *MgoStore) migrateIdentityKeys() error {
+	err := s.dropIndex(s.cfg.UsersCollection, "identities.provider_1_identities.subject_1", func(mgo.Index) bool { return true })
 	if err != nil {
-		log.Fatal("Error creating documents index:", err)
+		return err
+	}
+	return s.with(s.cfg.UsersCollection, func(c *mgo.Collection) error {
+		missing := bson.M{"key": bson.M{"$exists": false}}
+		iter := c.Find(bson.M{"identities": bson.M{"$elemMatch": missing}}).Select(bson.M{"identities": 1}).Iter()
+		var u User
+		for iter.Next(&u) {
+			for _, id := range u.Identities {
+				if id.Key != "" {
+					continue
+				}
+				// Identities unlinked since they were read are skipped.
+				match := bson.M{"provider": id.Provider, "subject": id.Subject, "key": missing["key"]}
+				err := c.Update(
+					bson.M{"_id": u.ID, "identities": bson.M{"$elemMatch": match}},
+					bson.M{"$set": bson.M{"identities.$.key": identityKey(id.Provider, id.Subject)}},
+				)
+				if err != nil && err != mgo.ErrNotFound {
+					iter.Close()
+					return err
+				}
+			}
+			u = User{}
+		}
+		return iter.Close()
+	})
+}
+
+// Databases set up before codes had to be unique have a plain index on
+// them, which can't be made unique in place. Codes saved more than once
+// are removed but for the oldest, then the index is dropped for
+// EnsureSchema to create it again.
+func (s *MgoStore) migrateSignupCodeIndex() error {
+	legacy := false
+	err := s.with(s.cfg.SignupCodesCollection, func(c *mgo.Collection) error {
+		indexes, err := c.Indexes()
+		for _, idx := range indexes {
+			if idx.Name == "code_1" && !idx.Unique {
+				legacy = true
+			}
+		}
+		return err
+	})
+	if err != nil || !legacy {
+		return err
 	}
-	err = mgoSession.DB(gqConfig.jobDatabase).C(SignupCodesCollection).EnsureIndex(signupCodesIndex)
+	err = s.with(s.cfg.SignupCodesCollection, func(c *mgo.Collection) error {
+		var duplicates []struct {
+			Code string          `bson:"_id"`
+			IDs  []bson.ObjectId `bson:"ids"`
+		}
+		err := c.Pipe([]bson.M{
+			{"$sort": bson.M{"_id": 1}},
+			{"$group": bson.M{"_id": "$code", "ids": bson.M{"$push": "$_id"}, "count": bson.M{"$sum": 1}}},
+			{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+		}).AllowDiskUse().All(&duplicates)
+		if err != nil {
+			return err
+		}
+		for _, d := range duplicates {
+			log.Printf("Removing %d duplicates of signup code %s", len(d.IDs)-1, d.Code)
+			if _, err := c.RemoveAll(bson.M{"_id": bson.M{"$in": d.IDs[1:]}}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		log.Fatal("Error creating signup codes index:", err)
+		return err
+	}
+	return s.dropIndex(s.cfg.SignupCodesCollection, "code_1", func(idx mgo.Index) bool { return !idx.Unique })
+}
+
+// Close closes the main session, if it was dialed.
+func (s *MgoStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.session != nil {
+		s.session.Close()
+		s.session = nil
+	}
+	return nil
+}
+
+type mgoUsers struct{ mgoCollection }
+
+func (m mgoUsers) FindByID(id bson.ObjectId) (*User, error) {
+	u := new(User)
+	err := m.with(func(c *mgo.Collection) error {
+		return c.FindId(id).One(u)
+	})
+	return u, err
+}
+
+func (m mgoUsers) FindByUsername(username string) (*User, error) {
+	u := new(User)
+	err := m.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"username": username}).One(u)
+	})
+	return u, err
+}
+
+func (m mgoUsers) FindByEmail(email string) (*User, error) {
+	u := new(User)
+	err := m.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"email": email}).One(u)
+	})
+	return u, err
+}
+
+func (m mgoUsers) FindAllByEmailFold(email string) ([]User, error) {
+	users := []User{}
+	err := m.with(func(c *mgo.Collection) error {
+		pattern := bson.RegEx{Pattern: "^" + regexp.QuoteMeta(email) + "$", Options: "i"}
+		return c.Find(bson.M{"email": pattern}).All(&users)
+	})
+	return users, err
+}
+
+func (m mgoUsers) FindByVerificationCode(code string) (*User, error) {
+	u := new(User)
+	err := m.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"confirm_code": code}).One(u)
+	})
+	return u, err
+}
+
+func (m mgoUsers) FindByGoogleOAuthSub(sub string) (*User, error) {
+	u := new(User)
+	err := m.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"google_oauth_sub": sub}).One(u)
+	})
+	return u, err
+}
+
+func (m mgoUsers) FindByIdentity(provider, subject string) (*User, error) {
+	u := new(User)
+	err := m.with(func(c *mgo.Collection) error {
+		match := bson.M{"provider": provider, "subject": subject}
+		return c.Find(bson.M{"identities": bson.M{"$elemMatch": match}}).One(u)
+	})
+	return u, err
+}
+
+func (m mgoUsers) Insert(u *User) error {
+	if u.ID == "" {
+		u.ID = bson.NewObjectId()
+	}
+	return m.with(func(c *mgo.Collection) error {
+		return c.Insert(u)
+	})
+}
+
+func (m mgoUsers) Update(u *User) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.UpdateId(u.ID, u)
+	})
+}
+
+// Returns the update saving the given fields of the document, and adding
+// msg to its pending mail if not nil.
+func mgoFieldUpdate(v interface{}, fields []string, msg *OutboxMessage) bson.M {
+	set, unset := fieldUpdate(v, fields)
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if msg != nil {
+		update["$push"] = bson.M{"pending_mail": msg}
+	}
+	return update
+}
+
+func (m mgoUsers) UpdateFields(u *User, fields ...string) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.UpdateId(u.ID, mgoFieldUpdate(u, fields, nil))
+	})
+}
+
+func (m mgoUsers) UpdateFieldsWithMail(u *User, msg *OutboxMessage, fields ...string) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.UpdateId(u.ID, mgoFieldUpdate(u, fields, msg))
+	})
+}
+
+func (m mgoUsers) Remove(id bson.ObjectId) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.RemoveId(id)
+	})
+}
+
+func (m mgoUsers) RecordLogin(id bson.ObjectId, at time.Time) error {
+	return m.with(func(c *mgo.Collection) error {
+		update := bson.M{
+			"$set":   bson.M{"last_login": at, "fails": 0, "lockouts": 0},
+			"$unset": bson.M{"locked_until": ""},
+		}
+		return c.UpdateId(id, update)
+	})
+}
+
+func (m mgoUsers) IncFailedLogins(id bson.ObjectId) (int, error) {
+	var fails struct {
+		Count int `bson:"fails"`
+	}
+	err := m.with(func(c *mgo.Collection) error {
+		change := mgo.Change{Update: bson.M{"$inc": bson.M{"fails": 1}}, ReturnNew: true}
+		_, err := c.FindId(id).Select(bson.M{"fails": 1}).Apply(change, &fails)
+		return err
+	})
+	return fails.Count, err
+}
+
+func (m mgoUsers) Lock(id bson.ObjectId, until time.Time) error {
+	return m.with(func(c *mgo.Collection) error {
+		update := bson.M{
+			"$set": bson.M{"locked_until": until, "fails": 0},
+			"$inc": bson.M{"lockouts": 1},
+		}
+		return c.UpdateId(id, update)
+	})
+}
+
+func (m mgoUsers) Unlock(id bson.ObjectId) error {
+	return m.with(func(c *mgo.Collection) error {
+		update := bson.M{
+			"$set":   bson.M{"fails": 0, "lockouts": 0},
+			"$unset": bson.M{"locked_until": ""},
+		}
+		return c.UpdateId(id, update)
+	})
+}
+
+func (m mgoUsers) ReserveInvite(id bson.ObjectId, allowance int) error {
+	return m.with(func(c *mgo.Collection) error {
+		query := bson.M{"_id": id, "invites_used": bson.M{"$not": bson.M{"$gte": allowance}}}
+		return c.Update(query, bson.M{"$inc": bson.M{"invites_used": 1}})
+	})
+}
+
+func (m mgoUsers) ReleaseInvite(id bson.ObjectId) error {
+	return m.with(func(c *mgo.Collection) error {
+		err := c.Update(bson.M{"_id": id, "invites_used": bson.M{"$gt": 0}}, bson.M{"$inc": bson.M{"invites_used": -1}})
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+type mgoDocuments struct{ mgoCollection }
+
+func (m mgoDocuments) FindByOwner(owner bson.ObjectId) ([]Document, error) {
+	docs := []Document{}
+	err := m.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"user": owner}).All(&docs)
+	})
+	return docs, err
+}
+
+func (m mgoDocuments) FindByID(owner, id bson.ObjectId) (*Document, error) {
+	doc := new(Document)
+	err := m.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"user": owner, "_id": id}).One(doc)
+	})
+	return doc, err
+}
+
+func (m mgoDocuments) Insert(d *Document) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.Insert(d)
+	})
+}
+
+func (m mgoDocuments) Update(d *Document) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.Update(bson.M{"_id": d.ID, "user": d.Owner}, d)
+	})
+}
+
+func (m mgoDocuments) Remove(owner, id bson.ObjectId) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.Remove(bson.M{"_id": id, "user": owner})
+	})
+}
+
+func (m mgoDocuments) AddChild(owner, parent, child bson.ObjectId) error {
+	return m.with(func(c *mgo.Collection) error {
+		change := bson.M{
+			"$push": bson.M{"children": child},
+			"$set":  bson.M{"lastmod": time.Now()},
+		}
+		return c.Update(bson.M{"_id": parent, "user": owner}, change)
+	})
+}
+
+func (m mgoDocuments) ChangeOwner(id, from, to bson.ObjectId) error {
+	return m.with(func(c *mgo.Collection) error {
+		change := bson.M{"$set": bson.M{"user": to, "lastmod": time.Now()}}
+		return c.Update(bson.M{"_id": id, "user": from}, change)
+	})
+}
+
+func (m mgoDocuments) TransferAll(from, to bson.ObjectId) error {
+	return m.with(func(c *mgo.Collection) error {
+		_, err := c.UpdateAll(bson.M{"user": from}, bson.M{"$set": bson.M{"user": to}})
+		return err
+	})
+}
+
+type mgoSignupCodes struct{ mgoCollection }
+
+func (m mgoSignupCodes) Insert(sc *SignupCode) error {
+	if sc.ID == "" {
+		sc.ID = bson.NewObjectId()
+	}
+	return m.with(func(c *mgo.Collection) error {
+		return c.Insert(sc)
+	})
+}
+
+func (m mgoSignupCodes) FindByCode(code string) ([]SignupCode, error) {
+	codes := []SignupCode{}
+	err := m.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"code": code}).All(&codes)
+	})
+	return codes, err
+}
+
+func (m mgoSignupCodes) List(label string) ([]SignupCode, error) {
+	codes := []SignupCode{}
+	err := m.with(func(c *mgo.Collection) error {
+		query := bson.M{}
+		if label != "" {
+			query["label"] = label
+		}
+		return c.Find(query).Sort("-_id").All(&codes)
+	})
+	return codes, err
+}
+
+func (m mgoSignupCodes) FindByCreator(creator bson.ObjectId) ([]SignupCode, error) {
+	codes := []SignupCode{}
+	err := m.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"creator": creator}).Sort("-_id").All(&codes)
+	})
+	return codes, err
+}
+
+// How many times Claim looks for a usable code again after losing a race
+// on one, before giving up.
+const signupCodeClaimRetries = 10
+
+// Claim checks the codes' conditions here, then updates the chosen code
+// only if its use count hasn't changed meanwhile, retrying if it has.
+func (m mgoSignupCodes) Claim(code string, r Redemption) (*SignupCode, error) {
+	sc := new(SignupCode)
+	err := m.with(func(c *mgo.Collection) error {
+		for try := 0; try <= signupCodeClaimRetries; try++ {
+			var candidates []SignupCode
+			if err := c.Find(bson.M{"code": code}).All(&candidates); err != nil {
+				return err
+			}
+			raced := false
+			for _, candidate := range candidates {
+				if !candidate.usableBy(r.Email, r.At) {
+					continue
+				}
+				query := bson.M{"_id": candidate.ID, "uses": candidate.Uses}
+				if candidate.Uses == 0 {
+					// Codes saved before use counts existed have none.
+					query = bson.M{"_id": candidate.ID, "uses": bson.M{"$in": []interface{}{0, nil}}}
+					if candidate.Used.IsZero() {
+						query["used_at"] = bson.M{"$exists": false}
+					} else {
+						query["used_at"] = candidate.Used
+					}
+				}
+				change := mgo.Change{
+					Update: bson.M{
+						"$inc":  bson.M{"uses": 1},
+						"$set":  bson.M{"used_at": r.At},
+						"$push": bson.M{"redemptions": r},
+					},
+					ReturnNew: true,
+				}
+				_, err := c.Find(query).Apply(change, sc)
+				if err == mgo.ErrNotFound {
+					raced = true
+					continue
+				}
+				return err
+			}
+			if !raced {
+				return mgo.ErrNotFound
+			}
+		}
+		return mgo.ErrNotFound
+	})
+	return sc, err
+}
+
+func (m mgoSignupCodes) Release(id bson.ObjectId, r Redemption) error {
+	return m.with(func(c *mgo.Collection) error {
+		update := bson.M{
+			"$inc":   bson.M{"uses": -1},
+			"$pull":  bson.M{"redemptions": bson.M{"username": r.Username, "at": r.At}},
+			"$unset": bson.M{"used_at": ""},
+		}
+		return c.UpdateId(id, update)
+	})
+}
+
+func (m mgoSignupCodes) Revoke(id bson.ObjectId, at time.Time) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.UpdateId(id, bson.M{"$set": bson.M{"revoked": at}})
+	})
+}
+
+type mgoSubscribers struct{ mgoCollection }
+
+func (m mgoSubscribers) Add(email string) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.Insert(bson.M{"email": email})
+	})
+}
+
+type mgoFiles struct{ mgoCollection }
+
+func (m mgoFiles) FindByOwner(owner bson.ObjectId) ([]File, error) {
+	files := []File{}
+	err := m.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"user": owner}).All(&files)
+	})
+	return files, err
+}
+
+func (m mgoFiles) FindByID(owner, id bson.ObjectId) (*File, error) {
+	f := new(File)
+	err := m.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"user": owner, "_id": id}).One(f)
+	})
+	return f, err
+}
+
+func (m mgoFiles) Insert(f *File) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.Insert(f)
+	})
+}
+
+func (m mgoFiles) Remove(owner, id bson.ObjectId) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.Remove(bson.M{"_id": id, "user": owner})
+	})
+}
+
+type mgoLoginAttempts struct{ mgoCollection }
+
+func (m mgoLoginAttempts) Insert(a *LoginAttempt) error {
+	if a.ID == "" {
+		a.ID = bson.NewObjectId()
+	}
+	return m.with(func(c *mgo.Collection) error {
+		return c.Insert(a)
+	})
+}
+
+func (m mgoLoginAttempts) find(query bson.M, since time.Time, limit int) ([]LoginAttempt, error) {
+	attempts := []LoginAttempt{}
+	query["date"] = bson.M{"$gte": since}
+	err := m.with(func(c *mgo.Collection) error {
+		return c.Find(query).Sort("-date").Limit(limit).All(&attempts)
+	})
+	return attempts, err
+}
+
+func (m mgoLoginAttempts) FindByUser(user bson.ObjectId, since time.Time, limit int) ([]LoginAttempt, error) {
+	return m.find(bson.M{"user": user}, since, limit)
+}
+
+func (m mgoLoginAttempts) FindByIp(ip string, since time.Time, limit int) ([]LoginAttempt, error) {
+	return m.find(bson.M{"ip": ip}, since, limit)
+}
+
+type mgoSessions struct{ mgoCollection }
+
+func (m mgoSessions) Insert(sess *Session) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.Insert(sess)
+	})
+}
+
+func (m mgoSessions) findOne(query bson.M) (*Session, error) {
+	sess := new(Session)
+	err := m.with(func(c *mgo.Collection) error {
+		return c.Find(query).One(sess)
+	})
+	return sess, err
+}
+
+func (m mgoSessions) FindByHash(hash []byte) (*Session, error) {
+	return m.findOne(bson.M{"hash": hash})
+}
+
+func (m mgoSessions) FindByPreviousHash(hash []byte) (*Session, error) {
+	return m.findOne(bson.M{"previous": hash})
+}
+
+func (m mgoSessions) Rotate(id bson.ObjectId, oldHash, newHash []byte, at, expires time.Time) error {
+	return m.with(func(c *mgo.Collection) error {
+		update := bson.M{
+			"$set":  bson.M{"hash": newHash, "last_used": at, "expires": expires},
+			"$push": bson.M{"previous": oldHash},
+		}
+		return c.Update(bson.M{"_id": id, "hash": oldHash}, update)
+	})
+}
+
+func (m mgoSessions) FindByUser(user bson.ObjectId, at time.Time) ([]Session, error) {
+	sessions := []Session{}
+	err := m.with(func(c *mgo.Collection) error {
+		query := bson.M{"user": user, "expires": bson.M{"$gt": at}}
+		return c.Find(query).Sort("-last_used").All(&sessions)
+	})
+	return sessions, err
+}
+
+func (m mgoSessions) Remove(user, id bson.ObjectId) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.Remove(bson.M{"_id": id, "user": user})
+	})
+}
+
+func (m mgoSessions) RemoveAll(user bson.ObjectId) error {
+	return m.with(func(c *mgo.Collection) error {
+		_, err := c.RemoveAll(bson.M{"user": user})
+		return err
+	})
+}
+
+type mgoPasswordResets struct{ mgoCollection }
+
+func (m mgoPasswordResets) Insert(r *PasswordReset) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.Insert(r)
+	})
+}
+
+func (m mgoPasswordResets) FindByHash(hash []byte) (*PasswordReset, error) {
+	r := new(PasswordReset)
+	err := m.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"hash": hash}).One(r)
+	})
+	return r, err
+}
+
+func (m mgoPasswordResets) Consume(hash []byte, at time.Time) (*PasswordReset, error) {
+	r := new(PasswordReset)
+	err := m.with(func(c *mgo.Collection) error {
+		query := bson.M{"hash": hash, "used_at": bson.M{"$exists": false}, "expires": bson.M{"$gt": at}}
+		change := mgo.Change{Update: bson.M{"$set": bson.M{"used_at": at}}, ReturnNew: true}
+		_, err := c.Find(query).Apply(change, r)
+		return err
+	})
+	return r, err
+}
+
+func (m mgoPasswordResets) RemoveAll(user bson.ObjectId) error {
+	return m.with(func(c *mgo.Collection) error {
+		_, err := c.RemoveAll(bson.M{"user": user})
+		return err
+	})
+}
+
+type mgoAPIKeys struct{ mgoCollection }
+
+func (m mgoAPIKeys) Insert(k *APIKey) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.Insert(k)
+	})
+}
+
+func (m mgoAPIKeys) FindByHash(hash []byte) (*APIKey, error) {
+	k := new(APIKey)
+	err := m.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"hash": hash}).One(k)
+	})
+	return k, err
+}
+
+func (m mgoAPIKeys) FindByUser(user bson.ObjectId) ([]APIKey, error) {
+	keys := []APIKey{}
+	err := m.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"user": user}).Sort("-created").All(&keys)
+	})
+	return keys, err
+}
+
+func (m mgoAPIKeys) Touch(id bson.ObjectId, at time.Time) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.UpdateId(id, bson.M{"$set": bson.M{"last_used": at}})
+	})
+}
+
+func (m mgoAPIKeys) Remove(user, id bson.ObjectId) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.Remove(bson.M{"_id": id, "user": user})
+	})
+}
+
+type mgoWaitlist struct{ mgoCollection }
+
+func (m mgoWaitlist) Insert(e *WaitlistEntry) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.Insert(e)
+	})
+}
+
+func (m mgoWaitlist) FindByEmail(email string) (*WaitlistEntry, error) {
+	e := new(WaitlistEntry)
+	err := m.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"email": email}).One(e)
+	})
+	return e, err
+}
+
+func (m mgoWaitlist) FindByHash(hash []byte) (*WaitlistEntry, error) {
+	e := new(WaitlistEntry)
+	err := m.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"hash": hash}).One(e)
+	})
+	return e, err
+}
+
+func (m mgoWaitlist) Update(e *WaitlistEntry) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.UpdateId(e.ID, e)
+	})
+}
+
+func (m mgoWaitlist) UpdateFields(e *WaitlistEntry, fields ...string) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.UpdateId(e.ID, mgoFieldUpdate(e, fields, nil))
+	})
+}
+
+func (m mgoWaitlist) UpdateFieldsWithMail(e *WaitlistEntry, msg *OutboxMessage, fields ...string) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.UpdateId(e.ID, mgoFieldUpdate(e, fields, msg))
+	})
+}
+
+func (m mgoWaitlist) List() ([]WaitlistEntry, error) {
+	entries := []WaitlistEntry{}
+	err := m.with(func(c *mgo.Collection) error {
+		return c.Find(nil).Sort("joined", "_id").All(&entries)
+	})
+	return entries, err
+}
+
+func (m mgoWaitlist) MarkInvited(id, code bson.ObjectId, at time.Time, invitation *OutboxMessage) error {
+	return m.with(func(c *mgo.Collection) error {
+		set := bson.M{"invited": at}
+		if code != "" {
+			set["code"] = code
+		}
+		update := bson.M{"$set": set}
+		if invitation != nil {
+			update["$push"] = bson.M{"pending_mail": invitation}
+		}
+		return c.Update(bson.M{"_id": id, "invited": bson.M{"$exists": false}}, update)
+	})
+}
+
+type mgoOutbox struct{ mgoCollection }
+
+func (m mgoOutbox) Insert(msg *OutboxMessage) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.Insert(msg)
+	})
+}
+
+func (m mgoOutbox) ClaimDue(at, lease time.Time) (*OutboxMessage, error) {
+	msg := new(OutboxMessage)
+	err := m.with(func(c *mgo.Collection) error {
+		query := bson.M{
+			"status":       bson.M{"$in": []string{OutboxPending, OutboxSending}},
+			"next_attempt": bson.M{"$lte": at},
+		}
+		change := mgo.Change{
+			Update:    bson.M{"$set": bson.M{"status": OutboxSending, "next_attempt": lease}},
+			ReturnNew: true,
+		}
+		_, err := c.Find(query).Sort("next_attempt", "_id").Apply(change, msg)
+		return err
+	})
+	return msg, err
+}
+
+func (m mgoOutbox) Update(msg *OutboxMessage) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.UpdateId(msg.ID, msg)
+	})
+}
+
+func (m mgoOutbox) FindByProviderID(id string) (*OutboxMessage, error) {
+	msg := new(OutboxMessage)
+	err := m.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"provider_id": id}).One(msg)
+	})
+	return msg, err
+}
+
+func (m mgoOutbox) List(status string, limit int) ([]OutboxMessage, error) {
+	messages := []OutboxMessage{}
+	err := m.with(func(c *mgo.Collection) error {
+		query := bson.M{}
+		if status != "" {
+			query["status"] = status
+		}
+		return c.Find(query).Sort("-_id").Limit(limit).All(&messages)
+	})
+	return messages, err
+}
+
+func (m mgoOutbox) Requeue(id bson.ObjectId, at time.Time) error {
+	return m.with(func(c *mgo.Collection) error {
+		query := bson.M{"_id": id, "status": bson.M{"$in": []string{OutboxDead, OutboxSent, OutboxSuppressed}}}
+		update := bson.M{
+			"$set":   bson.M{"status": OutboxPending, "attempts": 0, "next_attempt": at},
+			"$unset": bson.M{"last_error": ""},
+		}
+		return c.Update(query, update)
+	})
+}
+
+type mgoMailEvents struct{ mgoCollection }
+
+func (m mgoMailEvents) Insert(e *MailEvent) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.Insert(e)
+	})
+}
+
+func (m mgoMailEvents) FindByMessage(id bson.ObjectId) ([]MailEvent, error) {
+	events := []MailEvent{}
+	err := m.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"message": id}).Sort("at", "_id").All(&events)
+	})
+	return events, err
+}
+
+type mgoSuppressions struct{ mgoCollection }
+
+func (m mgoSuppressions) Add(s *Suppression) error {
+	return m.with(func(c *mgo.Collection) error {
+		_, err := c.UpsertId(s.Email, s)
+		return err
+	})
+}
+
+func (m mgoSuppressions) Find(email string) (*Suppression, error) {
+	s := new(Suppression)
+	err := m.with(func(c *mgo.Collection) error {
+		return c.FindId(email).One(s)
+	})
+	return s, err
+}
+
+func (m mgoSuppressions) Remove(email string) error {
+	return m.with(func(c *mgo.Collection) error {
+		return c.RemoveId(email)
+	})
+}
+
+func (m mgoSuppressions) List() ([]Suppression, error) {
+	list := []Suppression{}
+	err := m.with(func(c *mgo.Collection) error {
+		return c.Find(nil).Sort("_id").All(&list)
+	})
+	return list, err
+}
+
+// mgoPendingMail reaches the pending mail of every collection holding some.
+type mgoPendingMail struct{ s *MgoStore }
+
+// Returns the collections pending mail is saved in, by kind of document.
+func (s *MgoStore) pendingMailCollections() map[string]string {
+	return map[string]string{
+		pendingOnUser:          s.cfg.UsersCollection,
+		pendingOnPasswordReset: s.cfg.PasswordResetsCollection,
+		pendingOnSignupCode:    s.cfg.SignupCodesCollection,
+		pendingOnWaitlist:      s.cfg.WaitlistCollection,
+	}
+}
+
+func (m mgoPendingMail) Find(limit int) ([]PendingMail, error) {
+	list := []PendingMail{}
+	for kind, collection := range m.s.pendingMailCollections() {
+		var docs []struct {
+			ID          bson.ObjectId   `bson:"_id"`
+			PendingMail []OutboxMessage `bson:"pending_mail"`
+		}
+		err := m.s.with(collection, func(c *mgo.Collection) error {
+			query := bson.M{"pending_mail._id": bson.M{"$exists": true}}
+			return c.Find(query).Select(bson.M{"pending_mail": 1}).Limit(limit).All(&docs)
+		})
+		if err != nil {
+			return list, err
+		}
+		for _, d := range docs {
+			for _, msg := range d.PendingMail {
+				if len(list) == limit {
+					return list, nil
+				}
+				list = append(list, PendingMail{Kind: kind, Owner: d.ID, Message: msg})
+			}
+		}
+	}
+	return list, nil
+}
+
+func (m mgoPendingMail) Remove(p *PendingMail) error {
+	collection, ok := m.s.pendingMailCollections()[p.Kind]
+	if !ok {
+		return NotFoundError
 	}
+	return m.s.with(collection, func(c *mgo.Collection) error {
+		return c.UpdateId(p.Owner, bson.M{"$pull": bson.M{"pending_mail": bson.M{"_id": p.Message.ID}}})
+	})
 }
@@ -0,0 +1,359 @@
+package core
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var OIDCStateMismatchError = errors.New("Sign in request expired or forged, please try again.")
+var InvalidIDTokenError = errors.New("Invalid identity token.")
+var UnverifiedEmailConflictError = errors.New("An account already uses this email address. Sign in with your password to link it.")
+
+// OIDCConfig describes an OpenID Connect provider users can sign in with.
+type OIDCConfig struct {
+	// Provider names the provider in the users' identities.
+	Provider     string `config:"provider"      env:"QDOC_GOOGLE_PROVIDER"`
+	Issuer       string `config:"issuer"        env:"QDOC_GOOGLE_ISSUER"`
+	ClientID     string `config:"client_id"     env:"QDOC_GOOGLE_CLIENT_ID"`
+	ClientSecret string `config:"client_secret" env:"QDOC_GOOGLE_CLIENT_SECRET" secret:"true"`
+	RedirectURL  string `config:"redirect_url"  env:"QDOC_GOOGLE_REDIRECT_URL"`
+}
+
+// OIDCProvider runs the authorization code flow, with PKCE, against an
+// OpenID Connect provider, and validates the ID tokens it issues.
+type OIDCProvider struct {
+	config OIDCConfig
+	client *http.Client
+	meta   oidcMetadata
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+}
+
+// Endpoints read from the provider's discovery document.
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// The keys of the provider are fetched again when a token is signed with
+// an unknown one, but not more often than this.
+const jwksRefreshInterval = time.Minute
+
+// NewOIDCProvider reads the provider's discovery document. A nil client
+// means http.DefaultClient.
+func NewOIDCProvider(ctx context.Context, cfg OIDCConfig, client *http.Client) (*OIDCProvider, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	p := &OIDCProvider{config: cfg, client: client}
+	discovery := strings.TrimRight(cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, discovery, &p.meta); err != nil {
+		return nil, err
+	}
+	if p.meta.Issuer != cfg.Issuer {
+		return nil, fmt.Errorf("OIDC discovery: issuer %q doesn't match %q", p.meta.Issuer, cfg.Issuer)
+	}
+	return p, nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// AuthRequest is a pending sign in. The caller keeps it, typically in a
+// short-lived cookie, until the provider redirects the user back.
+type AuthRequest struct {
+	URL      string `json:"-"`
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+// AuthURL starts a sign in: the user must be redirected to the returned
+// request's URL.
+func (p *OIDCProvider) AuthURL() *AuthRequest {
+	r := &AuthRequest{
+		State:    RandomUrlencodedString(24),
+		Nonce:    RandomUrlencodedString(24),
+		Verifier: RandomUrlencodedString(48),
+	}
+	challenge := sha256.Sum256([]byte(r.Verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {"openid email profile"},
+		"state":                 {r.State},
+		"nonce":                 {r.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	r.URL = p.meta.AuthorizationEndpoint + "?" + params.Encode()
+	return r
+}
+
+// IDClaims is the validated content of an ID token.
+type IDClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	ExpiresAt     int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+	// Provider is the name of the provider that issued the token.
+	Provider string `json:"-"`
+}
+
+// Exchange trades the code the provider redirected the user back with for
+// an ID token, and returns its validated claims. state is the one received
+// along with the code.
+func (p *OIDCProvider) Exchange(ctx context.Context, r *AuthRequest, state, code string) (*IDClaims, error) {
+	if r == nil || subtle.ConstantTimeCompare([]byte(r.State), []byte(state)) != 1 {
+		return nil, OIDCStateMismatchError
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"client_secret": {p.config.ClientSecret},
+		"code_verifier": {r.Verifier},
+	}
+	req, err := http.NewRequest("POST", p.meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC token exchange: %s", resp.Status)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	return p.verifyIDToken(ctx, tokens.IDToken, r.Nonce)
+}
+
+// Checks the token's RS256 signature against the provider's keys, and its
+// issuer, audience, validity period and nonce.
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, token, nonce string) (*IDClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, InvalidIDTokenError
+	}
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil || header.Algorithm != "RS256" {
+		return nil, InvalidIDTokenError
+	}
+	key, err := p.key(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, InvalidIDTokenError
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+		return nil, InvalidIDTokenError
+	}
+	claims := new(IDClaims)
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, InvalidIDTokenError
+	}
+	now, leeway := timeNow(), getConfig().Tokens.Leeway
+	if now.Add(-leeway).After(time.Unix(claims.ExpiresAt, 0)) || now.Add(leeway).Before(time.Unix(claims.IssuedAt, 0)) {
+		return nil, InvalidIDTokenError
+	}
+	if claims.Issuer != p.config.Issuer || !claims.Audience.contains(p.config.ClientID) || claims.Subject == "" {
+		return nil, InvalidIDTokenError
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, InvalidIDTokenError
+	}
+	claims.Provider = p.config.Provider
+	if claims.Provider == "" {
+		claims.Provider = ProviderOIDC
+	}
+	return claims, nil
+}
+
+// Returns the provider's key with the given ID, fetching the key set
+// again if it is unknown.
+func (p *OIDCProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if timeNow().Sub(p.keysFetched) < jwksRefreshInterval {
+		return nil, UnknownTokenKeyError
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.meta.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keysFetched = timeNow()
+	p.keys = make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		p.keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, UnknownTokenKeyError
+}
+
+// DoOIDC logs in the user the ID token was issued for, recording the
+// attempt. Unknown identities are linked to the account with the same email
+// address when both the provider and the account verified it, and get a
+// new account otherwise.
+// Users with two-factor authentication enabled get a
+// *SecondFactorRequiredError, as with Do.
+func (l *LoginAttempt) DoOIDC(claims *IDClaims) (*User, error) {
+	u, err := FindUserByIdentity(claims.Provider, claims.Subject)
+	if err == NotFoundError {
+		u, err = oidcAccount(claims)
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.EnteredIp, u.EnteredUserAgent = l.Ip, l.UserAgent
+	if u.IsLocked() {
+		u.recordAttempt(LoginLocked)
+		return nil, &AccountLockedError{u.LockedUntil}
+	}
+	if u.TOTPEnabled {
+		challenge, err := u.newLoginChallenge()
+		if err != nil {
+			return nil, err
+		}
+		return nil, &SecondFactorRequiredError{challenge}
+	}
+	u.Login()
+	return u, nil
+}
+
+// Finds the account to link a new subject to, or creates it.
+func oidcAccount(claims *IDClaims) (*User, error) {
+	users := getStore().Users()
+	if claims.Email != "" && claims.EmailVerified {
+		u, err := users.FindByEmail(claims.Email)
+		if err == nil {
+			if !u.EmailVerified {
+				return nil, UnverifiedEmailConflictError
+			}
+			return u, u.LinkIdentity(claims.Provider, claims.Subject, claims.Email)
+		}
+		if err != NotFoundError {
+			return nil, err
+		}
+	}
+	u := &User{
+		Name:         claims.Name,
+		IsRegistered: true,
+		IsActive:     true,
+		LastLogin:    timeNow(),
+	}
+	if err := u.LinkIdentity(claims.Provider, claims.Subject, claims.Email); err != nil {
+		return nil, err
+	}
+	if claims.Email != "" {
+		if err := u.SetEmail(claims.Email); err != nil {
+			return nil, err
+		}
+		u.EmailVerified = claims.EmailVerified
+		if u.EmailVerified {
+			u.VerificationCode = ""
+		}
+	}
+	base := usernameFrom(claims.Email)
+	for i := 0; ; i++ {
+		u.Username = base
+		if i > 0 {
+			u.Username = fmt.Sprintf("%s%d", base, 1000+rand.Intn(9000))
+		}
+		err := users.Insert(u)
+		if err != DuplicateKeyError || i == 5 {
+			return u, err
+		}
+		u.ID = ""
+	}
+}
+
+var usernameInvalidChars = regexp.MustCompile("[^a-z0-9_-]+")
+
+// Suggests a valid username from an email address.
+func usernameFrom(email string) string {
+	name := email
+	if at := strings.Index(name, "@"); at >= 0 {
+		name = name[:at]
+	}
+	name = usernameInvalidChars.ReplaceAllString(strings.ToLower(name), "")
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	if len(name) < 3 {
+		name = "user" + name
+	}
+	return name
+}
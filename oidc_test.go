@@ -0,0 +1,137 @@
+package core
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// A minimal OpenID Connect provider, issuing ID tokens for whatever
+// claims the test sets before the code exchange.
+type mockProvider struct {
+	*httptest.Server
+	key        *rsa.PrivateKey
+	challenges map[string]string
+	claims     IDClaims
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockProvider{key: key, challenges: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcMetadata{m.URL, m.URL + "/auth", m.URL + "/token", m.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		e := big.NewInt(int64(key.E)).Bytes()
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1", "n": encodeSegment(key.N.Bytes()), "e": encodeSegment(e),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if m.challenges[r.FormValue("code")] != encodeSegment(sum[:]) {
+			http.Error(w, "bad verifier", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign(m.claims)})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockProvider) sign(claims IDClaims) string {
+	header, _ := json.Marshal(tokenHeader{"RS256", "JWT", "k1"})
+	payload, _ := json.Marshal(claims)
+	signed := encodeSegment(header) + "." + encodeSegment(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	return signed + "." + encodeSegment(signature)
+}
+
+// Goes through the authorization step, as the user's browser would.
+func (m *mockProvider) authorize(t *testing.T, r *AuthRequest) (state, code string) {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code = RandomUrlencodedString(8)
+	m.challenges[code] = u.Query().Get("code_challenge")
+	m.claims.Nonce = u.Query().Get("nonce")
+	return u.Query().Get("state"), code
+}
+
+func TestOIDCSignIn(t *testing.T) {
+	clock := setupAuthTest(t)
+	m := newMockProvider(t)
+	ctx := context.Background()
+	p, err := NewOIDCProvider(ctx, OIDCConfig{Issuer: m.URL, ClientID: "qdoc", RedirectURL: "https://example.com/cb"}, nil)
+	if err != nil {
+		t.Fatal("NewOIDCProvider:", err)
+	}
+	signIn := func(claims IDClaims) (*User, error) {
+		claims.Issuer, claims.Audience = m.URL, audience{"qdoc"}
+		claims.IssuedAt, claims.ExpiresAt = clock.Unix(), clock.Unix()+300
+		m.claims = claims
+		r := p.AuthURL()
+		state, code := m.authorize(t, r)
+		verified, err := p.Exchange(ctx, r, state, code)
+		if err != nil {
+			return nil, err
+		}
+		return (&LoginAttempt{Ip: "192.0.2.1"}).DoOIDC(verified)
+	}
+
+	created, err := signIn(IDClaims{Subject: "g-1", Email: "heidi.k@example.com", EmailVerified: true})
+	if err != nil {
+		t.Fatal("First sign in:", err)
+	}
+	if created.Username != "heidik" || !created.EmailVerified || created.HasPassword {
+		t.Errorf("Unexpected new user %+v", created)
+	}
+	again, err := signIn(IDClaims{Subject: "g-1", Email: "heidi.k@example.com", EmailVerified: true})
+	if err != nil || again.ID != created.ID {
+		t.Error("Second sign in didn't find the user:", err)
+	}
+
+	ivan := registerTestUser(t, "ivan", "plum-Harbor-42")
+	if _, err := signIn(IDClaims{Subject: "g-2", Email: ivan.Email, EmailVerified: true}); err != UnverifiedEmailConflictError {
+		t.Error("Linked to an account with an unverified address:", err)
+	}
+	ivan.EmailVerified = true
+	getStore().Users().Update(ivan)
+	if linked, err := signIn(IDClaims{Subject: "g-2", Email: ivan.Email, EmailVerified: true}); err != nil || linked.ID != ivan.ID {
+		t.Error("Not linked by verified email:", err)
+	}
+
+	r := p.AuthURL()
+	_, code := m.authorize(t, r)
+	if _, err := p.Exchange(ctx, r, "forged", code); err != OIDCStateMismatchError {
+		t.Error("Forged state accepted:", err)
+	}
+	state, code := m.authorize(t, r)
+	m.claims.Nonce = "replayed"
+	if _, err := p.Exchange(ctx, r, state, code); err != InvalidIDTokenError {
+		t.Error("Wrong nonce accepted:", err)
+	}
+	if _, err := p.verifyIDToken(ctx, m.sign(m.claims)+"x", "replayed"); err != InvalidIDTokenError {
+		t.Error("Bad signature accepted:", err)
+	}
+	expired := m.claims
+	expired.ExpiresAt = clock.Unix() - 3600
+	if _, err := p.verifyIDToken(ctx, m.sign(expired), "replayed"); err != InvalidIDTokenError {
+		t.Error("Expired token accepted:", err)
+	}
+}
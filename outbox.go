@@ -0,0 +1,228 @@
+package core
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Permission needed to inspect and requeue the outbox.
+const ActionManageOutbox = "outbox:manage"
+
+// States of an outbox message.
+const (
+	OutboxPending = "pending"
+	OutboxSending = "sending"
+	OutboxSent    = "sent"
+	OutboxDead    = "dead"
+	// The recipient was put on the suppression list after the message
+	// was queued.
+	OutboxSuppressed = "suppressed"
+)
+
+// OutboxConfig tells how the outbox worker delivers emails.
+type OutboxConfig struct {
+	// MaxAttempts is how many times delivery is tried before the message
+	// is declared dead.
+	MaxAttempts int `config:"max_attempts" env:"QDOC_OUTBOX_MAX_ATTEMPTS"`
+	// BaseDelay is the wait after the first failure, doubled after each
+	// of the next ones up to MaxDelay.
+	BaseDelay time.Duration `config:"base_delay" env:"QDOC_OUTBOX_BASE_DELAY"`
+	MaxDelay  time.Duration `config:"max_delay"  env:"QDOC_OUTBOX_MAX_DELAY"`
+	// PollInterval is how often the worker looks for messages to send.
+	PollInterval time.Duration `config:"poll_interval" env:"QDOC_OUTBOX_POLL_INTERVAL"`
+	// Lease is how long a message stays claimed by a worker, after which
+	// another one retries it, in case the first crashed.
+	Lease time.Duration `config:"lease" env:"QDOC_OUTBOX_LEASE"`
+}
+
+// Returns the wait before the next attempt, after the given number.
+func (c OutboxConfig) backoff(attempts int) time.Duration {
+	d := c.BaseDelay
+	for i := 1; i < attempts && d < c.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > c.MaxDelay {
+		d = c.MaxDelay
+	}
+	return d
+}
+
+// OutboxMessage is an email waiting to be delivered, or that was.
+type OutboxMessage struct {
+	Message `bson:",inline"`
+
+	ID          bson.ObjectId `bson:"_id"                   json:"id"`
+	Template    string        `bson:"template,omitempty"    json:"template,omitempty"`
+	Status      string        `bson:"status"                json:"status"`
+	Attempts    int           `bson:"attempts"              json:"attempts"`
+	NextAttempt time.Time     `bson:"next_attempt"          json:"nextAttempt"`
+	LastError   string        `bson:"last_error,omitempty"  json:"lastError,omitempty"`
+	Created     time.Time     `bson:"created"               json:"created"`
+	Sent        time.Time     `bson:"sent,omitempty"        json:"sent,omitempty"`
+	ProviderID  string        `bson:"provider_id,omitempty" json:"providerId,omitempty"`
+}
+
+// Kinds of documents emails are saved on, in the same write as the change
+// that triggers them, until sweepPendingMail moves them to the outbox.
+// MongoDB, as accessed through mgo, can't write several documents
+// atomically, so this is how an email is only sent for a change that was
+// saved, and is never lost once it was.
+const (
+	pendingOnUser          = "user"
+	pendingOnPasswordReset = "password_reset"
+	pendingOnSignupCode    = "signup_code"
+	pendingOnWaitlist      = "waitlist"
+)
+
+// How many pending emails are moved to the outbox at a time.
+const pendingMailBatch = 100
+
+// PendingMail is an email saved on the document whose change triggered it.
+type PendingMail struct {
+	// Kind tells which kind of document it is saved on.
+	Kind    string
+	Owner   bson.ObjectId
+	Message OutboxMessage
+}
+
+// Returns a message for the worker to deliver, or SuppressedAddressError
+// if the recipient is on the suppression list.
+func newOutboxMessage(template string, m *Message) (*OutboxMessage, error) {
+	if err := checkSuppressed(m.To); err != nil {
+		return nil, err
+	}
+	now := timeNow()
+	return &OutboxMessage{
+		ID:          bson.NewObjectId(),
+		Message:     *m,
+		Template:    template,
+		Status:      OutboxPending,
+		NextAttempt: now,
+		Created:     now,
+	}, nil
+}
+
+// Queues an email no stored change triggers, unless the recipient is on
+// the suppression list.
+func enqueue(template string, m *Message) error {
+	msg, err := newOutboxMessage(template, m)
+	if err != nil {
+		return err
+	}
+	return getStore().Outbox().Insert(msg)
+}
+
+// Moves the emails saved along the changes that triggered them to the
+// outbox. Messages keep their ID, so one moved twice after a crash is
+// only queued once.
+func sweepPendingMail() error {
+	pending := getStore().PendingMail()
+	for {
+		list, err := pending.Find(pendingMailBatch)
+		if err != nil {
+			return err
+		}
+		for i := range list {
+			p := &list[i]
+			if err := getStore().Outbox().Insert(&p.Message); err != nil && err != DuplicateKeyError {
+				return err
+			}
+			if err := pending.Remove(p); err != nil && err != NotFoundError {
+				return err
+			}
+		}
+		if len(list) < pendingMailBatch {
+			return nil
+		}
+	}
+}
+
+// DeliverOutbox queues the emails saved along the changes that triggered
+// them, then sends every message due, returning how many were sent.
+// Failed deliveries are retried later, with exponential backoff.
+func DeliverOutbox() (int, error) {
+	if err := sweepPendingMail(); err != nil {
+		return 0, err
+	}
+	outbox := getStore().Outbox()
+	cfg := getConfig().Outbox
+	sent := 0
+	for {
+		now := timeNow()
+		m, err := outbox.ClaimDue(now, now.Add(cfg.Lease))
+		if err == NotFoundError {
+			return sent, nil
+		}
+		if err != nil {
+			return sent, err
+		}
+		if err := checkSuppressed(m.To); err != nil {
+			if err != SuppressedAddressError {
+				return sent, err
+			}
+			m.Status = OutboxSuppressed
+			if err := outbox.Update(m); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		m.Attempts++
+		id, err := getMailer().Send(&m.Message)
+		now = timeNow()
+		switch {
+		case err == nil:
+			m.Status, m.Sent, m.ProviderID, m.LastError = OutboxSent, now, normalizeMessageID(id), ""
+			sent++
+		case m.Attempts >= cfg.MaxAttempts:
+			m.Status, m.LastError = OutboxDead, err.Error()
+			log.Printf("Giving up on email %s to %s: %v", m.ID.Hex(), m.To, err)
+		default:
+			m.Status, m.LastError = OutboxPending, err.Error()
+			m.NextAttempt = now.Add(cfg.backoff(m.Attempts))
+		}
+		if err := outbox.Update(m); err != nil {
+			return sent, err
+		}
+	}
+}
+
+// RunOutboxWorker delivers the outbox every Config.Outbox.PollInterval,
+// until ctx is done.
+func RunOutboxWorker(ctx context.Context) error {
+	ticker := time.NewTicker(getConfig().Outbox.PollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := DeliverOutbox(); err != nil {
+			log.Println("Error delivering the outbox:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// OutboxMessages lists up to limit messages in the given state, or in any
+// state if status is empty, newest first.
+func (actor *User) OutboxMessages(status string, limit int) ([]OutboxMessage, error) {
+	if err := Authorize(actor, ActionManageOutbox, nil); err != nil {
+		return nil, err
+	}
+	return getStore().Outbox().List(status, limit)
+}
+
+// RequeueMessage schedules a dead, sent or suppressed message for delivery
+// again, with a fresh count of attempts.
+func (actor *User) RequeueMessage(id string) error {
+	if err := Authorize(actor, ActionManageOutbox, nil); err != nil {
+		return err
+	}
+	if !bson.IsObjectIdHex(id) {
+		return NotFoundError
+	}
+	return getStore().Outbox().Requeue(bson.ObjectIdHex(id), timeNow())
+}
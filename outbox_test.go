@@ -0,0 +1,155 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Fails the given number of sends, then delivers to a MemoryMailer.
+type flakyMailer struct {
+	failures int
+	MemoryMailer
+}
+
+func (m *flakyMailer) Send(msg *Message) (string, error) {
+	if m.failures > 0 {
+		m.failures--
+		return "", errors.New("Service unavailable.")
+	}
+	return m.MemoryMailer.Send(msg)
+}
+
+func TestOutboxRetries(t *testing.T) {
+	clock := setupAuthTest(t)
+	mailer := &flakyMailer{failures: 2}
+	std.SetMailer(mailer)
+	if err := SendMail("Hello", "Hi there.", "bob@example.com"); err != nil {
+		t.Fatal("SendMail:", err)
+	}
+	if n, err := DeliverOutbox(); n != 0 || err != nil {
+		t.Fatal("Expected a failed delivery, got", n, err)
+	}
+	pending, _ := getStore().Outbox().List(OutboxPending, 0)
+	if len(pending) != 1 || pending[0].Attempts != 1 || pending[0].LastError != "Service unavailable." {
+		t.Fatalf("Expected a pending message, got %+v", pending)
+	}
+	base := getConfig().Outbox.BaseDelay
+	if !pending[0].NextAttempt.Equal(clock.Add(base)) {
+		t.Error("Expected a retry after", base, "got", pending[0].NextAttempt)
+	}
+
+	*clock = clock.Add(base - time.Second)
+	if n, _ := DeliverOutbox(); n != 0 || len(mailer.Messages()) != 0 {
+		t.Fatal("Retried before the backoff")
+	}
+	*clock = clock.Add(time.Second)
+	DeliverOutbox()
+	pending, _ = getStore().Outbox().List(OutboxPending, 0)
+	if len(pending) != 1 || !pending[0].NextAttempt.Equal(clock.Add(2*base)) {
+		t.Fatalf("Expected the delay to double, got %+v", pending)
+	}
+
+	*clock = clock.Add(2 * base)
+	if n, err := DeliverOutbox(); n != 1 || err != nil {
+		t.Fatal("Expected a delivery, got", n, err)
+	}
+	if len(mailer.Messages()) != 1 || mailer.Messages()[0].Subject != "Hello" {
+		t.Fatal("Unexpected mail", mailer.Messages())
+	}
+	sent, _ := getStore().Outbox().List(OutboxSent, 0)
+	if len(sent) != 1 || sent[0].Attempts != 3 || sent[0].ProviderID == "" || sent[0].LastError != "" {
+		t.Fatalf("Expected a sent message, got %+v", sent)
+	}
+}
+
+func TestOutboxDeadLetters(t *testing.T) {
+	clock := setupAuthTest(t)
+	admin := registerTestAdmin(t, "admin")
+	bob := registerTestUser(t, "bob", "plum-Harbor-42")
+	sentMail()
+	cfg := getConfig().Outbox
+	mailer := &flakyMailer{failures: cfg.MaxAttempts}
+	std.SetMailer(mailer)
+	if err := SendMail("Hello", "Hi there.", "carol@example.com"); err != nil {
+		t.Fatal("SendMail:", err)
+	}
+	for i := 0; i < cfg.MaxAttempts; i++ {
+		DeliverOutbox()
+		*clock = clock.Add(cfg.MaxDelay)
+	}
+	if _, err := bob.OutboxMessages(OutboxDead, 10); err != ForbiddenError {
+		t.Fatal("Expected ForbiddenError, got", err)
+	}
+	dead, err := admin.OutboxMessages(OutboxDead, 10)
+	if err != nil || len(dead) != 1 || dead[0].Attempts != cfg.MaxAttempts || dead[0].To != "carol@example.com" {
+		t.Fatalf("Expected a dead message, got %+v %v", dead, err)
+	}
+	if n, _ := DeliverOutbox(); n != 0 {
+		t.Fatal("Dead message delivered")
+	}
+
+	if err := bob.RequeueMessage(dead[0].ID.Hex()); err != ForbiddenError {
+		t.Fatal("Expected ForbiddenError, got", err)
+	}
+	if err := admin.RequeueMessage(dead[0].ID.Hex()); err != nil {
+		t.Fatal("RequeueMessage:", err)
+	}
+	if n, err := DeliverOutbox(); n != 1 || err != nil {
+		t.Fatal("Expected the requeued message to be sent, got", n, err)
+	}
+	if err := admin.RequeueMessage("nonsense"); err != NotFoundError {
+		t.Fatal("Expected NotFoundError, got", err)
+	}
+}
+
+func TestOutboxLease(t *testing.T) {
+	clock := setupAuthTest(t)
+	if err := SendMail("Hello", "Hi there.", "bob@example.com"); err != nil {
+		t.Fatal("SendMail:", err)
+	}
+	// A worker claims the message, then crashes.
+	lease := getConfig().Outbox.Lease
+	if _, err := getStore().Outbox().ClaimDue(*clock, clock.Add(lease)); err != nil {
+		t.Fatal("ClaimDue:", err)
+	}
+	if n, _ := DeliverOutbox(); n != 0 {
+		t.Fatal("Delivered a claimed message")
+	}
+	*clock = clock.Add(lease)
+	if n, err := DeliverOutbox(); n != 1 || err != nil {
+		t.Fatal("Expected the message to be sent once the lease expired, got", n, err)
+	}
+}
+
+func TestPendingMail(t *testing.T) {
+	setupAuthTest(t)
+	bob := registerTestUser(t, "bob", "plum-Harbor-42")
+	if queued, _ := getStore().Outbox().List("", 0); len(queued) != 0 {
+		t.Fatal("Queued the welcome email before the sweep")
+	}
+	// A change that fails to be saved sends nothing.
+	err := new(User).Register(User{Username: "bob", Email: "other@example.com", EnteredPassword: "plum-Harbor-42"})
+	if err != UsernameAlreadyTakenError {
+		t.Fatal("Expected UsernameAlreadyTakenError, got", err)
+	}
+
+	// A sweep crashes after queuing the email, before taking it off the user.
+	stored, _ := getStore().Users().FindByID(bob.ID)
+	if len(stored.PendingMail) != 1 {
+		t.Fatalf("Expected the welcome email on the user, got %+v", stored.PendingMail)
+	}
+	if err := getStore().Outbox().Insert(&stored.PendingMail[0]); err != nil {
+		t.Fatal("Insert:", err)
+	}
+	if mail := sentMail(); len(mail) != 1 || mail[0].To != bob.Email {
+		t.Fatalf("Expected a single welcome email, got %+v", mail)
+	}
+	stored, _ = getStore().Users().FindByID(bob.ID)
+	if len(stored.PendingMail) != 0 {
+		t.Fatal("Expected the sweep to take the email off the user")
+	}
+	if n, _ := DeliverOutbox(); n != 0 {
+		t.Fatal("Sent the welcome email twice")
+	}
+}
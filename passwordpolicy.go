@@ -0,0 +1,300 @@
+package core
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Codes of the password feedback, for the UI to pick its own wording.
+const (
+	PasswordTooShort         = "too_short"
+	PasswordContainsPersonal = "contains_personal"
+	PasswordCommon           = "common"
+	PasswordGuessable        = "guessable"
+	PasswordBreached         = "breached"
+)
+
+// PasswordPolicy tells which passwords users may choose.
+// MinScore ranges from 0 (anything) to 4 (very hard to guess), see
+// PasswordScore.
+type PasswordPolicy struct {
+	MinLength      int  `config:"min_length"      env:"QDOC_PASSWORD_MIN_LENGTH"`
+	MinScore       int  `config:"min_score"       env:"QDOC_PASSWORD_MIN_SCORE"`
+	RejectPersonal bool `config:"reject_personal" env:"QDOC_PASSWORD_REJECT_PERSONAL"`
+	RejectCommon   bool `config:"reject_common"   env:"QDOC_PASSWORD_REJECT_COMMON"`
+}
+
+// PasswordFeedback is one reason a password was refused.
+type PasswordFeedback struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// WeakPasswordError is returned when a password doesn't satisfy the policy.
+type WeakPasswordError struct {
+	Score    int                `json:"score"`
+	Feedback []PasswordFeedback `json:"feedback"`
+}
+
+func (e *WeakPasswordError) Error() string {
+	messages := make([]string, len(e.Feedback))
+	for i, f := range e.Feedback {
+		messages[i] = f.Message
+	}
+	return "Password too weak. " + strings.Join(messages, " ")
+}
+
+// BreachSource looks passwords up in a breach corpus without ever seeing
+// them: it is given the first 5 hex digits of their SHA-1, and returns the
+// remaining 35 digits of every breached password sharing that prefix,
+// with the number of times it was seen.
+type BreachSource interface {
+	Range(prefix string) (map[string]int, error)
+}
+
+// PwnedPasswords queries the Pwned Passwords range API.
+// Lookups fail open: when the API is unreachable or too slow, the error is
+// logged and the password is checked against the other rules only.
+type PwnedPasswords struct {
+	// URL defaults to https://api.pwnedpasswords.com/range/
+	URL string
+	// Client defaults to one giving up after pwnedPasswordsTimeout, so
+	// that a hanging API doesn't hold up signups and password changes.
+	Client *http.Client
+}
+
+// How long a lookup may take with the default client.
+const pwnedPasswordsTimeout = 5 * time.Second
+
+var pwnedPasswordsClient = &http.Client{Timeout: pwnedPasswordsTimeout}
+
+func (p PwnedPasswords) Range(prefix string) (map[string]int, error) {
+	url, client := p.URL, p.Client
+	if url == "" {
+		url = "https://api.pwnedpasswords.com/range/"
+	}
+	if client == nil {
+		client = pwnedPasswordsClient
+	}
+	resp, err := client.Get(url + prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Breach range lookup failed: %s", resp.Status)
+	}
+	suffixes := make(map[string]int)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		count, _ := strconv.Atoi(parts[1])
+		suffixes[strings.ToUpper(parts[0])] = count
+	}
+	return suffixes, scanner.Err()
+}
+
+// Tells how many times the password was found in breaches.
+func breachCount(source BreachSource, password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	suffixes, err := source.Range(digest[:5])
+	if err != nil {
+		return 0, err
+	}
+	return suffixes[digest[5:]], nil
+}
+
+// Check returns a *WeakPasswordError listing every rule the password
+// breaks. personal holds words the password must not contain, such as
+// the user's name and email address.
+// When source is not nil the password is also looked up in breaches; a
+// failing lookup is logged and doesn't refuse the password.
+func (p PasswordPolicy) Check(password string, source BreachSource, personal ...string) error {
+	weak := &WeakPasswordError{Score: PasswordScore(password, personal...)}
+	refuse := func(code, message string) {
+		weak.Feedback = append(weak.Feedback, PasswordFeedback{code, message})
+	}
+	if len([]rune(password)) < p.MinLength {
+		refuse(PasswordTooShort, fmt.Sprintf("Use at least %d characters.", p.MinLength))
+	}
+	if p.RejectPersonal && containsPersonal(password, personal) {
+		refuse(PasswordContainsPersonal, "Don't use your username or email address.")
+	}
+	if p.RejectCommon && isCommonPassword(password) {
+		refuse(PasswordCommon, "This is one of the most used passwords.")
+	} else if weak.Score < p.MinScore {
+		refuse(PasswordGuessable, "Add a few more words; avoid sequences, repetitions and common words.")
+	}
+	if len(weak.Feedback) == 0 && source != nil {
+		count, err := breachCount(source, password)
+		if err != nil {
+			log.Println("Error checking password breaches:", err)
+		} else if count > 0 {
+			refuse(PasswordBreached, "This password appeared in a data breach, choose another one.")
+		}
+	}
+	if len(weak.Feedback) > 0 {
+		return weak
+	}
+	return nil
+}
+
+// Words of the user that mustn't appear in their password: the username,
+// the email address and its local part, and the name.
+func (u *User) personalWords() []string {
+	words := []string{u.Username, u.Email, u.Name}
+	if at := strings.LastIndex(u.Email, "@"); at > 0 {
+		words = append(words, u.Email[:at])
+	}
+	return words
+}
+
+func containsPersonal(password string, personal []string) bool {
+	lower := strings.ToLower(password)
+	for _, w := range personal {
+		w = strings.ToLower(w)
+		if len(w) >= 3 && (strings.Contains(lower, w) || strings.Contains(unleet(lower), w)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isCommonPassword(password string) bool {
+	_, ok := commonPasswordRanks[strings.ToLower(password)]
+	return ok
+}
+
+// Undoes the usual letter substitutions, so that "p4ssw0rd" is recognized.
+var unleet = strings.NewReplacer("4", "a", "@", "a", "3", "e", "1", "i", "!", "i", "0", "o", "$", "s", "5", "s", "7", "t").Replace
+
+// PasswordScore rates how hard the password is to guess, from 0 to 4,
+// in the manner of zxcvbn: 0 means under a thousand guesses, then under a
+// million, a hundred million, ten billion, and 4 means more.
+// Common passwords and the personal words found inside the password count
+// as single dictionary guesses, and repeated or sequential characters add
+// almost nothing.
+func PasswordScore(password string, personal ...string) int {
+	guesses := passwordEntropy(password, personal) * math.Log10(2)
+	for score, limit := range []float64{3, 6, 8, 10} {
+		if guesses < limit {
+			return score
+		}
+	}
+	return 4
+}
+
+// Longer substrings aren't looked up in the dictionary.
+const maxDictionaryWord = 32
+
+// Estimates the bits of entropy of the password.
+func passwordEntropy(password string, personal []string) float64 {
+	runes := []rune(strings.ToLower(password))
+	plain := []rune(unleet(string(runes)))
+	if len(plain) != len(runes) {
+		plain = runes
+	}
+	covered := make([]bool, len(runes))
+	bits := 0.0
+
+	// Dictionary words cost their rank in the list, longest first.
+	mine := make(map[string]bool, len(personal))
+	for _, w := range personal {
+		mine[strings.ToLower(w)] = true
+	}
+	lookup := func(w []rune) (int, bool) {
+		if mine[string(w)] {
+			return 1, true
+		}
+		rank, ok := commonPasswordRanks[string(w)]
+		return rank, ok
+	}
+	longest := len(runes)
+	if longest > maxDictionaryWord {
+		longest = maxDictionaryWord
+	}
+	for length := longest; length >= 3; length-- {
+		for start := 0; start+length <= len(runes); start++ {
+			rank, ok := lookup(runes[start : start+length])
+			if !ok {
+				rank, ok = lookup(plain[start : start+length])
+			}
+			if !ok || anyCovered(covered[start:start+length]) {
+				continue
+			}
+			for i := start; i < start+length; i++ {
+				covered[i] = true
+			}
+			bits += math.Log2(float64(rank) + 1)
+		}
+	}
+
+	// Other characters cost the size of the alphabet they are drawn from,
+	// unless they repeat or continue a sequence.
+	alphabet := math.Log2(float64(alphabetSize(password)))
+	for i, r := range runes {
+		if covered[i] {
+			continue
+		}
+		if i > 0 && !covered[i-1] {
+			if d := r - runes[i-1]; d >= -1 && d <= 1 {
+				bits++
+				continue
+			}
+		}
+		bits += alphabet
+	}
+	return bits
+}
+
+func anyCovered(c []bool) bool {
+	for _, v := range c {
+		if v {
+			return true
+		}
+	}
+	return false
+}
+
+func alphabetSize(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	size := 0
+	if lower {
+		size += 26
+	}
+	if upper {
+		size += 26
+	}
+	if digit {
+		size += 10
+	}
+	if other {
+		size += 33
+	}
+	return size
+}
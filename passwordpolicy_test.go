@@ -0,0 +1,87 @@
+package core
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// Answers range queries from a fixed list of breached passwords.
+type fakeBreaches []string
+
+func (f fakeBreaches) Range(prefix string) (map[string]int, error) {
+	suffixes := make(map[string]int)
+	for _, p := range f {
+		sum := sha1.Sum([]byte(p))
+		digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+		if strings.HasPrefix(digest, prefix) {
+			suffixes[digest[5:]]++
+		}
+	}
+	return suffixes, nil
+}
+
+func feedbackCodes(err error) []string {
+	weak, ok := err.(*WeakPasswordError)
+	if !ok {
+		return nil
+	}
+	var codes []string
+	for _, f := range weak.Feedback {
+		codes = append(codes, f.Code)
+	}
+	return codes
+}
+
+func TestPasswordScore(t *testing.T) {
+	for _, c := range []struct {
+		password string
+		max, min int
+	}{
+		{"password", 0, 0},
+		{"P4ssw0rd", 0, 0},
+		{"aaaaaaaaaaaa", 1, 0},
+		{"abcdefghijkl", 1, 0},
+		{"dragon2015", 2, 0},
+		{"plum-Harbor-42", 4, 4},
+		{"correct horse battery staple", 4, 4},
+	} {
+		if score := PasswordScore(c.password); score > c.max || score < c.min {
+			t.Errorf("%q scored %d", c.password, score)
+		}
+	}
+	if PasswordScore("gwendolyn99", "gwendolyn") >= PasswordScore("gwendolyn99") {
+		t.Error("Personal words don't lower the score")
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := DefaultConfig().PasswordPolicy
+	for password, want := range map[string]string{
+		"short":                    PasswordTooShort,
+		"qwertyuiop":               PasswordCommon,
+		"xxgwendolynxx":            PasswordContainsPersonal,
+		"zzzzzzzzzz":               PasswordGuessable,
+		"Sturdy-Walrus-Tea-Kettle": "",
+	} {
+		codes := feedbackCodes(policy.Check(password, nil, "gwendolyn", "gwen@example.com"))
+		if want == "" && codes != nil || want != "" && (len(codes) == 0 || codes[0] != want) {
+			t.Errorf("%q: got %v, want %q", password, codes, want)
+		}
+	}
+
+	breached := fakeBreaches{"Sturdy-Walrus-Tea-Kettle"}
+	if codes := feedbackCodes(policy.Check("Sturdy-Walrus-Tea-Kettle", breached)); len(codes) != 1 || codes[0] != PasswordBreached {
+		t.Error("Breached password accepted:", codes)
+	}
+	if err := policy.Check("Amber-Lantern-Quietly-9", breached); err != nil {
+		t.Error("Safe password refused:", err)
+	}
+
+	setupAuthTest(t)
+	err := new(User).Register(User{Username: "gwendolyn", Email: "gwen@example.com", EnteredPassword: "Gwendolyn-2015"})
+	if codes := feedbackCodes(err); len(codes) == 0 || codes[0] != PasswordContainsPersonal {
+		t.Error("Registered with the username in the password:", err)
+	}
+}
@@ -0,0 +1,187 @@
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var WrongPasswordError = errors.New("Wrong password.")
+var UnknownPasswordHashError = errors.New("Unknown password hash format.")
+
+// Password hashing algorithms.
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+)
+
+// Prefixes of the stored hashes, telling which algorithm made them.
+const (
+	bcryptPrefix = "$bcrypt-sha256$"
+	argon2Prefix = "$argon2id$"
+)
+
+// PasswordHashing chooses how new passwords are hashed. Stored hashes made
+// with another algorithm or with other parameters are upgraded on the
+// next successful login.
+type PasswordHashing struct {
+	Algorithm  string `config:"algorithm"   env:"QDOC_PASSWORD_ALGORITHM"`
+	BcryptCost int    `config:"bcrypt_cost" env:"QDOC_PASSWORD_BCRYPT_COST"`
+	// Argon2id parameters: passes over memory, memory in KiB, and lanes.
+	Argon2Time    int `config:"argon2_time"    env:"QDOC_PASSWORD_ARGON2_TIME"`
+	Argon2Memory  int `config:"argon2_memory"  env:"QDOC_PASSWORD_ARGON2_MEMORY"`
+	Argon2Threads int `config:"argon2_threads" env:"QDOC_PASSWORD_ARGON2_THREADS"`
+}
+
+func (p PasswordHashing) problems() []string {
+	var problems []string
+	switch p.Algorithm {
+	case Bcrypt:
+		if p.BcryptCost < bcrypt.MinCost || p.BcryptCost > bcrypt.MaxCost {
+			problems = append(problems, fmt.Sprintf("passwords.bcrypt_cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost))
+		}
+	case Argon2id:
+		if p.Argon2Time < 1 || p.Argon2Memory < 8*p.Argon2Threads || p.Argon2Threads < 1 || p.Argon2Threads > 255 {
+			problems = append(problems, "passwords.argon2_* parameters are out of range")
+		}
+	default:
+		problems = append(problems, "passwords.algorithm must be "+Bcrypt+" or "+Argon2id)
+	}
+	return problems
+}
+
+// Hashes the password according to the configured algorithm.
+//
+// bcrypt only reads the first 72 bytes of its input, so the password is
+// reduced with SHA-256 first: every byte of a long password counts.
+// Hashes look like
+//
+//	$bcrypt-sha256$$2a$12$...
+//	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+func hashPassword(password string, p PasswordHashing) ([]byte, error) {
+	switch p.Algorithm {
+	case Bcrypt:
+		h, err := bcrypt.GenerateFromPassword(prehash(password), p.BcryptCost)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(bcryptPrefix), h...), nil
+	case Argon2id:
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		key := argon2.IDKey([]byte(password), salt, uint32(p.Argon2Time), uint32(p.Argon2Memory), uint8(p.Argon2Threads), 32)
+		return []byte(fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", Argon2id, argon2.Version,
+			p.Argon2Memory, p.Argon2Time, p.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))), nil
+	}
+	return nil, UnknownPasswordHashError
+}
+
+// The SHA-256 digest is base64 encoded, as bcrypt stops at NUL bytes.
+func prehash(password string) []byte {
+	sum := sha256.Sum256([]byte(password))
+	return []byte(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// Decoded argon2id hash.
+type argon2Hash struct {
+	time, memory, threads int
+	salt, key             []byte
+}
+
+func parseArgon2(hash []byte) (*argon2Hash, error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != Argon2id || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return nil, UnknownPasswordHashError
+	}
+	h := new(argon2Hash)
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, UnknownPasswordHashError
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, UnknownPasswordHashError
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, UnknownPasswordHashError
+	}
+	return h, nil
+}
+
+// Checks the password against a stored hash. A non-empty salt marks the
+// legacy format: bcrypt of the password with the salt appended, of which
+// bcrypt only ever read the first 72 bytes.
+func comparePassword(hash, salt []byte, password string) error {
+	var err error
+	switch {
+	case len(salt) > 0:
+		input := append([]byte(password), salt...)
+		if len(input) > 72 {
+			input = input[:72]
+		}
+		err = bcrypt.CompareHashAndPassword(hash, input)
+	case bytes.HasPrefix(hash, []byte(bcryptPrefix)):
+		err = bcrypt.CompareHashAndPassword(hash[len(bcryptPrefix):], prehash(password))
+	case bytes.HasPrefix(hash, []byte(argon2Prefix)):
+		h, perr := parseArgon2(hash)
+		if perr != nil {
+			return perr
+		}
+		key := argon2.IDKey([]byte(password), h.salt, uint32(h.time), uint32(h.memory), uint8(h.threads), uint32(len(h.key)))
+		if subtle.ConstantTimeCompare(key, h.key) != 1 {
+			return WrongPasswordError
+		}
+		return nil
+	default:
+		return UnknownPasswordHashError
+	}
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return WrongPasswordError
+	}
+	return err
+}
+
+// Tells whether a stored hash was made with an outdated scheme or
+// parameters, and should be replaced.
+func needsRehash(hash, salt []byte, p PasswordHashing) bool {
+	if len(salt) > 0 {
+		return true
+	}
+	switch p.Algorithm {
+	case Bcrypt:
+		if !bytes.HasPrefix(hash, []byte(bcryptPrefix)) {
+			return true
+		}
+		cost, err := bcrypt.Cost(hash[len(bcryptPrefix):])
+		return err != nil || cost != p.BcryptCost
+	case Argon2id:
+		h, err := parseArgon2(hash)
+		return err != nil || h.time != p.Argon2Time || h.memory != p.Argon2Memory || h.threads != p.Argon2Threads
+	}
+	return false
+}
+
+// Replaces the user's password hash if it is outdated. The password must
+// have been checked already.
+func (u *User) upgradePasswordHash(password string) error {
+	p := getConfig().Passwords
+	if !needsRehash(u.Password, u.Salt, p) {
+		return nil
+	}
+	hash, err := hashPassword(password, p)
+	if err != nil {
+		return err
+	}
+	u.Password, u.Salt = hash, nil
+	return getStore().Users().UpdateFields(u, "password", "salt")
+}
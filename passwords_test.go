@@ -0,0 +1,65 @@
+package core
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLongPasswordsAreFullySignificant(t *testing.T) {
+	setupAuthTest(t)
+	long := strings.Repeat("a", 80)
+	for _, algorithm := range []string{Bcrypt, Argon2id} {
+		std.config.Passwords.Algorithm = algorithm
+		hash, err := hashPassword(long+"1", std.config.Passwords)
+		if err != nil {
+			t.Fatal(algorithm, err)
+		}
+		if err := comparePassword(hash, nil, long+"1"); err != nil {
+			t.Error(algorithm, "rejected the right password:", err)
+		}
+		if err := comparePassword(hash, nil, long+"2"); err != WrongPasswordError {
+			t.Error(algorithm, "ignored the end of a long password:", err)
+		}
+	}
+}
+
+func TestPasswordHashUpgradeOnLogin(t *testing.T) {
+	setupAuthTest(t)
+	u := registerTestUser(t, "frank", "plum-Harbor-4242")
+
+	// Hash as stored before versioning, by a bcrypt silently truncating
+	// its input to 72 bytes.
+	u.Salt = getSalt()
+	salted := append([]byte("plum-Harbor-4242"), u.Salt...)
+	u.Password, _ = bcrypt.GenerateFromPassword(salted[:72], bcrypt.MinCost)
+	if err := getStore().Users().Update(u); err != nil {
+		t.Fatal(err)
+	}
+	login := func() *User {
+		l := &User{Username: "frank", EnteredPassword: "plum-Harbor-4242"}
+		if err := l.CheckPassword(); err != nil {
+			t.Fatal("CheckPassword:", err)
+		}
+		u, _ := GetUserByName("frank")
+		return u
+	}
+	u = login()
+	if len(u.Salt) != 0 || !bytes.HasPrefix(u.Password, []byte(bcryptPrefix)) {
+		t.Fatal("Legacy hash not upgraded:", string(u.Password))
+	}
+
+	std.config.Passwords.BcryptCost++
+	if u = login(); needsRehash(u.Password, u.Salt, std.config.Passwords) {
+		t.Error("Hash not upgraded to the new cost")
+	}
+	std.config.Passwords.Algorithm = Argon2id
+	if u = login(); !bytes.HasPrefix(u.Password, []byte(argon2Prefix)) {
+		t.Error("Hash not upgraded to argon2id:", string(u.Password))
+	}
+	if err := (&User{Username: "frank", EnteredPassword: "plum-Harbor-4243"}).CheckPassword(); err != WrongPasswordError {
+		t.Error("Expected WrongPasswordError, got", err)
+	}
+}
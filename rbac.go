@@ -0,0 +1,127 @@
+package core
+
+import (
+	"errors"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var ForbiddenError = errors.New("You are not allowed to do that.")
+var UnknownRoleError = errors.New("Unknown role.")
+
+// Built-in values of User.Role. Custom roles can be added with
+// Client.DefineRole.
+const (
+	RoleUser      = 0
+	RoleModerator = 1
+	RoleAdmin     = 2
+)
+
+// Privileged actions, besides the document and file ones.
+const (
+	ActionChangeOwner    = "documents:change_owner"
+	ActionSetPassword    = "users:set_password"
+	ActionUnlockUser     = "users:unlock"
+	ActionResetTwoFactor = "users:reset_2fa"
+	ActionManageRoles    = "users:manage_roles"
+)
+
+// RoleDef names a role and lists what it allows. Permissions apply to
+// every resource, Own only to the resources the user owns.
+// A permission is an action, such as "documents:write", a family of
+// actions, such as "documents:*", or "*" for everything.
+type RoleDef struct {
+	Name        string
+	Permissions []string
+	Own         []string
+}
+
+// Users can't set their own password without the current one, which
+// ChangePassword asks for, so ActionSetPassword is never among Own.
+func defaultRoles() map[int]RoleDef {
+	own := []string{"documents:*", "files:*"}
+	return map[int]RoleDef{
+		RoleUser: {Name: "user", Own: own},
+		RoleModerator: {
+			Name:        "moderator",
+			Permissions: []string{ActionReadDocuments, ActionWriteDocuments, ActionReadFiles, ActionUnlockUser},
+			Own:         own,
+		},
+		RoleAdmin: {Name: "admin", Permissions: []string{"*"}},
+	}
+}
+
+// DefineRole adds or replaces a role. Users get it by having its value
+// as their Role.
+func (c *Client) DefineRole(role int, def RoleDef) {
+	c.rolesMu.Lock()
+	defer c.rolesMu.Unlock()
+	c.roles[role] = def
+}
+
+// Role returns the definition of a role.
+func (c *Client) Role(role int) (RoleDef, bool) {
+	c.rolesMu.RLock()
+	defer c.rolesMu.RUnlock()
+	def, ok := c.roles[role]
+	return def, ok
+}
+
+// Resource is anything owned by a user, that Authorize can check
+// actions on.
+type Resource interface {
+	OwnerID() bson.ObjectId
+}
+
+// OwnerID makes users the owners of their own account.
+func (u *User) OwnerID() bson.ObjectId { return u.ID }
+
+func (d *Document) OwnerID() bson.ObjectId { return d.Owner }
+
+func (f *File) OwnerID() bson.ObjectId { return f.Owner }
+
+func permits(permissions []string, action string) bool {
+	for _, p := range permissions {
+		if p == "*" || p == action || strings.HasSuffix(p, ":*") && strings.HasPrefix(action, p[:len(p)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize returns ForbiddenError unless the user's role allows the
+// action on the resource. resource may be nil for actions that don't
+// apply to any.
+func Authorize(u *User, action string, resource Resource) error {
+	if u == nil || !u.ID.Valid() {
+		return ForbiddenError
+	}
+	def, ok := std.Role(u.Role)
+	if !ok {
+		return ForbiddenError
+	}
+	if permits(def.Permissions, action) {
+		return nil
+	}
+	if resource != nil && resource.OwnerID() == u.ID && permits(def.Own, action) {
+		return nil
+	}
+	return ForbiddenError
+}
+
+// SetRole gives the user with the given ID another role.
+func (actor *User) SetRole(uid string, role int) error {
+	if _, ok := std.Role(role); !ok {
+		return UnknownRoleError
+	}
+	u, err := GetUserById(uid)
+	if err != nil {
+		return err
+	}
+	if err := Authorize(actor, ActionManageRoles, u); err != nil {
+		return err
+	}
+	u.Role = role
+	return getStore().Users().UpdateFields(u, "role")
+}
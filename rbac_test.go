@@ -0,0 +1,71 @@
+package core
+
+import "testing"
+
+func TestAuthorize(t *testing.T) {
+	setupAuthTest(t)
+	owner := registerTestUser(t, "mallory", "plum-Harbor-42")
+	other := registerTestUser(t, "nina", "plum-Harbor-42")
+	admin := registerTestAdmin(t, "root")
+	doc := &Document{Title: "notes"}
+	if err := owner.AddDocument(doc); err != nil {
+		t.Fatal("AddDocument:", err)
+	}
+
+	if err := Authorize(owner, ActionWriteDocuments, doc); err != nil {
+		t.Error("Owner can't write their document:", err)
+	}
+	if err := Authorize(other, ActionWriteDocuments, doc); err != ForbiddenError {
+		t.Error("Other user can write the document:", err)
+	}
+	if err := Authorize(nil, ActionReadDocuments, doc); err != ForbiddenError {
+		t.Error("Anonymous user can read the document:", err)
+	}
+	if err := doc.ChangeOwner(other, other); err != ForbiddenError {
+		t.Error("Document taken by another user:", err)
+	}
+	if err := doc.ChangeOwner(owner, other); err != nil || doc.Owner != other.ID {
+		t.Error("Owner can't give the document away:", err)
+	}
+
+	if err := other.SetUserPassword(owner.ID.Hex(), "Fresh-Lemon-Tree-7"); err != ForbiddenError {
+		t.Error("Password of another user changed:", err)
+	}
+	if err := owner.SetUserPassword(owner.ID.Hex(), "Fresh-Lemon-Tree-7"); err != ForbiddenError {
+		t.Error("Own password set without the current one:", err)
+	}
+	if err := admin.SetUserPassword(owner.ID.Hex(), "Fresh-Lemon-Tree-7"); err != nil {
+		t.Error("Admin can't set a password:", err)
+	}
+	if err := owner.ChangePassword("plum-Harbor-42", "Other-Lemon-Tree-8"); err != WrongPasswordError {
+		t.Error("Password changed without the current one:", err)
+	}
+	if err := owner.ChangePassword("Fresh-Lemon-Tree-7", "Other-Lemon-Tree-8"); err != nil {
+		t.Error("ChangePassword:", err)
+	}
+
+	// Moderators can unlock users but not manage roles.
+	if err := admin.SetRole(other.ID.Hex(), RoleModerator); err != nil {
+		t.Fatal("SetRole:", err)
+	}
+	other.Sync()
+	if err := other.UnlockUser(owner.ID.Hex()); err != nil {
+		t.Error("Moderator can't unlock:", err)
+	}
+	if err := other.SetRole(other.ID.Hex(), RoleAdmin); err != ForbiddenError {
+		t.Error("Moderator promoted themselves:", err)
+	}
+
+	std.DefineRole(10, RoleDef{Name: "archivist", Permissions: []string{"documents:*"}})
+	defer delete(std.roles, 10)
+	if err := admin.SetRole(owner.ID.Hex(), 10); err != nil {
+		t.Fatal("SetRole with a custom role:", err)
+	}
+	owner.Sync()
+	if err := Authorize(owner, ActionChangeOwner, &Document{Owner: admin.ID}); err != nil {
+		t.Error("Custom role permission not granted:", err)
+	}
+	if err := admin.SetRole(owner.ID.Hex(), 11); err != UnknownRoleError {
+		t.Error("Undefined role given:", err)
+	}
+}
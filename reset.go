@@ -0,0 +1,116 @@
+package core
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var InvalidResetTokenError = errors.New("Invalid or expired password reset link.")
+
+// PasswordReset is a single-use, time-limited token letting a user choose
+// a new password. Only its hash is stored.
+type PasswordReset struct {
+	ID        bson.ObjectId `bson:"_id"               json:"-"`
+	User      bson.ObjectId `bson:"user"              json:"-"`
+	TokenHash []byte        `bson:"hash"              json:"-"`
+	Created   time.Time     `bson:"created"           json:"-"`
+	ExpiresAt time.Time     `bson:"expires"           json:"-"`
+	Used      time.Time     `bson:"used_at,omitempty" json:"-"`
+	// PendingMail holds the email with the link, until it is moved to the
+	// outbox.
+	PendingMail []OutboxMessage `bson:"pending_mail,omitempty" json:"-"`
+}
+
+// Builds an absolute link to a page of the web application.
+func appLink(path string, params url.Values) string {
+	return strings.TrimRight(getConfig().BaseURL, "/") + path + "?" + params.Encode()
+}
+
+// RequestPasswordReset emails a password reset link to the user with the
+// given address. It returns nil whether or not such a user exists, so that
+// it can't be used to find out who is registered.
+func RequestPasswordReset(email string) error {
+	u, err := getStore().Users().FindByEmail(email)
+	if err == NotFoundError {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = u.createPasswordReset()
+	if err == SuppressedAddressError {
+		return nil
+	}
+	return err
+}
+
+// Stores a new reset token for the user, with the email sending it, and
+// returns it.
+func (u *User) createPasswordReset() (string, error) {
+	raw := RandomUrlencodedString(32)
+	m, err := u.passwordResetMail(raw, getConfig().PasswordResetTTL)
+	if err != nil {
+		return "", err
+	}
+	now := timeNow()
+	r := &PasswordReset{
+		ID:          bson.NewObjectId(),
+		User:        u.ID,
+		TokenHash:   hashToken(raw),
+		Created:     now,
+		ExpiresAt:   now.Add(getConfig().PasswordResetTTL),
+		PendingMail: []OutboxMessage{*m},
+	}
+	return raw, getStore().PasswordResets().Insert(r)
+}
+
+func (u *User) passwordResetMail(raw string, ttl time.Duration) (*OutboxMessage, error) {
+	return renderMail(TemplatePasswordReset, u.Email, u.Locale, map[string]interface{}{
+		"Username": u.Username,
+		"Link":     appLink("/#/password/reset", url.Values{"token": {raw}}),
+		"TTL":      ttl,
+	})
+}
+
+// ResetPassword sets a new password for the owner of the reset token.
+// The token is consumed, any other pending reset token of the user is
+// invalidated, every session is revoked and any lockout is lifted.
+// A password rejected by validation doesn't consume the token.
+func ResetPassword(token, newPassword string) error {
+	resets := getStore().PasswordResets()
+	hash := hashToken(token)
+	now := timeNow()
+	r, err := resets.FindByHash(hash)
+	if err == NotFoundError || err == nil && (!r.Used.IsZero() || !r.ExpiresAt.After(now)) {
+		return InvalidResetTokenError
+	}
+	if err != nil {
+		return err
+	}
+	u := &User{ID: r.User}
+	if err := u.Sync(); err != nil {
+		return InvalidResetTokenError
+	}
+	if err := u.setPassword(newPassword); err != nil {
+		return err
+	}
+	if _, err := resets.Consume(hash, now); err == NotFoundError {
+		return InvalidResetTokenError
+	} else if err != nil {
+		return err
+	}
+	u.HasPassword = true
+	u.FailedLogins, u.Lockouts, u.LockedUntil = 0, 0, time.Time{}
+	err = getStore().Users().UpdateFields(u, "password", "salt", "has_password", "fails", "lockouts", "locked_until")
+	if err != nil {
+		return err
+	}
+	if err := resets.RemoveAll(u.ID); err != nil {
+		return err
+	}
+	return u.RevokeAllSessions()
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"crypto/sha256"
+	"errors"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var InvalidRefreshTokenError = errors.New("Invalid or expired refresh token.")
+var RefreshTokenReusedError = errors.New("Refresh token already used, session revoked.")
+
+// Session is a device a user is signed in from. It is authenticated by a
+// long-lived refresh token, of which only the hash is stored. Every use
+// rotates the token; presenting a rotated token again revokes the session,
+// as it means the token was stolen.
+type Session struct {
+	ID             bson.ObjectId `bson:"_id"       json:"sessionID"`
+	User           bson.ObjectId `bson:"user"      json:"-"`
+	Device         string        `bson:"device"    json:"device"`
+	Created        time.Time     `bson:"created"   json:"created"`
+	LastUsed       time.Time     `bson:"last_used" json:"lastUsed"`
+	ExpiresAt      time.Time     `bson:"expires"   json:"expires"`
+	TokenHash      []byte        `bson:"hash"      json:"-"`
+	PreviousHashes [][]byte      `bson:"previous"  json:"-"`
+}
+
+func hashToken(raw string) []byte {
+	h := sha256.Sum256([]byte(raw))
+	return h[:]
+}
+
+// NewSession signs the user in from the named device and returns the
+// refresh token of the new session. The token is not stored anywhere and
+// can't be recovered.
+func (u *User) NewSession(device string) (string, *Session, error) {
+	raw := RandomUrlencodedString(32)
+	now := timeNow()
+	s := &Session{
+		ID:        bson.NewObjectId(),
+		User:      u.ID,
+		Device:    device,
+		Created:   now,
+		LastUsed:  now,
+		ExpiresAt: now.Add(getConfig().Tokens.RefreshTTL),
+		TokenHash: hashToken(raw),
+	}
+	if err := getStore().Sessions().Insert(s); err != nil {
+		return "", nil, err
+	}
+	return raw, s, nil
+}
+
+// RefreshSession exchanges a refresh token for a new one, and returns the
+// session's user so that a new access token can be issued for them.
+// Reusing an already rotated token revokes the whole session.
+func RefreshSession(raw string) (*User, string, error) {
+	sessions := getStore().Sessions()
+	hash := hashToken(raw)
+	now := timeNow()
+	s, err := sessions.FindByHash(hash)
+	if err == NotFoundError {
+		if reused, err := sessions.FindByPreviousHash(hash); err == nil {
+			sessions.Remove(reused.User, reused.ID)
+			return nil, "", RefreshTokenReusedError
+		}
+		return nil, "", InvalidRefreshTokenError
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if !s.ExpiresAt.After(now) {
+		return nil, "", InvalidRefreshTokenError
+	}
+	u := &User{ID: s.User}
+	if err := u.Sync(); err != nil {
+		return nil, "", InvalidRefreshTokenError
+	}
+	next := RandomUrlencodedString(32)
+	err = sessions.Rotate(s.ID, hash, hashToken(next), now, now.Add(getConfig().Tokens.RefreshTTL))
+	if err == NotFoundError {
+		// Rotated concurrently: the same token was presented twice.
+		sessions.Remove(s.User, s.ID)
+		return nil, "", RefreshTokenReusedError
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return u, next, nil
+}
+
+// Sessions lists the devices the user is currently signed in from.
+func (u *User) Sessions() ([]Session, error) {
+	return getStore().Sessions().FindByUser(u.ID, timeNow())
+}
+
+// RevokeSession signs the user out of one device.
+func (u *User) RevokeSession(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return NotFoundError
+	}
+	return getStore().Sessions().Remove(u.ID, bson.ObjectIdHex(id))
+}
+
+// RevokeAllSessions signs the user out of every device.
+func (u *User) RevokeAllSessions() error {
+	return getStore().Sessions().RemoveAll(u.ID)
+}
@@ -0,0 +1,250 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var NotFoundError = errors.New("Not found.")
+var DuplicateKeyError = errors.New("Duplicate key.")
+
+// Store is the persistence backend used throughout the package.
+// Every store returns NotFoundError when a lookup matches nothing and
+// DuplicateKeyError when an insert violates a unique constraint.
+type Store interface {
+	Users() UserStore
+	Documents() DocumentStore
+	SignupCodes() SignupCodeStore
+	Subscribers() SubscriberStore
+	Files() FileStore
+	LoginAttempts() LoginAttemptStore
+	Sessions() SessionStore
+	PasswordResets() PasswordResetStore
+	APIKeys() APIKeyStore
+	Waitlist() WaitlistStore
+	Outbox() OutboxStore
+	MailEvents() MailEventStore
+	Suppressions() SuppressionStore
+	PendingMail() PendingMailStore
+	// EnsureSchema creates indexes and any other server-side structure.
+	// It must be idempotent.
+	EnsureSchema(ctx context.Context) error
+	Close() error
+}
+
+type UserStore interface {
+	FindByID(id bson.ObjectId) (*User, error)
+	FindByUsername(username string) (*User, error)
+	FindByEmail(email string) (*User, error)
+	// FindAllByEmailFold returns every user with the address, whatever
+	// its case.
+	FindAllByEmailFold(email string) ([]User, error)
+	FindByVerificationCode(code string) (*User, error)
+	FindByGoogleOAuthSub(sub string) (*User, error)
+	FindByIdentity(provider, subject string) (*User, error)
+	// Insert assigns a new ID to the user if it has none.
+	Insert(u *User) error
+	// Update overwrites the stored user with the same ID.
+	Update(u *User) error
+	// UpdateFields overwrites only the given fields, by their bson names,
+	// of the stored user with the same ID, leaving the others as they are.
+	UpdateFields(u *User, fields ...string) error
+	// UpdateFieldsWithMail is UpdateFields also adding the message to the
+	// pending mail of the user, in the same write.
+	UpdateFieldsWithMail(u *User, m *OutboxMessage, fields ...string) error
+	Remove(id bson.ObjectId) error
+	// RecordLogin sets the last login time and clears the failed logins
+	// counter and any lockout.
+	RecordLogin(id bson.ObjectId, at time.Time) error
+	// IncFailedLogins atomically increments the failed logins counter and
+	// returns its new value.
+	IncFailedLogins(id bson.ObjectId) (int, error)
+	// Lock locks the account until the given time, increments the lockouts
+	// counter and clears the failed logins counter.
+	Lock(id bson.ObjectId, until time.Time) error
+	// Unlock clears the lock and both counters.
+	Unlock(id bson.ObjectId) error
+	// ReserveInvite atomically increments the counter of invitations sent
+	// if it is below allowance, and returns NotFoundError otherwise.
+	ReserveInvite(id bson.ObjectId, allowance int) error
+	// ReleaseInvite decrements the counter of invitations sent, if positive.
+	ReleaseInvite(id bson.ObjectId) error
+}
+
+type DocumentStore interface {
+	FindByOwner(owner bson.ObjectId) ([]Document, error)
+	FindByID(owner, id bson.ObjectId) (*Document, error)
+	Insert(d *Document) error
+	// Update overwrites the stored document with the same ID and owner.
+	Update(d *Document) error
+	Remove(owner, id bson.ObjectId) error
+	AddChild(owner, parent, child bson.ObjectId) error
+	ChangeOwner(id, from, to bson.ObjectId) error
+	// TransferAll moves every document owned by from to the user to.
+	TransferAll(from, to bson.ObjectId) error
+}
+
+type SignupCodeStore interface {
+	// Insert returns DuplicateKeyError if the code is taken.
+	Insert(s *SignupCode) error
+	FindByCode(code string) ([]SignupCode, error)
+	// List returns the codes with the given label, or every code if label
+	// is empty, newest first.
+	List(label string) ([]SignupCode, error)
+	// FindByCreator returns the codes the user created, newest first.
+	FindByCreator(creator bson.ObjectId) ([]SignupCode, error)
+	// Claim atomically records the redemption on a code that is usable by
+	// r.Email at r.At, and returns the code. It returns NotFoundError if
+	// there is none.
+	Claim(code string, r Redemption) (*SignupCode, error)
+	// Release undoes a redemption recorded by Claim, and clears the time
+	// the code was last used.
+	Release(id bson.ObjectId, r Redemption) error
+	Revoke(id bson.ObjectId, at time.Time) error
+}
+
+type SubscriberStore interface {
+	Add(email string) error
+}
+
+type FileStore interface {
+	FindByOwner(owner bson.ObjectId) ([]File, error)
+	FindByID(owner, id bson.ObjectId) (*File, error)
+	Insert(f *File) error
+	Remove(owner, id bson.ObjectId) error
+}
+
+type LoginAttemptStore interface {
+	Insert(a *LoginAttempt) error
+	// FindByUser returns up to limit attempts on the user's account made
+	// since the given time, newest first.
+	FindByUser(user bson.ObjectId, since time.Time, limit int) ([]LoginAttempt, error)
+	// FindByIp returns up to limit attempts made from the given address
+	// since the given time, newest first.
+	FindByIp(ip string, since time.Time, limit int) ([]LoginAttempt, error)
+}
+
+type SessionStore interface {
+	Insert(s *Session) error
+	FindByHash(hash []byte) (*Session, error)
+	// FindByPreviousHash finds the session a rotated token belonged to.
+	FindByPreviousHash(hash []byte) (*Session, error)
+	// Rotate atomically replaces the token hash of the session, provided
+	// it is still oldHash, and extends its expiry. It returns NotFoundError
+	// otherwise.
+	Rotate(id bson.ObjectId, oldHash, newHash []byte, at, expires time.Time) error
+	// FindByUser lists the user's sessions not expired at the given time.
+	FindByUser(user bson.ObjectId, at time.Time) ([]Session, error)
+	Remove(user, id bson.ObjectId) error
+	RemoveAll(user bson.ObjectId) error
+}
+
+type PasswordResetStore interface {
+	Insert(r *PasswordReset) error
+	FindByHash(hash []byte) (*PasswordReset, error)
+	// Consume atomically marks the unused, unexpired reset with the given
+	// hash as used. It returns NotFoundError if there is none.
+	Consume(hash []byte, at time.Time) (*PasswordReset, error)
+	RemoveAll(user bson.ObjectId) error
+}
+
+type APIKeyStore interface {
+	Insert(k *APIKey) error
+	FindByHash(hash []byte) (*APIKey, error)
+	FindByUser(user bson.ObjectId) ([]APIKey, error)
+	// Touch records that the key was used at the given time.
+	Touch(id bson.ObjectId, at time.Time) error
+	Remove(user, id bson.ObjectId) error
+}
+
+// SetStore replaces the backend of the default client.
+// It is meant to be called once, before serving any request.
+func SetStore(s Store) {
+	std.store = s
+}
+
+func getStore() Store {
+	return std.store
+}
+
+// Splits the given fields of the document into the ones to set and the
+// ones to unset, which are the zero omitempty fields.
+func fieldUpdate(v interface{}, fields []string) (bson.M, bson.M) {
+	doc := bson.M{}
+	raw, err := bson.Marshal(v)
+	check(err)
+	check(bson.Unmarshal(raw, doc))
+	set, unset := bson.M{}, bson.M{}
+	for _, f := range fields {
+		if v, ok := doc[f]; ok {
+			set[f] = v
+		} else {
+			unset[f] = ""
+		}
+	}
+	return set, unset
+}
+
+type WaitlistStore interface {
+	// Insert returns DuplicateKeyError if the address is already listed.
+	Insert(e *WaitlistEntry) error
+	FindByEmail(email string) (*WaitlistEntry, error)
+	FindByHash(hash []byte) (*WaitlistEntry, error)
+	Update(e *WaitlistEntry) error
+	// UpdateFields overwrites only the given fields, by their bson names,
+	// of the stored entry with the same ID.
+	UpdateFields(e *WaitlistEntry, fields ...string) error
+	// UpdateFieldsWithMail is UpdateFields also adding the message to the
+	// pending mail of the entry, in the same write.
+	UpdateFieldsWithMail(e *WaitlistEntry, m *OutboxMessage, fields ...string) error
+	// List returns every entry, in the order they joined.
+	List() ([]WaitlistEntry, error)
+	// MarkInvited atomically records that an entry not invited yet was
+	// given the code, adding the invitation to its pending mail if not nil.
+	// It returns NotFoundError if the entry was invited.
+	MarkInvited(id, code bson.ObjectId, at time.Time, invitation *OutboxMessage) error
+}
+
+type OutboxStore interface {
+	Insert(m *OutboxMessage) error
+	// ClaimDue atomically takes the message due the earliest, the oldest
+	// one among those due at the same time, if by the given time, marking
+	// it as sending until lease. Messages whose lease expired are due
+	// again. It returns NotFoundError if none is due.
+	ClaimDue(at, lease time.Time) (*OutboxMessage, error)
+	Update(m *OutboxMessage) error
+	FindByProviderID(id string) (*OutboxMessage, error)
+	// List returns up to limit messages with the given status, or with any
+	// status if it is empty, newest first.
+	List(status string, limit int) ([]OutboxMessage, error)
+	// Requeue makes a dead, sent or suppressed message pending again, due
+	// at the given time. It returns NotFoundError for messages in any other
+	// state.
+	Requeue(id bson.ObjectId, at time.Time) error
+}
+
+// PendingMailStore reaches the emails saved on the documents whose change
+// triggered them, waiting to be moved to the outbox.
+type PendingMailStore interface {
+	// Find returns up to limit pending emails, of any kind of document.
+	Find(limit int) ([]PendingMail, error)
+	// Remove takes the email off the document it is saved on.
+	Remove(p *PendingMail) error
+}
+
+type MailEventStore interface {
+	Insert(e *MailEvent) error
+	// FindByMessage returns the events of an outbox message, oldest first.
+	FindByMessage(id bson.ObjectId) ([]MailEvent, error)
+}
+
+type SuppressionStore interface {
+	// Add inserts the suppression, or replaces the one of the same address.
+	Add(s *Suppression) error
+	Find(email string) (*Suppression, error)
+	Remove(email string) error
+	List() ([]Suppression, error)
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMemoryStoreUserLifecycle(t *testing.T) {
+	SetStore(NewMemoryStore())
+
+	u := new(User)
+	err := u.Register(User{Username: "alice", Email: "alice@example.com", EnteredPassword: "plum-Harbor-42"})
+	if err != nil {
+		t.Fatal("Register:", err)
+	}
+	if !u.ID.Valid() {
+		t.Fatal("Registered user has no ID")
+	}
+	if err := new(User).Register(User{Username: "alice", Email: "a@example.com", EnteredPassword: "gravel-Otter-19"}); err != UsernameAlreadyTakenError {
+		t.Error("Expected UsernameAlreadyTakenError, got", err)
+	}
+
+	login := &User{Username: "alice", EnteredPassword: "plum-Harbor-42"}
+	if err := login.CheckPassword(); err != nil {
+		t.Error("CheckPassword with the right password:", err)
+	}
+	if login.ID != u.ID {
+		t.Error("CheckPassword didn't load the stored user")
+	}
+	wrong := &User{Username: "alice", EnteredPassword: "plum-Harbor-43"}
+	if err := wrong.CheckPassword(); err == nil {
+		t.Error("CheckPassword accepted a wrong password")
+	}
+
+	doc := &Document{Url: "http://www.goquadro.com", Title: "GoQuadro"}
+	if err := u.AddDocument(doc); err != nil {
+		t.Fatal("AddDocument:", err)
+	}
+	docs, err := u.Documents()
+	if err != nil || len(*docs) != 1 {
+		t.Fatal("Documents:", len(*docs), err)
+	}
+	if _, err := u.GetDocumentById(doc.ID.Hex()); err != nil {
+		t.Error("GetDocumentById:", err)
+	}
+	other := new(User)
+	if _, err := other.GetDocumentById(doc.ID.Hex()); err != NotFoundError {
+		t.Error("Expected NotFoundError for another user's document, got", err)
+	}
+	if err := u.DeleteDocument(doc); err != nil {
+		t.Error("DeleteDocument:", err)
+	}
+}
+
+func TestMemoryStoreUpdateFields(t *testing.T) {
+	SetStore(NewMemoryStore())
+	users := getStore().Users()
+	u := &User{Username: "alice", Email: "alice@example.com", FailedLogins: 2, TOTPSecret: "SECRET"}
+	if err := users.Insert(u); err != nil {
+		t.Fatal("Insert:", err)
+	}
+	stale := *u
+	if _, err := users.IncFailedLogins(u.ID); err != nil {
+		t.Fatal("IncFailedLogins:", err)
+	}
+	stale.Email, stale.TOTPSecret = "alice@example.org", ""
+	if err := users.UpdateFields(&stale, "email", "totp_secret"); err != nil {
+		t.Fatal("UpdateFields:", err)
+	}
+	stored, _ := users.FindByID(u.ID)
+	if stored.Email != "alice@example.org" || stored.TOTPSecret != "" || stored.FailedLogins != 3 || stored.Username != "alice" {
+		t.Fatalf("Unexpected user %+v", stored)
+	}
+	if err := users.UpdateFields(&User{ID: bson.NewObjectId()}, "email"); err != NotFoundError {
+		t.Fatal("Expected NotFoundError, got", err)
+	}
+}
+
+func TestMemoryStoreWaitlistUpdateFields(t *testing.T) {
+	SetStore(NewMemoryStore())
+	entries := getStore().Waitlist()
+	e := &WaitlistEntry{ID: bson.NewObjectId(), Email: "alice@example.com", TokenHash: []byte("hash")}
+	if err := entries.Insert(e); err != nil {
+		t.Fatal("Insert:", err)
+	}
+	stale := *e
+	code := bson.NewObjectId()
+	if err := entries.MarkInvited(e.ID, code, time.Now(), nil); err != nil {
+		t.Fatal("MarkInvited:", err)
+	}
+	stale.TokenHash = nil
+	msg := &OutboxMessage{ID: bson.NewObjectId(), Message: Message{To: e.Email}}
+	if err := entries.UpdateFieldsWithMail(&stale, msg, "hash"); err != nil {
+		t.Fatal("UpdateFieldsWithMail:", err)
+	}
+	stored, _ := entries.FindByEmail(e.Email)
+	if stored.TokenHash != nil || stored.Code != code || stored.Invited.IsZero() ||
+		len(stored.PendingMail) != 1 || stored.PendingMail[0].ID != msg.ID {
+		t.Fatalf("Unexpected entry %+v", stored)
+	}
+}
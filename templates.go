@@ -0,0 +1,261 @@
+package core
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// The templates shipped with the package, used unless Config.TemplateDir
+// names a directory laid out the same way.
+//
+//go:embed templates
+var embeddedTemplates embed.FS
+
+// Emails the package sends.
+const (
+	TemplateWelcome              = "welcome"
+	TemplateVerification         = "verification"
+	TemplatePasswordReset        = "password_reset"
+	TemplateInvitation           = "invitation"
+	TemplateWaitlistVerification = "waitlist_verification"
+	TemplateShare                = "share"
+)
+
+// Templates renders the package's emails.
+//
+// Each email is made of NAME.txt, which must define the "subject" and
+// "content" templates, and optionally NAME.html, defining "content" for
+// the HTML part. They are rendered within layout.txt and layout.html,
+// which can declare other blocks, such as "footer", for emails to override.
+//
+// Templates get their wording from the message catalogs, through the
+// functions of a Localizer: {{t "key" args...}}, {{n "key" count args...}},
+// {{date time}} and {{locale}}.
+type Templates struct {
+	text map[string]*texttemplate.Template
+	html map[string]*htmltemplate.Template
+}
+
+// LoadTemplates parses every email found in fsys, such as os.DirFS(dir).
+// Rendering fails if a template uses data it wasn't given.
+func LoadTemplates(fsys fs.FS) (*Templates, error) {
+	names, err := fs.Glob(fsys, "*.txt")
+	if err != nil {
+		return nil, err
+	}
+	t := &Templates{
+		text: map[string]*texttemplate.Template{},
+		html: map[string]*htmltemplate.Template{},
+	}
+	for _, file := range names {
+		name := strings.TrimSuffix(file, ".txt")
+		if name == "layout" {
+			continue
+		}
+		text, err := texttemplate.New("layout.txt").Option("missingkey=error").Funcs(templateFuncs(&Localizer{})).ParseFS(fsys, "layout.txt", file)
+		if err != nil {
+			return nil, err
+		}
+		if text.Lookup("subject") == nil {
+			return nil, fmt.Errorf("%s: no subject defined", file)
+		}
+		t.text[name] = text
+		if _, err := fs.Stat(fsys, name+".html"); err != nil {
+			continue
+		}
+		html, err := htmltemplate.New("layout.html").Option("missingkey=error").Funcs(templateFuncs(&Localizer{})).ParseFS(fsys, "layout.html", name+".html")
+		if err != nil {
+			return nil, err
+		}
+		t.html[name] = html
+	}
+	return t, nil
+}
+
+// DefaultTemplates returns the templates shipped with the package.
+func DefaultTemplates() *Templates {
+	sub, err := fs.Sub(embeddedTemplates, "templates")
+	check(err)
+	t, err := LoadTemplates(sub)
+	check(err)
+	return t
+}
+
+// Loads the templates of Config.TemplateDir, or the default ones.
+func loadConfiguredTemplates(dir string) (*Templates, error) {
+	if dir == "" {
+		return DefaultTemplates(), nil
+	}
+	return LoadTemplates(os.DirFS(dir))
+}
+
+// Names lists the emails that can be rendered.
+func (t *Templates) Names() []string {
+	names := make([]string, 0, len(t.text))
+	for name := range t.text {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func templateFuncs(l *Localizer) map[string]interface{} {
+	return map[string]interface{}{
+		"t":      l.T,
+		"n":      l.N,
+		"date":   l.Date,
+		"locale": l.Locale,
+	}
+}
+
+// Render returns the email with the given data, in the language of l.
+// Only the sender and recipient are left to set.
+func (t *Templates) Render(name string, l *Localizer, data interface{}) (*Message, error) {
+	parsed, ok := t.text[name]
+	if !ok {
+		return nil, fmt.Errorf("no email template named %q", name)
+	}
+	// The parsed templates are never executed, so that they can be cloned
+	// and bound to each localizer.
+	text := texttemplate.Must(parsed.Clone()).Funcs(templateFuncs(l))
+	var subject, body bytes.Buffer
+	if err := text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := text.ExecuteTemplate(&body, "layout.txt", data); err != nil {
+		return nil, err
+	}
+	m := &Message{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    strings.TrimSpace(body.String()) + "\n",
+	}
+	if parsed, ok := t.html[name]; ok {
+		html, err := parsed.Clone()
+		if err != nil {
+			return nil, err
+		}
+		html.Funcs(templateFuncs(l))
+		var buf bytes.Buffer
+		if err := html.ExecuteTemplate(&buf, "layout.html", data); err != nil {
+			return nil, err
+		}
+		m.HTML = buf.String()
+	}
+	return m, nil
+}
+
+// Data the previews are rendered with.
+var templateSamples = map[string]map[string]interface{}{
+	TemplateWelcome: {
+		"Username": "jane",
+		"Link":     "https://www.goquadro.com/#/verify?code=sample",
+	},
+	TemplateVerification: {
+		"Username": "jane",
+		"Link":     "https://www.goquadro.com/#/verify?code=sample",
+		"TTL":      72 * time.Hour,
+	},
+	TemplatePasswordReset: {
+		"Username": "jane",
+		"Link":     "https://www.goquadro.com/#/password/reset?token=sample",
+		"TTL":      time.Hour,
+	},
+	TemplateInvitation: {
+		"Inviter": "jane",
+		"Link":    "https://www.goquadro.com/#/signup?code=SAMPLE",
+		"Expires": time.Date(2015, 3, 15, 0, 0, 0, 0, time.UTC),
+	},
+	TemplateWaitlistVerification: {
+		"Link": "https://www.goquadro.com/#/waitlist/verify?token=sample",
+	},
+	TemplateShare: {
+		"Sharer": "jane",
+		"Title":  "Quarterly report",
+		"Link":   "https://www.goquadro.com/#/docs/sample",
+	},
+}
+
+// Preview renders an email with sample data, in the language of l.
+func (t *Templates) Preview(name string, l *Localizer) (*Message, error) {
+	return t.Render(name, l, templateSamples[name])
+}
+
+// PreviewHandler serves the emails rendered with sample data, for
+// designers: /NAME shows the HTML part and /NAME.txt the plain one, in
+// the language given by the lang parameter.
+// Templates and catalogs are read again from templateDir and localeDir on
+// every request, each defaulting to the embedded ones if empty.
+func PreviewHandler(templateDir, localeDir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, err := loadConfiguredTemplates(templateDir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		catalogs, err := loadConfiguredCatalogs(localeDir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		l := newLocalizer(catalogs, r.URL.Query().Get("lang"), "en")
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if name == "" {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprintln(w, "<ul>")
+			for _, n := range t.Names() {
+				fmt.Fprintf(w, "<li><a href=\"%[1]s?%[2]s\">%[1]s</a> (<a href=\"%[1]s.txt?%[2]s\">text</a>)</li>\n", htmltemplate.HTMLEscapeString(n), htmltemplate.HTMLEscapeString(r.URL.RawQuery))
+			}
+			fmt.Fprintln(w, "</ul>")
+			return
+		}
+		plain := strings.HasSuffix(name, ".txt")
+		m, err := t.Preview(strings.TrimSuffix(name, ".txt"), l)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if plain || m.HTML == "" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintf(w, "Subject: %s\n\n%s", m.Subject, m.Text)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, m.HTML)
+	})
+}
+
+// Renders a template in the language of locale, falling back to the
+// default one, into a message from the notification address, to be saved
+// along the change that triggers it.
+func renderMail(name, recipient, locale string, data interface{}) (*OutboxMessage, error) {
+	t, err := std.getTemplates()
+	if err != nil {
+		return nil, err
+	}
+	m, err := t.Render(name, Localize(locale), data)
+	if err != nil {
+		return nil, err
+	}
+	m.From = getConfig().NotificationAddress
+	m.To = recipient
+	return newOutboxMessage(name, m)
+}
+
+// Renders a template like renderMail and queues it, for emails no stored
+// change triggers.
+func sendTemplate(name, recipient, locale string, data interface{}) error {
+	m, err := renderMail(name, recipient, locale, data)
+	if err != nil {
+		return err
+	}
+	return getStore().Outbox().Insert(m)
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDefaultTemplates(t *testing.T) {
+	templates := DefaultTemplates()
+	for name := range templateSamples {
+		m, err := templates.Preview(name, Localize(""))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if m.Subject == "" || m.Text == "" || m.HTML == "" {
+			t.Errorf("%s: incomplete message %+v", name, m)
+		}
+		if !strings.Contains(m.HTML, "<html lang=\"en\">") || !strings.Contains(m.Text, "The GoQuadro team") {
+			t.Errorf("%s: layout not applied", name)
+		}
+	}
+	if len(templates.Names()) != len(templateSamples) {
+		t.Error("Templates without sample data:", templates.Names())
+	}
+	if _, err := templates.Render(TemplateVerification, Localize(""), map[string]interface{}{"Username": "jane"}); err == nil {
+		t.Error("Rendered with missing data")
+	}
+}
+
+func TestWelcomeEmail(t *testing.T) {
+	setupAuthTest(t)
+	u := registerTestUser(t, "jane", "plum-Harbor-42")
+	if err := u.SendConfirmationEmail(); err != nil {
+		t.Fatal("SendConfirmationEmail:", err)
+	}
+	var welcome *Message
+	for _, m := range sentMail() {
+		if m.Subject == "You just registered on GoQuadro" {
+			welcome = &m
+		}
+	}
+	if welcome == nil {
+		t.Fatal("No welcome email sent")
+	}
+	if !strings.Contains(welcome.Text, "Hi, jane!") || !strings.Contains(welcome.Text, u.verificationLink()) {
+		t.Error("Unexpected welcome email:", welcome.Text)
+	}
+	if !strings.Contains(welcome.HTML, u.verificationLink()) {
+		t.Error("No verification link in the HTML part:", welcome.HTML)
+	}
+}
+
+func TestTemplateDir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"layout.txt":  `{{block "content" .}}{{end}}{{block "footer" .}} -- default{{end}}`,
+		"layout.html": `<html>{{block "content" .}}{{end}}</html>`,
+		"hello.txt":   `{{define "subject"}}Hi {{.Name}}{{end}}{{define "content"}}Hello, {{.Name}}.{{end}}{{define "footer"}} -- custom{{end}}`,
+		"hello.html":  `{{define "content"}}<b>{{.Name}}</b>{{end}}`,
+		"plain.txt":   `{{define "subject"}}Plain{{end}}{{define "content"}}Text only.{{end}}`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	templates, err := LoadTemplates(os.DirFS(dir))
+	if err != nil {
+		t.Fatal("LoadTemplates:", err)
+	}
+	m, err := templates.Render("hello", Localize(""), map[string]string{"Name": "<Jane>"})
+	if err != nil {
+		t.Fatal("Render:", err)
+	}
+	if m.Subject != "Hi <Jane>" || m.Text != "Hello, <Jane>. -- custom\n" || m.HTML != "<html><b>&lt;Jane&gt;</b></html>" {
+		t.Errorf("Unexpected message: %+v", m)
+	}
+	if m, _ := templates.Render("plain", Localize(""), nil); m.HTML != "" || m.Text != "Text only. -- default\n" {
+		t.Errorf("Unexpected message: %+v", m)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "broken.txt"), []byte(`{{define "content"}}No subject{{end}}`), 0600)
+	if _, err := LoadTemplates(os.DirFS(dir)); err == nil {
+		t.Error("Loaded a template without subject")
+	}
+	cfg := DefaultConfig()
+	cfg.TemplateDir = dir
+	if err, ok := cfg.Validate().(*ConfigError); !ok || !strings.Contains(strings.Join(err.Problems, ";"), "template_dir") {
+		t.Error("Broken template_dir not reported:", err)
+	}
+}
+
+func TestPreviewHandler(t *testing.T) {
+	h := PreviewHandler("", "")
+	for path, want := range map[string]string{
+		"/":                 `href="password_reset?`,
+		"/password_reset":   "<a href=\"https://www.goquadro.com/#/password/reset?token=sample\">",
+		"/invitation.txt":   "Subject: jane invited you to GoQuadro",
+		"/no_such_template": "no email template",
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("%s: expected %q in\n%s", path, want, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var InvalidTokenError = errors.New("Invalid token.")
+var TokenExpiredError = errors.New("Token expired.")
+var UnknownTokenKeyError = errors.New("Token signed with an unknown key.")
+
+// Signing algorithms supported by TokenIssuer, as named in the JWT header.
+const (
+	HS256 = "HS256"
+	EdDSA = "EdDSA"
+)
+
+// TokenConfig holds the claims checked on every access token.
+type TokenConfig struct {
+	Issuer   string        `config:"issuer"   env:"QDOC_TOKEN_ISSUER"`
+	Audience string        `config:"audience" env:"QDOC_TOKEN_AUDIENCE"`
+	TTL      time.Duration `config:"ttl"      env:"QDOC_TOKEN_TTL"`
+	// Leeway tolerates clock skew between issuer and verifier.
+	Leeway time.Duration `config:"leeway" env:"QDOC_TOKEN_LEEWAY"`
+	// RefreshTTL is how long an unused session lasts.
+	RefreshTTL time.Duration `config:"refresh_ttl" env:"QDOC_REFRESH_TOKEN_TTL"`
+}
+
+// SigningKey is a key a TokenIssuer can sign or verify tokens with,
+// identified by the `kid` header of the tokens.
+type SigningKey struct {
+	ID         string
+	Algorithm  string
+	secret     []byte
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+// NewHS256Key returns an HMAC-SHA256 key. The secret should be at least
+// 32 random bytes.
+func NewHS256Key(kid string, secret []byte) SigningKey {
+	return SigningKey{ID: kid, Algorithm: HS256, secret: secret}
+}
+
+// NewEd25519Key returns an Ed25519 key able to sign tokens.
+func NewEd25519Key(kid string, private ed25519.PrivateKey) SigningKey {
+	public := private.Public().(ed25519.PublicKey)
+	return SigningKey{ID: kid, Algorithm: EdDSA, privateKey: private, publicKey: public}
+}
+
+// NewEd25519VerificationKey returns an Ed25519 key that can only verify
+// tokens, for services that don't issue any.
+func NewEd25519VerificationKey(kid string, public ed25519.PublicKey) SigningKey {
+	return SigningKey{ID: kid, Algorithm: EdDSA, publicKey: public}
+}
+
+func (k SigningKey) canSign() bool {
+	return k.secret != nil || k.privateKey != nil
+}
+
+func (k SigningKey) sign(payload []byte) []byte {
+	if k.Algorithm == HS256 {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(payload)
+		return mac.Sum(nil)
+	}
+	return ed25519.Sign(k.privateKey, payload)
+}
+
+func (k SigningKey) verify(payload, signature []byte) bool {
+	if k.Algorithm == HS256 {
+		return hmac.Equal(k.sign(payload), signature)
+	}
+	return ed25519.Verify(k.publicKey, payload, signature)
+}
+
+// Claims is the content of an access token.
+type Claims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	IssuedAt  int64    `json:"iat"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	ID        string   `json:"jti"`
+	Role      int      `json:"role"`
+}
+
+// UserID returns the ID of the user the token was issued to.
+func (c *Claims) UserID() bson.ObjectId {
+	if !bson.IsObjectIdHex(c.Subject) {
+		return ""
+	}
+	return bson.ObjectIdHex(c.Subject)
+}
+
+// audience accepts both forms allowed for the aud claim: a string or
+// an array of strings.
+type audience []string
+
+func (a audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a *audience) UnmarshalJSON(raw []byte) error {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	return json.Unmarshal(raw, (*[]string)(a))
+}
+
+func (a audience) contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
+
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// TokenIssuer mints and verifies signed JSON web tokens.
+// It signs with its active key and verifies with any key it knows, so that
+// keys can be rotated without invalidating the tokens already issued.
+type TokenIssuer struct {
+	config TokenConfig
+	mu     sync.RWMutex
+	keys   map[string]SigningKey
+	active string
+}
+
+// NewTokenIssuer returns an issuer signing with the given key.
+func NewTokenIssuer(cfg TokenConfig, key SigningKey) *TokenIssuer {
+	t := &TokenIssuer{config: cfg, keys: make(map[string]SigningKey)}
+	t.Rotate(key)
+	return t
+}
+
+// AddKey makes the issuer accept tokens signed with key, without signing
+// with it.
+func (t *TokenIssuer) AddKey(key SigningKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.keys[key.ID] = key
+}
+
+// Rotate makes key the one new tokens are signed with. Previous keys are
+// still accepted until removed.
+func (t *TokenIssuer) Rotate(key SigningKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.keys[key.ID] = key
+	t.active = key.ID
+}
+
+// RemoveKey stops accepting tokens signed with the given key.
+func (t *TokenIssuer) RemoveKey(kid string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.keys, kid)
+}
+
+// Issue mints an access token for the user.
+func (t *TokenIssuer) Issue(u *User) (string, error) {
+	t.mu.RLock()
+	key, ok := t.keys[t.active]
+	t.mu.RUnlock()
+	if !ok || !key.canSign() {
+		return "", UnknownTokenKeyError
+	}
+	now := timeNow()
+	claims := Claims{
+		Issuer:    t.config.Issuer,
+		Subject:   u.ID.Hex(),
+		Audience:  audience{t.config.Audience},
+		ExpiresAt: now.Add(t.config.TTL).Unix(),
+		IssuedAt:  now.Unix(),
+		ID:        RandomUrlencodedString(12),
+		Role:      u.Role,
+	}
+	header, err := json.Marshal(tokenHeader{key.Algorithm, "JWT", key.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := encodeSegment(header) + "." + encodeSegment(payload)
+	return signed + "." + encodeSegment(key.sign([]byte(signed))), nil
+}
+
+// Verify checks the token's signature, expiry, issuer and audience, and
+// returns its claims.
+func (t *TokenIssuer) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, InvalidTokenError
+	}
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, InvalidTokenError
+	}
+	t.mu.RLock()
+	key, ok := t.keys[header.KeyID]
+	t.mu.RUnlock()
+	if !ok {
+		return nil, UnknownTokenKeyError
+	}
+	// The algorithm is bound to the key, never taken from the header alone.
+	if header.Algorithm != key.Algorithm {
+		return nil, InvalidTokenError
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, InvalidTokenError
+	}
+	claims := new(Claims)
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, InvalidTokenError
+	}
+	now := timeNow()
+	leeway := t.config.Leeway
+	if claims.ExpiresAt == 0 || now.Add(-leeway).After(time.Unix(claims.ExpiresAt, 0)) {
+		return nil, TokenExpiredError
+	}
+	if claims.NotBefore != 0 && now.Add(leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, InvalidTokenError
+	}
+	if claims.Issuer != t.config.Issuer || !claims.Audience.contains(t.config.Audience) {
+		return nil, InvalidTokenError
+	}
+	if !claims.UserID().Valid() {
+		return nil, InvalidTokenError
+	}
+	return claims, nil
+}
+
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSegment(s string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
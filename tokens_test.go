@@ -0,0 +1,95 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTokenIssuer(t *testing.T) {
+	clock := setupAuthTest(t)
+	u := &User{ID: bson.NewObjectId(), Role: 2}
+	cfg := getConfig().Tokens
+	_, private, _ := ed25519.GenerateKey(rand.Reader)
+
+	issuer := NewTokenIssuer(cfg, NewHS256Key("2015-01", []byte("0123456789abcdef0123456789abcdef")))
+	oldToken, err := issuer.Issue(u)
+	if err != nil {
+		t.Fatal("Issue:", err)
+	}
+	issuer.Rotate(NewEd25519Key("2015-02", private))
+	newToken, _ := issuer.Issue(u)
+	for _, token := range []string{oldToken, newToken} {
+		claims, err := issuer.Verify(token)
+		if err != nil {
+			t.Fatal("Verify:", err)
+		}
+		if claims.UserID() != u.ID || claims.Role != 2 {
+			t.Error("Unexpected claims", claims)
+		}
+	}
+
+	verifier := NewTokenIssuer(cfg, NewEd25519VerificationKey("2015-02", private.Public().(ed25519.PublicKey)))
+	if _, err := verifier.Verify(newToken); err != nil {
+		t.Error("Verification-only issuer rejected a valid token:", err)
+	}
+	if _, err := verifier.Issue(u); err != UnknownTokenKeyError {
+		t.Error("Verification-only issuer signed a token:", err)
+	}
+	if _, err := verifier.Verify(oldToken); err != UnknownTokenKeyError {
+		t.Error("Expected UnknownTokenKeyError for an unknown key, got", err)
+	}
+
+	parts := strings.Split(newToken, ".")
+	if _, err := issuer.Verify(parts[0] + "." + parts[1] + "." + encodeSegment([]byte("forged"))); err != InvalidTokenError {
+		t.Error("Expected InvalidTokenError for a forged signature, got", err)
+	}
+
+	other := cfg
+	other.Audience = "someone-else"
+	if _, err := NewTokenIssuer(other, NewEd25519Key("2015-02", private)).Verify(newToken); err != InvalidTokenError {
+		t.Error("Expected InvalidTokenError for a wrong audience, got", err)
+	}
+
+	*clock = clock.Add(cfg.TTL + cfg.Leeway + time.Second)
+	if _, err := issuer.Verify(newToken); err != TokenExpiredError {
+		t.Error("Expected TokenExpiredError, got", err)
+	}
+}
+
+func TestRefreshTokenRotationAndReuse(t *testing.T) {
+	setupAuthTest(t)
+	u := registerTestUser(t, "dave", "plum-Harbor-42")
+
+	first, _, err := u.NewSession("laptop")
+	if err != nil {
+		t.Fatal("NewSession:", err)
+	}
+	phone, _, _ := u.NewSession("phone")
+
+	refreshed, second, err := RefreshSession(first)
+	if err != nil || refreshed.ID != u.ID {
+		t.Fatal("RefreshSession:", err)
+	}
+	if _, _, err := RefreshSession(first); err != RefreshTokenReusedError {
+		t.Error("Expected RefreshTokenReusedError, got", err)
+	}
+	if _, _, err := RefreshSession(second); err != InvalidRefreshTokenError {
+		t.Error("Session survived token reuse:", err)
+	}
+
+	sessions, _ := u.Sessions()
+	if len(sessions) != 1 || sessions[0].Device != "phone" {
+		t.Fatal("Expected only the phone session, got", sessions)
+	}
+	if err := u.Logout(); err != nil {
+		t.Fatal("Logout:", err)
+	}
+	if _, _, err := RefreshSession(phone); err != InvalidRefreshTokenError {
+		t.Error("Session survived logout:", err)
+	}
+}
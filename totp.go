@@ -0,0 +1,275 @@
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var InvalidOTPError = errors.New("Invalid authentication code.")
+var TOTPAlreadyEnabledError = errors.New("Two-factor authentication is already enabled.")
+var TOTPNotEnrolledError = errors.New("Two-factor authentication is not set up.")
+var InvalidLoginChallengeError = errors.New("Sign in expired, please enter your password again.")
+
+// TOTP parameters, the ones every authenticator app supports (RFC 6238).
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// Codes of the previous and next periods are accepted too, to make up
+	// for clock drift and typing time.
+	totpSkew = 1
+)
+
+// How long the second login step may wait after the password was checked.
+const loginChallengeTTL = 5 * time.Minute
+
+// Number of recovery codes handed out when 2FA is enabled.
+const recoveryCodeCount = 10
+
+// Fields of the user saved by the two-factor operations, which leave the
+// rest of the account alone.
+var totpFields = []string{
+	"totp_secret", "totp_enabled", "totp_last_step", "recovery_codes",
+	"login_challenge", "login_challenge_expires",
+}
+
+// SecondFactorRequiredError is returned by LoginAttempt.Do when the
+// password is right but the user has two-factor authentication enabled.
+// The challenge must be passed to LoginAttempt.DoSecondFactor along with
+// the code.
+type SecondFactorRequiredError struct {
+	Challenge string
+}
+
+func (e *SecondFactorRequiredError) Error() string {
+	return "Authentication code required."
+}
+
+// Computes the code of the given time step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// EnrollTOTP generates a new TOTP secret for the user, and returns it
+// along with an otpauth:// URI to show as a QR code.
+// Two-factor authentication is only enabled by ConfirmTOTP, once the user
+// proved their app generates the right codes.
+func (u *User) EnrollTOTP() (string, string, error) {
+	if err := u.Sync(); err != nil {
+		return "", "", err
+	}
+	if u.TOTPEnabled {
+		return "", "", TOTPAlreadyEnabledError
+	}
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	u.TOTPSecret = base32NoPadding.EncodeToString(raw)
+	if err := getStore().Users().UpdateFields(u, totpFields...); err != nil {
+		return "", "", err
+	}
+	issuer := getConfig().TOTPIssuer
+	params := url.Values{
+		"secret":    {u.TOTPSecret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	uri := "otpauth://totp/" + url.PathEscape(issuer+":"+u.Username) + "?" + params.Encode()
+	return u.TOTPSecret, uri, nil
+}
+
+// ConfirmTOTP enables two-factor authentication if code was generated from
+// the secret given by EnrollTOTP, and returns the recovery codes. They are
+// only stored hashed and can't be shown again.
+func (u *User) ConfirmTOTP(code string) ([]string, error) {
+	if err := u.Sync(); err != nil {
+		return nil, err
+	}
+	if u.TOTPEnabled {
+		return nil, TOTPAlreadyEnabledError
+	}
+	if u.TOTPSecret == "" {
+		return nil, TOTPNotEnrolledError
+	}
+	if !u.checkTOTP(code) {
+		return nil, InvalidOTPError
+	}
+	u.TOTPEnabled = true
+	codes := u.newRecoveryCodes()
+	if err := getStore().Users().UpdateFields(u, totpFields...); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns two-factor authentication off, given a current code
+// or a recovery code.
+func (u *User) DisableTOTP(code string) error {
+	if err := u.Sync(); err != nil {
+		return err
+	}
+	if !u.TOTPEnabled {
+		return TOTPNotEnrolledError
+	}
+	if !u.checkTOTP(code) && !u.useRecoveryCode(code) {
+		return InvalidOTPError
+	}
+	u.clearTOTP()
+	return getStore().Users().UpdateFields(u, totpFields...)
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes, given a
+// current code.
+func (u *User) RegenerateRecoveryCodes(code string) ([]string, error) {
+	if err := u.Sync(); err != nil {
+		return nil, err
+	}
+	if !u.TOTPEnabled {
+		return nil, TOTPNotEnrolledError
+	}
+	if !u.checkTOTP(code) {
+		return nil, InvalidOTPError
+	}
+	codes := u.newRecoveryCodes()
+	return codes, getStore().Users().UpdateFields(u, totpFields...)
+}
+
+// ResetTwoFactor disables two-factor authentication for a user who lost
+// their device and recovery codes, if the acting user is allowed to.
+func (actor *User) ResetTwoFactor(uid string) error {
+	u, err := GetUserById(uid)
+	if err != nil {
+		return err
+	}
+	if err := Authorize(actor, ActionResetTwoFactor, u); err != nil {
+		return err
+	}
+	u.clearTOTP()
+	return getStore().Users().UpdateFields(u, totpFields...)
+}
+
+func (u *User) clearTOTP() {
+	u.TOTPEnabled = false
+	u.TOTPSecret = ""
+	u.TOTPLastStep = 0
+	u.RecoveryCodes = nil
+	u.LoginChallenge = nil
+	u.LoginChallengeExpires = time.Time{}
+}
+
+// Checks a code against the user's secret. A code is only accepted once,
+// and neither are the codes of earlier periods once one was used.
+// The last step used is set on the user, who must be saved.
+func (u *User) checkTOTP(code string) bool {
+	secret, err := base32NoPadding.DecodeString(u.TOTPSecret)
+	if err != nil || len(code) != totpDigits {
+		return false
+	}
+	now := totpStep(timeNow())
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= u.TOTPLastStep {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			u.TOTPLastStep = step
+			return true
+		}
+	}
+	return false
+}
+
+// Sets fresh recovery codes on the user, who must be saved, and returns them.
+func (u *User) newRecoveryCodes() []string {
+	codes := make([]string, recoveryCodeCount)
+	u.RecoveryCodes = make([][]byte, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			panic(err)
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(raw))
+		codes[i] = code[:4] + "-" + code[4:]
+		u.RecoveryCodes[i] = hashToken(codes[i])
+	}
+	return codes
+}
+
+// Consumes a recovery code. The user must be saved.
+func (u *User) useRecoveryCode(code string) bool {
+	hash := hashToken(strings.ToLower(strings.TrimSpace(code)))
+	for i, h := range u.RecoveryCodes {
+		if bytes.Equal(h, hash) {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i], u.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Starts the second login step for a user whose password was checked,
+// returning the challenge to present along with the code.
+func (u *User) newLoginChallenge() (string, error) {
+	raw := RandomUrlencodedString(24)
+	u.LoginChallenge = hashToken(raw)
+	u.LoginChallengeExpires = timeNow().Add(loginChallengeTTL)
+	return raw, getStore().Users().UpdateFields(u, totpFields...)
+}
+
+// DoSecondFactor completes a login interrupted by a
+// *SecondFactorRequiredError, with a TOTP code or a recovery code.
+// A wrong code counts as a failed login.
+func (l *LoginAttempt) DoSecondFactor(challenge, code string) (*User, error) {
+	u, err := getStore().Users().FindByUsername(l.Username)
+	if err == NotFoundError {
+		return nil, InvalidLoginChallengeError
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.EnteredIp, u.EnteredUserAgent = l.Ip, l.UserAgent
+	if !u.TOTPEnabled || u.LoginChallenge == nil || !hmac.Equal(u.LoginChallenge, hashToken(challenge)) ||
+		!timeNow().Before(u.LoginChallengeExpires) {
+		return nil, InvalidLoginChallengeError
+	}
+	if u.IsLocked() {
+		u.recordAttempt(LoginLocked)
+		return nil, &AccountLockedError{u.LockedUntil}
+	}
+	if !u.checkTOTP(code) && !u.useRecoveryCode(code) {
+		if lockErr := u.loginFailed(LoginBadSecondFactor); lockErr != nil {
+			return nil, lockErr
+		}
+		return nil, InvalidOTPError
+	}
+	u.LoginChallenge = nil
+	u.LoginChallengeExpires = time.Time{}
+	if err := getStore().Users().UpdateFields(u, totpFields...); err != nil {
+		return nil, err
+	}
+	u.Login()
+	return u, nil
+}
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 test vectors, truncated to 6 digits.
+	secret := []byte("12345678901234567890")
+	for unix, want := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"} {
+		if got := totpCode(secret, totpStep(time.Unix(unix, 0))); got != want {
+			t.Errorf("At %d: got %s, want %s", unix, got, want)
+		}
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	clock := setupAuthTest(t)
+	registered := registerTestUser(t, "grace", "plum-Harbor-42")
+	// Enrolling from a user known only by ID leaves the account intact.
+	u := &User{ID: registered.ID}
+	secret, uri, err := u.EnrollTOTP()
+	if err != nil {
+		t.Fatal("EnrollTOTP:", err)
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Scheme != "otpauth" || parsed.Query().Get("secret") != secret {
+		t.Fatal("Bad otpauth URI", uri)
+	}
+	raw, _ := base32NoPadding.DecodeString(secret)
+	code := func() string { return totpCode(raw, totpStep(*clock)) }
+
+	if _, err := u.ConfirmTOTP("000000"); err != InvalidOTPError {
+		t.Fatal("Wrong confirmation code accepted:", err)
+	}
+	recovery, err := u.ConfirmTOTP(code())
+	if err != nil || len(recovery) != recoveryCodeCount {
+		t.Fatal("ConfirmTOTP:", err)
+	}
+
+	attempt := &LoginAttempt{Username: "grace", Ip: "192.0.2.1"}
+	_, err = attempt.Do("plum-Harbor-42")
+	required, ok := err.(*SecondFactorRequiredError)
+	if !ok {
+		t.Fatal("Expected a SecondFactorRequiredError, got", err)
+	}
+	if _, err := attempt.DoSecondFactor(required.Challenge, code()); err != InvalidOTPError {
+		t.Error("Code used for confirmation accepted again:", err)
+	}
+	*clock = clock.Add(totpPeriod * time.Second)
+	if _, err := attempt.DoSecondFactor("forged", code()); err != InvalidLoginChallengeError {
+		t.Error("Forged challenge accepted:", err)
+	}
+	if logged, err := attempt.DoSecondFactor(required.Challenge, code()); err != nil || logged.ID != u.ID {
+		t.Fatal("DoSecondFactor:", err)
+	}
+	if _, err := attempt.DoSecondFactor(required.Challenge, code()); err != InvalidLoginChallengeError {
+		t.Error("Challenge reused:", err)
+	}
+
+	// Recovery codes work once.
+	_, err = attempt.Do("plum-Harbor-42")
+	required = err.(*SecondFactorRequiredError)
+	if _, err := attempt.DoSecondFactor(required.Challenge, recovery[0]); err != nil {
+		t.Fatal("Recovery code refused:", err)
+	}
+	_, err = attempt.Do("plum-Harbor-42")
+	required = err.(*SecondFactorRequiredError)
+	if _, err := attempt.DoSecondFactor(required.Challenge, recovery[0]); err != InvalidOTPError {
+		t.Error("Recovery code reused:", err)
+	}
+	*clock = clock.Add(loginChallengeTTL)
+	if _, err := attempt.DoSecondFactor(required.Challenge, recovery[1]); err != InvalidLoginChallengeError {
+		t.Error("Expired challenge accepted:", err)
+	}
+
+	if err := registerTestAdmin(t, "root").ResetTwoFactor(u.ID.Hex()); err != nil {
+		t.Fatal("ResetTwoFactor:", err)
+	}
+	if _, err := attempt.Do("plum-Harbor-42"); err != nil {
+		t.Error("Login after 2FA reset:", err)
+	}
+}
@@ -11,7 +11,6 @@ import (
 	"strings"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -22,26 +21,48 @@ var UsernameAlreadyTakenError = errors.New("Username already taken.")
 var UserAlreadyLoggedIn = errors.New("Current user is already logged in.")
 var InvalidUidError = errors.New("No user with that ID.")
 
+// User is an account of the application.
+// GoogleOAuthSub is deprecated: Google accounts are now among the
+// Identities, where it is moved on first use.
 type User struct {
-	ID               bson.ObjectId `bson:"_id,omitempty"    json:"userID"`
-	Username         string        `bson:"username"         json:"username"`
-	Name             string        `bson:"name"             json:"name"`
-	Location         string        `bson:"location"         json:"location"`
-	URL              string        `bson:"url"              json:"url"`
-	Email            string        `bson:"email"            json:"email"`
-	EmailVerified    bool          `bson:"email_verified"   json:"-"`
-	IsRegistered     bool          `bson:"is_registered"    json:"-"`
-	HasPassword      bool          `bson:"has_password"     json:"-"`
-	IsActive         bool          `bson:"is_active"        json:"-"`
-	Password         []byte        `bson:"password"         json:"-"`
-	Salt             []byte        `bson:"salt"             json:"-"`
-	GoogleOAuthSub   string        `bson:"google_oauth_sub" json:"-"`
-	LastLogin        time.Time     `bson:"last_login"       json:"-"`
-	EnteredPassword  string        `bson:"-"                json:"password"`
-	CodeUsed         bson.ObjectId `bson:"signup_code"      json:"-"`
-	VerificationCode string        `bson:"confirm_code"     json:"-"`
-	Role             int           `bson:"role"             json:"-"`
-	FailedLogins     int           `bson:"fails"            json:"-"`
+	ID                    bson.ObjectId `bson:"_id,omitempty"                     json:"userID"`
+	Username              string        `bson:"username"                          json:"username"`
+	Name                  string        `bson:"name"                              json:"name"`
+	Location              string        `bson:"location"                          json:"location"`
+	URL                   string        `bson:"url"                               json:"url"`
+	Email                 string        `bson:"email"                             json:"email"`
+	EmailVerified         bool          `bson:"email_verified"                    json:"-"`
+	EmailBounced          time.Time     `bson:"email_bounced,omitempty"           json:"emailBounced,omitempty"`
+	IsRegistered          bool          `bson:"is_registered"                     json:"-"`
+	HasPassword           bool          `bson:"has_password"                      json:"-"`
+	IsActive              bool          `bson:"is_active"                         json:"-"`
+	Password              []byte        `bson:"password"                          json:"-"`
+	Salt                  []byte        `bson:"salt,omitempty"                    json:"-"`
+	Identities            []Identity    `bson:"identities,omitempty"              json:"identities"`
+	GoogleOAuthSub        string        `bson:"google_oauth_sub,omitempty"        json:"-"`
+	LastLogin             time.Time     `bson:"last_login"                        json:"-"`
+	EnteredPassword       string        `bson:"-"                                 json:"password"`
+	EnteredIp             string        `bson:"-"                                 json:"-"`
+	EnteredUserAgent      string        `bson:"-"                                 json:"-"`
+	CodeUsed              bson.ObjectId `bson:"signup_code,omitempty"             json:"-"`
+	InvitedBy             bson.ObjectId `bson:"invited_by,omitempty"              json:"-"`
+	InvitesUsed           int           `bson:"invites_used"                      json:"-"`
+	Locale                string        `bson:"locale,omitempty"                  json:"locale"`
+	VerificationCode      string        `bson:"confirm_code"                      json:"-"`
+	VerificationSent      time.Time     `bson:"confirm_sent,omitempty"            json:"-"`
+	Role                  int           `bson:"role"                              json:"-"`
+	FailedLogins          int           `bson:"fails"                             json:"-"`
+	Lockouts              int           `bson:"lockouts"                          json:"-"`
+	LockedUntil           time.Time     `bson:"locked_until,omitempty"            json:"-"`
+	TOTPSecret            string        `bson:"totp_secret,omitempty"             json:"-"`
+	TOTPEnabled           bool          `bson:"totp_enabled"                      json:"twoFactorEnabled"`
+	TOTPLastStep          int64         `bson:"totp_last_step,omitempty"          json:"-"`
+	RecoveryCodes         [][]byte      `bson:"recovery_codes,omitempty"          json:"-"`
+	LoginChallenge        []byte        `bson:"login_challenge,omitempty"         json:"-"`
+	LoginChallengeExpires time.Time     `bson:"login_challenge_expires,omitempty" json:"-"`
+	// PendingMail holds the emails the last changes triggered, until they
+	// are moved to the outbox.
+	PendingMail []OutboxMessage `bson:"pending_mail,omitempty" json:"-"`
 	//ProfileImageUrl         string `json:"profile_image_url"`
 	//ProfileImageUrlHttps    string `json:"profile_image_url_https"`
 }
@@ -49,9 +70,12 @@ type User struct {
 // Sync overwrites the provided user object with the information
 // stored in the database, using the ID property to find it.
 func (u *User) Sync() error {
-	locSession := getSession()
-	defer locSession.Close()
-	return locSession.DB(gqConfig.jobDatabase).C(UsersCollection).FindId(u.ID).One(u)
+	stored, err := getStore().Users().FindByID(u.ID)
+	if err != nil {
+		return err
+	}
+	*u = *stored
+	return nil
 }
 
 // Returns a pointer to a User object, given its ID in the form of a string.
@@ -67,11 +91,7 @@ func GetUserById(uid string) (*User, error) {
 
 // Returns a pointer to a User object, given its username.
 func GetUserByName(username string) (*User, error) {
-	u := new(User)
-	locSession := getSession()
-	defer locSession.Close()
-	c := locSession.DB(gqConfig.jobDatabase).C(UsersCollection)
-	err := c.Find(bson.M{"username": username}).One(u)
+	u, err := getStore().Users().FindByUsername(username)
 	if err != nil {
 		log.Println("GetUserByName error:", err) // Debug code
 	}
@@ -124,9 +144,14 @@ func (u1 *User) MergeAndClean(u2 User) error {
 	if !u1.HasPassword && u2.HasPassword {
 		u1.HasPassword = true
 		u1.Password = u2.Password
+		u1.Salt = u2.Salt
 	}
-	if u1.GoogleOAuthSub == "" {
-		u1.GoogleOAuthSub = u2.GoogleOAuthSub
+	u1.migrateGoogleOAuthSub()
+	u2.migrateGoogleOAuthSub()
+	for _, id := range u2.Identities {
+		if !u1.hasIdentity(id.Provider, id.Subject) {
+			u1.Identities = append(u1.Identities, id)
+		}
 	}
 	if u1.LastLogin.Before(u2.LastLogin) {
 		u1.LastLogin = u2.LastLogin
@@ -134,31 +159,34 @@ func (u1 *User) MergeAndClean(u2 User) error {
 	if u1.IsRegistered || u2.IsRegistered {
 		u1.IsRegistered = true
 	}
-	locSession := getSession()
-	defer locSession.Close()
-	uc := locSession.DB(gqConfig.jobDatabase).C(UsersCollection)
-	if bson.IsObjectIdHex(u2.ID.String()) {
-		docsFinder := bson.M{"owner": u2.ID}
-		change := bson.M{"$set": bson.M{"owner": u1.ID}}
-		err := locSession.DB(gqConfig.jobDatabase).C(DocumentsCollection).Update(docsFinder, change)
+	st := getStore()
+	if u2.ID.Valid() && u2.ID != u1.ID {
+		err := st.Documents().TransferAll(u2.ID, u1.ID)
 		if err != nil {
 			return err
 		}
-		err = uc.RemoveId(u2.ID)
+		err = st.Users().Remove(u2.ID)
 		if err != nil {
 			return err
 		}
 	}
-	return uc.UpdateId(u1.ID, u1)
+	return st.Users().Update(u1)
 }
 
 // Sets the User's email to the provided address, after some checking.
+// A new address has to be verified: EmailVerified and EmailBounced are
+// cleared and a new verification code is generated.
 func (u *User) SetEmail(address string) error {
 	email, err := mail.ParseAddress(address)
 	if err != nil {
 		return err
 	}
-	u.Email = email.Address
+	if email.Address != u.Email {
+		u.Email = email.Address
+		u.EmailVerified = false
+		u.EmailBounced = time.Time{}
+		u.newVerificationCode()
+	}
 	return nil
 }
 
@@ -184,36 +212,81 @@ func (u *User) SetUsername(username string) error {
 	return nil
 }
 
-// Checks the chosen password against some basic rules.
-// Presently, it only checks for the length (8+).
-func validatePassword(password string) error {
-	if len(password) >= 8 {
-		return nil
-	}
-	return errors.New("Inserted password is too short")
+// Checks the password the user chose against the configured policy.
+// The error is a *WeakPasswordError.
+func (u *User) validatePassword(password string) error {
+	return getConfig().PasswordPolicy.Check(password, std.breaches, u.personalWords()...)
 }
 
-// Sets a new password for the calling user.
-// Doesn't check for authentication.
-func (u *User) SetPassword(password string) error {
-	if err := validatePassword(password); err != nil {
+// Sets a new password for the calling user, who must be saved.
+// Doesn't check for authentication: see ChangePassword and SetUserPassword.
+func (u *User) setPassword(password string) error {
+	if err := u.validatePassword(password); err != nil {
 		return err
 	}
-	u.Salt = getSalt()
-	hashedPasswd, err := bcrypt.GenerateFromPassword(append([]byte(password), u.Salt...), bcrypt.DefaultCost)
+	hashedPasswd, err := hashPassword(password, getConfig().Passwords)
 	if err != nil {
 		return err
 	}
 	u.Password = hashedPasswd
+	u.Salt = nil
 	return nil
 }
 
+// ChangePassword replaces the user's password, given the current one.
+// Users without a password, who sign in with an external identity, can
+// set one with an empty current password.
+// As with CheckPassword, a wrong current password counts as a failed
+// login, and nothing can be changed while the account is locked.
+func (u *User) ChangePassword(current, password string) error {
+	ip, userAgent := u.EnteredIp, u.EnteredUserAgent
+	if err := u.Sync(); err != nil {
+		return err
+	}
+	u.EnteredIp, u.EnteredUserAgent = ip, userAgent
+	if u.IsLocked() {
+		u.recordAttempt(LoginLocked)
+		return &AccountLockedError{u.LockedUntil}
+	}
+	if u.HasPassword {
+		err := comparePassword(u.Password, u.Salt, current)
+		if err == WrongPasswordError {
+			if lockErr := u.loginFailed(LoginBadPassword); lockErr != nil {
+				return lockErr
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := u.setPassword(password); err != nil {
+		return err
+	}
+	u.HasPassword = true
+	return getStore().Users().UpdateFields(u, "password", "salt", "has_password")
+}
+
+// SetUserPassword sets the password of the user with the given ID, if the
+// acting user is allowed to.
+func (actor *User) SetUserPassword(uid, password string) error {
+	u, err := GetUserById(uid)
+	if err != nil {
+		return err
+	}
+	if err := Authorize(actor, ActionSetPassword, u); err != nil {
+		return err
+	}
+	if err := u.setPassword(password); err != nil {
+		return err
+	}
+	u.HasPassword = true
+	return getStore().Users().UpdateFields(u, "password", "salt", "has_password")
+}
+
 // Registers a new user, provided as an argument, and transfers its properties
 // to the calling User object after sanitization.
 func (u *User) Register(candidate User) error {
-	locSession := getSession()
-	defer locSession.Close()
-	c := locSession.DB(gqConfig.jobDatabase).C(UsersCollection)
 	err := u.SetUsername(candidate.Username)
 	if err != nil {
 		return err
@@ -222,22 +295,33 @@ func (u *User) Register(candidate User) error {
 	if err != nil {
 		return err
 	}
-	err = u.SetPassword(candidate.EnteredPassword)
+	err = u.setPassword(candidate.EnteredPassword)
 	if err != nil {
 		return err
 	}
+	if candidate.Locale != "" {
+		if err := u.SetLocale(candidate.Locale); err != nil {
+			return err
+		}
+	}
 	u.IsRegistered = true
 	u.IsActive = true
 	u.HasPassword = true
-	u.VerificationCode = RandomUrlencodedString(35)
+	if !u.EmailVerified {
+		u.newVerificationCode()
+	}
 	u.LastLogin = time.Now()
+	if m, err := u.confirmationMail(); err != nil {
+		log.Println("Error queuing confirmation email:", err)
+	} else {
+		u.PendingMail = append(u.PendingMail, *m)
+	}
 
-	err = c.Insert(u)
-	if err != nil {
-		return err
+	err = getStore().Users().Insert(u)
+	if err == DuplicateKeyError {
+		return UsernameAlreadyTakenError
 	}
-	go u.SendConfirmationEmail()
-	return c.Find(bson.M{"username": u.Username}).One(u)
+	return err
 }
 
 func (u *User) UniqueId() interface{} {
@@ -250,9 +334,6 @@ func (u *User) GetById(uid string) error {
 	if !bson.IsObjectIdHex(uid) {
 		return errors.New(fmt.Sprint("User ID not valid:", uid))
 	}
-	bsonid := bson.ObjectIdHex(uid)
-	locSession := getSession()
-	defer locSession.Close()
-	err := locSession.DB(gqConfig.jobDatabase).C(UsersCollection).FindId(bsonid).One(&u)
-	return err
+	u.ID = bson.ObjectIdHex(uid)
+	return u.Sync()
 }
@@ -0,0 +1,116 @@
+package core
+
+import (
+	"errors"
+	"net/url"
+	"time"
+)
+
+var InvalidVerificationCodeError = errors.New("Invalid email verification code.")
+var VerificationCodeExpiredError = errors.New("Email verification code expired, ask for a new one.")
+var EmailAlreadyVerifiedError = errors.New("Email address already verified.")
+var ResendTooSoonError = errors.New("Verification email sent too recently, try again later.")
+var EmailNotVerifiedError = errors.New("Please verify your email address first.")
+
+// Actions that can be reserved to users with a verified email address,
+// through Config.RequireVerifiedEmail.
+const (
+	ActionWriteDocuments = "documents:write"
+	ActionWriteFiles     = "files:write"
+)
+
+// Gives the user a fresh verification code, invalidating the previous one.
+func (u *User) newVerificationCode() {
+	u.VerificationCode = RandomUrlencodedString(35)
+	u.VerificationSent = timeNow()
+}
+
+func (u *User) verificationLink() string {
+	return appLink("/#/verify", url.Values{"code": {u.VerificationCode}})
+}
+
+func (u User) verificationMail() (*OutboxMessage, error) {
+	return renderMail(TemplateVerification, u.Email, u.Locale, map[string]interface{}{
+		"Username": u.Username,
+		"Link":     u.verificationLink(),
+		"TTL":      getConfig().EmailVerificationTTL,
+	})
+}
+
+// VerifyEmail marks as verified the address the code was sent to, and
+// returns its owner.
+func VerifyEmail(code string) (*User, error) {
+	if code == "" {
+		return nil, InvalidVerificationCodeError
+	}
+	u, err := getStore().Users().FindByVerificationCode(code)
+	if err == NotFoundError {
+		return nil, InvalidVerificationCodeError
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !timeNow().Before(u.VerificationSent.Add(getConfig().EmailVerificationTTL)) {
+		return nil, VerificationCodeExpiredError
+	}
+	u.EmailVerified = true
+	u.VerificationCode = ""
+	u.VerificationSent = time.Time{}
+	return u, getStore().Users().UpdateFields(u, "email_verified", "confirm_code", "confirm_sent")
+}
+
+// ResendVerification sends a new verification code to the user's address.
+// Codes can't be sent more often than Config.VerificationResendInterval.
+func (u *User) ResendVerification() error {
+	if err := u.Sync(); err != nil {
+		return err
+	}
+	if u.EmailVerified {
+		return EmailAlreadyVerifiedError
+	}
+	if timeNow().Before(u.VerificationSent.Add(getConfig().VerificationResendInterval)) {
+		return ResendTooSoonError
+	}
+	u.newVerificationCode()
+	m, err := u.verificationMail()
+	if err != nil {
+		return err
+	}
+	return getStore().Users().UpdateFieldsWithMail(u, m, "confirm_code", "confirm_sent")
+}
+
+// ChangeEmail sets a new address for the user, who has to verify it again.
+func (u *User) ChangeEmail(address string) error {
+	if err := u.Sync(); err != nil {
+		return err
+	}
+	previous := u.Email
+	if err := u.SetEmail(address); err != nil {
+		return err
+	}
+	if u.Email == previous {
+		return nil
+	}
+	m, err := u.verificationMail()
+	if err != nil {
+		return err
+	}
+	return getStore().Users().UpdateFieldsWithMail(u, m, "email", "email_verified", "email_bounced", "confirm_code", "confirm_sent")
+}
+
+// Returns EmailNotVerifiedError if the action is reserved to verified
+// addresses and the user's isn't, or EmailBouncedError if it bounced.
+func (u *User) requireVerifiedEmail(action string) error {
+	if u.EmailVerified {
+		return nil
+	}
+	for _, a := range getConfig().RequireVerifiedEmail {
+		if a == action {
+			if !u.EmailBounced.IsZero() {
+				return EmailBouncedError
+			}
+			return EmailNotVerifiedError
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package core
+
+import (
+	"log"
+	"net/mail"
+	"net/url"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Permission needed to see and release the waitlist.
+const ActionManageWaitlist = "waitlist:manage"
+
+// Label of the signup codes released from the waitlist.
+const waitlistLabel = "waitlist"
+
+// WaitlistEntry is a person waiting to be allowed to sign up.
+// Position is only set by Waitlist, for people still waiting.
+type WaitlistEntry struct {
+	ID        bson.ObjectId `bson:"_id"                  json:"id"`
+	Email     string        `bson:"email"                json:"email"`
+	Joined    time.Time     `bson:"joined"               json:"joined"`
+	TokenHash []byte        `bson:"hash,omitempty"       json:"-"`
+	TokenSent time.Time     `bson:"token_sent,omitempty" json:"-"`
+	Verified  time.Time     `bson:"verified,omitempty"   json:"verified,omitempty"`
+	Invited   time.Time     `bson:"invited,omitempty"    json:"invited,omitempty"`
+	Code      bson.ObjectId `bson:"code,omitempty"       json:"-"`
+	Position  int           `bson:"-"                    json:"position,omitempty"`
+	// PendingMail holds the emails sent to the address, until they are
+	// moved to the outbox.
+	PendingMail []OutboxMessage `bson:"pending_mail,omitempty" json:"-"`
+}
+
+func (e *WaitlistEntry) waiting() bool {
+	return !e.Verified.IsZero() && e.Invited.IsZero()
+}
+
+// JoinWaitlist adds the address to the waitlist and sends it a link to
+// confirm it, which VerifyWaitlistEmail checks. People only get a place
+// once they confirmed. Joining again resends the link, at most every
+// Config.VerificationResendInterval.
+// It returns nil if the address is already registered or waiting, so that
+// it can't be used to find out who is.
+func JoinWaitlist(email string) error {
+	address, err := mail.ParseAddress(email)
+	if err != nil {
+		return InvalidEmailAddressError
+	}
+	email = address.Address
+	if _, err := getStore().Users().FindByEmail(email); err != NotFoundError {
+		return err
+	}
+	entries := getStore().Waitlist()
+	now := timeNow()
+	e, err := entries.FindByEmail(email)
+	switch {
+	case err == NotFoundError:
+		e = &WaitlistEntry{ID: bson.NewObjectId(), Email: email, Joined: now}
+		m, err := e.verificationMail(e.newToken(now))
+		if err != nil {
+			return err
+		}
+		e.PendingMail = []OutboxMessage{*m}
+		if err := entries.Insert(e); err != DuplicateKeyError {
+			return err
+		}
+		return nil
+	case err != nil:
+		return err
+	case e.Verified.IsZero() && !now.Before(e.TokenSent.Add(getConfig().VerificationResendInterval)):
+		m, err := e.verificationMail(e.newToken(now))
+		if err != nil {
+			return err
+		}
+		return entries.UpdateFieldsWithMail(e, m, "hash", "token_sent")
+	}
+	return nil
+}
+
+// Gives the entry a fresh verification token and returns it.
+func (e *WaitlistEntry) newToken(now time.Time) string {
+	raw := RandomUrlencodedString(32)
+	e.TokenHash = hashToken(raw)
+	e.TokenSent = now
+	return raw
+}
+
+// Returns the email with the verification link.
+func (e *WaitlistEntry) verificationMail(raw string) (*OutboxMessage, error) {
+	return renderMail(TemplateWaitlistVerification, e.Email, "", map[string]interface{}{
+		"Link": appLink("/#/waitlist/verify", url.Values{"token": {raw}}),
+	})
+}
+
+// VerifyWaitlistEmail confirms the address the token was sent to, which
+// then gets a place on the waitlist.
+func VerifyWaitlistEmail(token string) (*WaitlistEntry, error) {
+	entries := getStore().Waitlist()
+	e, err := entries.FindByHash(hashToken(token))
+	if err == NotFoundError {
+		return nil, InvalidVerificationCodeError
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !timeNow().Before(e.TokenSent.Add(getConfig().EmailVerificationTTL)) {
+		return nil, VerificationCodeExpiredError
+	}
+	e.Verified = timeNow()
+	e.TokenHash = nil
+	return e, entries.UpdateFields(e, "verified", "hash")
+}
+
+// Waitlist lists everyone who joined the waitlist, in the order they did.
+// The people still waiting have their position set, starting at 1.
+func (actor *User) Waitlist() ([]WaitlistEntry, error) {
+	if err := Authorize(actor, ActionManageWaitlist, nil); err != nil {
+		return nil, err
+	}
+	entries, err := getStore().Waitlist().List()
+	if err != nil {
+		return nil, err
+	}
+	position := 0
+	for i := range entries {
+		if entries[i].waiting() {
+			position++
+			entries[i].Position = position
+		}
+	}
+	return entries, nil
+}
+
+// ReleaseWaitlist invites the next n people waiting, sending each of them
+// a code bound to their address. It returns the entries it released.
+// People who registered meanwhile leave the waitlist without a code.
+func (actor *User) ReleaseWaitlist(n int) ([]WaitlistEntry, error) {
+	if err := Authorize(actor, ActionManageWaitlist, nil); err != nil {
+		return nil, err
+	}
+	store := getStore()
+	entries, err := store.Waitlist().List()
+	if err != nil {
+		return nil, err
+	}
+	released := []WaitlistEntry{}
+	for _, e := range entries {
+		if len(released) >= n {
+			break
+		}
+		if !e.waiting() {
+			continue
+		}
+		now := timeNow()
+		_, err := store.Users().FindByEmail(e.Email)
+		if err == nil {
+			if err := store.Waitlist().MarkInvited(e.ID, "", now, nil); err != nil && err != NotFoundError {
+				return released, err
+			}
+			continue
+		}
+		if err != NotFoundError {
+			return released, err
+		}
+		sc := &SignupCode{
+			ID:          bson.NewObjectId(),
+			EmailBound:  true,
+			Email:       e.Email,
+			Label:       waitlistLabel,
+			Creator:     actor.ID,
+			Created:     now,
+			ExpiresAt:   now.Add(getConfig().InvitationTTL),
+			MaxUses:     1,
+			Redemptions: []Redemption{},
+		}
+		if err := sc.persistRandom(nil); err != nil {
+			return released, err
+		}
+		// Only one of concurrent releases marks the entry and queues the
+		// invitation. The others revoke the code they made, as do releases
+		// that can't email it, which leave the entry waiting.
+		invitation, err := invitationMail(nil, sc)
+		if err == nil {
+			err = store.Waitlist().MarkInvited(e.ID, sc.ID, now, invitation)
+		}
+		if err != nil {
+			if revokeErr := store.SignupCodes().Revoke(sc.ID, now); revokeErr != nil {
+				log.Println("Error revoking unused waitlist code:", revokeErr)
+			}
+			if err == NotFoundError || err == SuppressedAddressError {
+				continue
+			}
+			return released, err
+		}
+		e.Invited, e.Code = now, sc.ID
+		released = append(released, e)
+	}
+	return released, nil
+}
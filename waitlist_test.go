@@ -0,0 +1,115 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+// Joins the waitlist and verifies the address, bypassing the email.
+func joinTestWaitlist(t *testing.T, email string) {
+	if err := JoinWaitlist(email); err != nil {
+		t.Fatal("JoinWaitlist:", err)
+	}
+	e, err := getStore().Waitlist().FindByEmail(email)
+	if err != nil {
+		t.Fatal("FindByEmail:", err)
+	}
+	raw := e.newToken(timeNow())
+	getStore().Waitlist().Update(e)
+	if _, err := VerifyWaitlistEmail(raw); err != nil {
+		t.Fatal("VerifyWaitlistEmail:", err)
+	}
+}
+
+func TestWaitlist(t *testing.T) {
+	clock := setupAuthTest(t)
+	admin := registerTestAdmin(t, "admin")
+	bob := registerTestUser(t, "bob", "plum-Harbor-42")
+	if _, err := bob.Waitlist(); err != ForbiddenError {
+		t.Fatal("Expected ForbiddenError, got", err)
+	}
+
+	for _, email := range []string{"first@example.com", "second@example.com", "third@example.com"} {
+		joinTestWaitlist(t, email)
+		*clock = clock.Add(time.Minute)
+	}
+	if err := JoinWaitlist("Second <second@example.com>"); err != nil {
+		t.Fatal("Joining again:", err)
+	}
+	if err := JoinWaitlist("unverified@example.com"); err != nil {
+		t.Fatal("JoinWaitlist:", err)
+	}
+	if err := JoinWaitlist("bob@example.com"); err != nil {
+		t.Fatal("Joining with a registered address:", err)
+	}
+	entries, err := admin.Waitlist()
+	if err != nil {
+		t.Fatal("Waitlist:", err)
+	}
+	if len(entries) != 4 {
+		t.Fatal("Expected 4 entries, got", entries)
+	}
+	if entries[1].Email != "second@example.com" || entries[1].Position != 2 || entries[3].Position != 0 {
+		t.Error("Unexpected positions:", entries)
+	}
+
+	released, err := admin.ReleaseWaitlist(2)
+	if err != nil {
+		t.Fatal("ReleaseWaitlist:", err)
+	}
+	if len(released) != 2 || released[0].Email != "first@example.com" || released[1].Email != "second@example.com" {
+		t.Fatal("Unexpected release:", released)
+	}
+	entries, _ = admin.Waitlist()
+	if entries[2].Position != 1 {
+		t.Error("Expected third@example.com to be first in line, got", entries[2].Position)
+	}
+
+	codes, _ := admin.SignupCodes(waitlistLabel)
+	if len(codes) != 2 {
+		t.Fatal("Expected 2 codes, got", len(codes))
+	}
+	for _, sc := range codes {
+		if sc.Email != "first@example.com" {
+			continue
+		}
+		first := &User{Username: "first", Email: "first@example.com", EnteredPassword: "plum-Harbor-42"}
+		if err := first.SignupWithCode(sc.Code); err != nil {
+			t.Error("SignupWithCode:", err)
+		}
+		if first.InvitedBy != "" {
+			t.Error("Waitlist release recorded as an invitation")
+		}
+	}
+	if released, _ := admin.ReleaseWaitlist(5); len(released) != 1 {
+		t.Error("Expected only the last verified entry released, got", released)
+	}
+}
+
+func TestReleaseSuppressedWaitlist(t *testing.T) {
+	setupAuthTest(t)
+	admin := registerTestAdmin(t, "admin")
+	joinTestWaitlist(t, "gone@example.com")
+	getStore().Suppressions().Add(&Suppression{Email: "gone@example.com", Type: MailBounced})
+
+	if released, err := admin.ReleaseWaitlist(1); err != nil || len(released) != 0 {
+		t.Fatal("Released an entry without emailing it:", released, err)
+	}
+	entries, _ := admin.Waitlist()
+	if len(entries) != 1 || entries[0].Position != 1 {
+		t.Fatalf("Expected the entry to keep waiting, got %+v", entries)
+	}
+	codes, _ := admin.SignupCodes(waitlistLabel)
+	if len(codes) != 1 || codes[0].Revoked.IsZero() {
+		t.Fatalf("Expected the unused code to be revoked, got %+v", codes)
+	}
+
+	admin.Unsuppress("gone@example.com")
+	if released, err := admin.ReleaseWaitlist(1); err != nil || len(released) != 1 {
+		t.Fatal("Expected the entry released, got", released, err)
+	}
+	mail := sentMail()
+	if last := mail[len(mail)-1]; last.To != "gone@example.com" {
+		t.Fatalf("Expected an invitation, got %+v", last)
+	}
+}